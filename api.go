@@ -0,0 +1,94 @@
+package krud
+
+import (
+	"time"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+// The bodies, problems and errors of the API are in package krudapi, so that clients need not
+// import the server. They are here under the same names, for the server and its callers.
+
+type (
+	Date              = krudapi.Date
+	Author            = krudapi.Author
+	Book              = krudapi.Book
+	AuthorBook        = krudapi.AuthorBook
+	Event             = krudapi.Event
+	BulkMode          = krudapi.BulkMode
+	BulkItem          = krudapi.BulkItem
+	BulkResponse      = krudapi.BulkResponse
+	ChainBreak        = krudapi.ChainBreak
+	ChainVerification = krudapi.ChainVerification
+	Webhook           = krudapi.Webhook
+	WebhookMessage    = krudapi.WebhookMessage
+	WebhookDelivery   = krudapi.WebhookDelivery
+	WebhookPayload    = krudapi.WebhookPayload
+	Problem           = krudapi.Problem
+	ValidationError   = krudapi.ValidationError
+	Record            = krudapi.Record
+)
+
+const (
+	MediaJSON    = krudapi.MediaJSON
+	MediaCSV     = krudapi.MediaCSV
+	MediaNDJSON  = krudapi.MediaNDJSON
+	MediaProblem = krudapi.MediaProblem
+
+	CodeValidation    = krudapi.CodeValidation
+	CodeNotFound      = krudapi.CodeNotFound
+	CodeConflict      = krudapi.CodeConflict
+	CodeUnauthorized  = krudapi.CodeUnauthorized
+	CodeForbidden     = krudapi.CodeForbidden
+	CodeNotAcceptable = krudapi.CodeNotAcceptable
+	CodeIdempotency   = krudapi.CodeIdempotency
+	CodeRateLimited   = krudapi.CodeRateLimited
+	CodeInternal      = krudapi.CodeInternal
+
+	BulkAtomic     = krudapi.BulkAtomic
+	BulkBestEffort = krudapi.BulkBestEffort
+
+	WebhookPending   = krudapi.WebhookPending
+	WebhookDelivered = krudapi.WebhookDelivered
+	WebhookDead      = krudapi.WebhookDead
+
+	WebhookSignatureHeader = krudapi.WebhookSignatureHeader
+	WebhookEventHeader     = krudapi.WebhookEventHeader
+	WebhookDeliveryHeader  = krudapi.WebhookDeliveryHeader
+)
+
+// Domain errors, see krudapi.
+var (
+	ErrUnauthorized        = krudapi.ErrUnauthorized
+	ErrForbidden           = krudapi.ErrForbidden
+	ErrDoesNotExist        = krudapi.ErrDoesNotExist
+	ErrConflict            = krudapi.ErrConflict
+	ErrInvalid             = krudapi.ErrInvalid
+	ErrNotAcceptable       = krudapi.ErrNotAcceptable
+	ErrIdempotencyMismatch = krudapi.ErrIdempotencyMismatch
+	ErrRateLimited         = krudapi.ErrRateLimited
+)
+
+var (
+	AuthorCSVHeader          = krudapi.AuthorCSVHeader
+	BookCSVHeader            = krudapi.BookCSVHeader
+	EventCSVHeader           = krudapi.EventCSVHeader
+	WebhookCSVHeader         = krudapi.WebhookCSVHeader
+	WebhookMessageCSVHeader  = krudapi.WebhookMessageCSVHeader
+	WebhookDeliveryCSVHeader = krudapi.WebhookDeliveryCSVHeader
+)
+
+// ParseBulkMode is krudapi.ParseBulkMode.
+func ParseBulkMode(s string) (BulkMode, error) {
+	return krudapi.ParseBulkMode(s)
+}
+
+// SignWebhook is krudapi.SignWebhook.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	return krudapi.SignWebhook(secret, ts, body)
+}
+
+// VerifyWebhook is krudapi.VerifyWebhook.
+func VerifyWebhook(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	return krudapi.VerifyWebhook(secret, signature, body, now, tolerance)
+}
@@ -0,0 +1,270 @@
+package krud
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The events table is partitioned by month, in partitions named like events_2022_06.
+// Events of a month without a partition end up in events_default, which is never archived.
+const eventPartitionFormat = "events_2006_01"
+
+// EventPartitionsAhead is how many months after the current one get partitions made ahead of time.
+const EventPartitionsAhead = 2
+
+// archiveLock is the advisory lock key held while archiving,
+// so that servers sharing a database do not archive the same partition twice.
+const archiveLock = 0x6b727564 // "krud"
+
+// monthOf is the start of the month of t, in UTC like ts.
+func monthOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// RetentionCutoff is when events expire, keeping the current month and the months before it.
+// Partitions ending before the cutoff can be archived.
+func RetentionCutoff(now time.Time, months int) time.Time {
+	return monthOf(now).AddDate(0, -months, 0)
+}
+
+// EnsureEventPartitions makes partitions for the month of now and EventPartitionsAhead months after.
+func EnsureEventPartitions(ctx context.Context, db *sql.DB, now time.Time) error {
+	month := monthOf(now)
+	for i := 0; i <= EventPartitionsAhead; i++ {
+		from := month.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+		name := pgx.Identifier{from.Format(eventPartitionFormat)}.Sanitize()
+		// Bounds are formatted by us, not taken from outside.
+		_, err := db.ExecContext(ctx, fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF events FOR VALUES FROM ('%s') TO ('%s')",
+			name, from.Format(chainTimeFormat), to.Format(chainTimeFormat)))
+		if err != nil {
+			return fmt.Errorf("create partition %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// eventPartitions are the months with a partition, oldest first.
+func eventPartitions(ctx context.Context, db *sql.DB) ([]time.Time, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT c.relname
+         FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+         WHERE i.inhparent = 'events'::regclass
+         ORDER BY c.relname`)
+	if err != nil {
+		return nil, fmt.Errorf("select partitions: %w", err)
+	}
+	defer rows.Close()
+
+	var months []time.Time
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		month, err := time.Parse(eventPartitionFormat, name)
+		if err != nil {
+			// Like events_default.
+			continue
+		}
+		months = append(months, month)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+	return months, nil
+}
+
+// ArchivedPartition is a month of events written to File and then dropped.
+type ArchivedPartition struct {
+	Month  time.Time `json:"month"`
+	File   string    `json:"file"`
+	Events int64     `json:"events"`
+}
+
+// archivedEvent is a line of an archive file.
+// Hashes are kept so that the archive can be checked against the chain.
+type archivedEvent struct {
+	Seq       int64     `json:"seq"`
+	When      time.Time `json:"ts"`
+	Tenant    string    `json:"tenant,omitempty"`
+	User      string    `json:"user"`
+	Operation string    `json:"operation"`
+	Type      string    `json:"type"`
+	ID        *int64    `json:"id,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// ArchiveEvents writes every partition of events that ends before cutoff to a
+// gzipped NDJSON file in dir, and then drops it. Oldest months go first.
+// Nothing is archived while another ArchiveEvents is at it, that one will get to it.
+func ArchiveEvents(ctx context.Context, db *sql.DB, dir string, cutoff time.Time) (archived []ArchivedPartition, err error) {
+	defer observe(ctx, "ArchiveEvents", time.Now(), &err)
+
+	months, err := eventPartitions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, month := range months {
+		if month.AddDate(0, 1, 0).After(cutoff) {
+			break
+		}
+		ap, err := archivePartition(ctx, db, dir, month)
+		if errors.Is(err, errArchiveLocked) {
+			LoggerFrom(ctx).Infof("events are being archived elsewhere")
+			return archived, nil
+		}
+		if err != nil {
+			return archived, err
+		}
+		LoggerFrom(ctx).Infof("archived %d events to %s", ap.Events, ap.File)
+		archived = append(archived, *ap)
+	}
+	return archived, nil
+}
+
+var errArchiveLocked = errors.New("archive locked")
+
+// archivePartition archives the partition of month, see ArchiveEvents.
+// The partition is dropped in the same transaction that read it, after the file is in place.
+func archivePartition(ctx context.Context, db *sql.DB, dir string, month time.Time) (ap *ArchivedPartition, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", archiveLock).Scan(&locked)
+	if err != nil {
+		return nil, fmt.Errorf("lock archive: %w", err)
+	}
+	if !locked {
+		return nil, errArchiveLocked
+	}
+
+	name := month.Format(eventPartitionFormat)
+	ap = &ArchivedPartition{Month: month, File: filepath.Join(dir, name+".ndjson.gz")}
+	first, last, err := writeArchive(ctx, tx, name, ap)
+	if err != nil {
+		return nil, err
+	}
+
+	if ap.Events > 0 {
+		var archivedSeq int64
+		err = tx.QueryRowContext(ctx, "SELECT archived_seq FROM event_chain WHERE id = 1 FOR UPDATE").Scan(&archivedSeq)
+		if err != nil {
+			return nil, fmt.Errorf("lock event chain: %w", err)
+		}
+		// Otherwise what is left cannot be verified.
+		if first.Seq != archivedSeq+1 {
+			return nil, fmt.Errorf("partition %s starts at event %d, not right after archived event %d", name, first.Seq, archivedSeq)
+		}
+		if last.hash == nil {
+			last.hash = []byte{}
+		}
+		_, err = tx.ExecContext(ctx,
+			"UPDATE event_chain SET archived_seq = $1, archived_hash = $2 WHERE id = 1",
+			last.Seq, last.hash)
+		if err != nil {
+			return nil, fmt.Errorf("update event chain: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "DROP TABLE "+pgx.Identifier{name}.Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("drop partition %s: %w", name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return ap, nil
+}
+
+// writeArchive writes the events of partition to ap.File, returning the first and last of them.
+// The file is written next to its final name and renamed, so a file is never half written.
+func writeArchive(ctx context.Context, tx *sql.Tx, partition string, ap *ArchivedPartition) (first, last link, err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(ap.File), "."+partition+"-*")
+	if err != nil {
+		return first, last, fmt.Errorf("create archive: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT seq, ts, COALESCE(tenant_id, ''), username, operation, obj_type, obj_id, prev_hash, hash
+         FROM `+pgx.Identifier{partition}.Sanitize()+`
+         ORDER BY seq`)
+	if err != nil {
+		return first, last, fmt.Errorf("select events: %w", err)
+	}
+	defer rows.Close()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	for rows.Next() {
+		var l link
+		err := rows.Scan(&l.Seq, &l.When, &l.Tenant, &l.User, &l.Operation, &l.Type, &l.ID, &l.prev, &l.hash)
+		if err != nil {
+			return first, last, fmt.Errorf("scanning row: %w", err)
+		}
+		err = enc.Encode(archivedEvent{
+			Seq:       l.Seq,
+			When:      l.When,
+			Tenant:    l.Tenant,
+			User:      l.User,
+			Operation: l.Operation,
+			Type:      l.Type,
+			ID:        l.ID,
+			PrevHash:  hex.EncodeToString(l.prev),
+			Hash:      hex.EncodeToString(l.hash),
+		})
+		if err != nil {
+			return first, last, fmt.Errorf("write archive: %w", err)
+		}
+		if ap.Events == 0 {
+			first = l
+		}
+		last = l
+		ap.Events++
+	}
+	if err := rows.Err(); err != nil {
+		return first, last, fmt.Errorf("going over rows: %w", err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return first, last, fmt.Errorf("write archive: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return first, last, fmt.Errorf("sync archive: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return first, last, fmt.Errorf("close archive: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ap.File); err != nil {
+		return first, last, fmt.Errorf("rename archive: %w", err)
+	}
+	return first, last, nil
+}
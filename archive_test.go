@@ -0,0 +1,32 @@
+package krud_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vikblom/krud"
+)
+
+func TestRetentionCutoff(t *testing.T) {
+	tests := []struct {
+		now    string
+		months int
+		cutoff string
+	}{
+		{"2022-06-15T12:00:00Z", 0, "2022-06-01T00:00:00Z"},
+		{"2022-06-15T12:00:00Z", 3, "2022-03-01T00:00:00Z"},
+		{"2022-01-31T23:59:59Z", 1, "2021-12-01T00:00:00Z"},
+		// Months are in UTC, like ts.
+		{"2022-07-01T01:00:00+02:00", 0, "2022-06-01T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		now, err := time.Parse(time.RFC3339, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := krud.RetentionCutoff(now, tt.months)
+		if got.Format(time.RFC3339) != tt.cutoff {
+			t.Errorf("%s keeping %d months: expected cutoff %s but got: %s", tt.now, tt.months, tt.cutoff, got.Format(time.RFC3339))
+		}
+	}
+}
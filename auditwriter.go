@@ -0,0 +1,233 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAuditWriterClosed is returned when writing to an AuditWriter that has been closed.
+var ErrAuditWriterClosed = errors.New("audit writer closed")
+
+// Defaults of an AuditWriter, see the options.
+const (
+	DefaultAuditBuffer        = 10000
+	DefaultAuditBatchSize     = 1000
+	DefaultAuditFlushInterval = time.Second
+)
+
+// auditFlushAttempts is how many times a batch is tried before it is dropped.
+const auditFlushAttempts = 3
+
+// AuditWriter takes audit events off the request path.
+// Events are buffered and written in batches with COPY, when a batch is full
+// or at an interval, whichever comes first.
+// When the buffer is full writers block, pushing back on the requests making the events.
+// Events that are still buffered are not seen by QueryEvents.
+type AuditWriter struct {
+	db  *sql.DB
+	log *log.Logger
+
+	queue     chan Event
+	batchSize int
+	interval  time.Duration
+
+	// mu guards closed, so that no one sends on queue once it is closed.
+	mu     sync.RWMutex
+	closed bool
+	// done is closed once the last batch is written.
+	done chan struct{}
+}
+
+// AuditWriterOption configures optional parts of an AuditWriter.
+type AuditWriterOption func(*AuditWriter)
+
+// WithAuditBuffer sets how many events may be waiting to be written before writers block.
+func WithAuditBuffer(n int) AuditWriterOption {
+	return func(aw *AuditWriter) {
+		aw.queue = make(chan Event, n)
+	}
+}
+
+// WithAuditBatch sets the max number of events written at once,
+// and how long an event may wait for its batch to fill up.
+func WithAuditBatch(size int, interval time.Duration) AuditWriterOption {
+	return func(aw *AuditWriter) {
+		aw.batchSize = size
+		aw.interval = interval
+	}
+}
+
+// NewAuditWriter starts writing events to db in the background, until closed.
+func NewAuditWriter(log *log.Logger, db *sql.DB, opts ...AuditWriterOption) *AuditWriter {
+	aw := &AuditWriter{
+		db:        db,
+		log:       log,
+		queue:     make(chan Event, DefaultAuditBuffer),
+		batchSize: DefaultAuditBatchSize,
+		interval:  DefaultAuditFlushInterval,
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(aw)
+	}
+	if aw.batchSize < 1 {
+		aw.batchSize = 1
+	}
+	if aw.interval <= 0 {
+		aw.interval = DefaultAuditFlushInterval
+	}
+	go aw.run()
+	return aw
+}
+
+// Write queues e to be written, blocking while the buffer is full.
+func (aw *AuditWriter) Write(ctx context.Context, e Event) error {
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.closed {
+		return ErrAuditWriterClosed
+	}
+
+	select {
+	case aw.queue <- e:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audit buffer full: %w", ctx.Err())
+	}
+}
+
+// Close stops taking new events and waits for the buffered ones to be written,
+// or for ctx to be done.
+func (aw *AuditWriter) Close(ctx context.Context) error {
+	aw.mu.Lock()
+	if !aw.closed {
+		aw.closed = true
+		close(aw.queue)
+	}
+	aw.mu.Unlock()
+
+	select {
+	case <-aw.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flush audit events: %w", ctx.Err())
+	}
+}
+
+func (aw *AuditWriter) run() {
+	defer close(aw.done)
+
+	ticker := time.NewTicker(aw.interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, aw.batchSize)
+	for {
+		select {
+		case e, ok := <-aw.queue:
+			if !ok {
+				aw.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) < aw.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		aw.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes batch, trying a few times before giving up on it.
+func (aw *AuditWriter) flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 1; attempt <= auditFlushAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = copyEvents(ctx, aw.db, batch)
+		cancel()
+		if err == nil {
+			for _, e := range batch {
+				auditEvents.WithLabelValues(e.Operation, e.Type).Inc()
+			}
+			return
+		}
+		time.Sleep(retryWait(100*time.Millisecond, attempt))
+	}
+	auditDropped.Add(float64(len(batch)))
+	aw.log.Errorf("dropped %d audit events: %v", len(batch), err)
+}
+
+// copyEvents inserts events with COPY, which needs a pgx connection underneath db.
+// The events are linked onto the chain in the same transaction.
+func copyEvents(ctx context.Context, db *sql.DB, events []Event) (err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	links, err := linkEvents(ctx, tx, events)
+	if err != nil {
+		return err
+	}
+	rows := make([][]interface{}, len(links))
+	for i, l := range links {
+		var tenant *string
+		if l.Tenant != "" {
+			tenant = &links[i].Tenant
+		}
+		rows[i] = []interface{}{l.Seq, l.When, tenant, l.User, l.Operation, l.Type, l.ID, l.prev, l.hash}
+	}
+
+	// The same connection, so still within tx.
+	err = conn.Raw(func(driverConn interface{}) error {
+		pc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY needs a pgx connection, not %T", driverConn)
+		}
+		_, err := pc.Conn().CopyFrom(ctx,
+			pgx.Identifier{"events"},
+			[]string{"seq", "ts", "tenant_id", "username", "operation", "obj_type", "obj_id", "prev_hash", "hash"},
+			pgx.CopyFromRows(rows))
+		if err != nil {
+			return fmt.Errorf("copy events: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := advanceChain(ctx, tx, links); err != nil {
+		return err
+	}
+	if err := enqueueWebhooks(ctx, tx, links); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,37 @@
+package krud_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+func TestAuditWriterClosed(t *testing.T) {
+	// Nothing is written so the database is never reached.
+	db, err := sql.Open("pgx", "postgres://nowhere/krud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	log, _ := test.NewNullLogger()
+	aw := krud.NewAuditWriter(log, db)
+	if err := aw.Close(context.Background()); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// Closing twice is fine.
+	if err := aw.Close(context.Background()); err != nil {
+		t.Fatalf("close again: %v", err)
+	}
+
+	err = aw.Write(context.Background(), krud.Event{When: time.Now(), User: TEST_USER, Operation: krud.AUDIT_OP_READ, Type: "authors"})
+	if !errors.Is(err, krud.ErrAuditWriterClosed) {
+		t.Errorf("expected writing after close to fail but got: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BulkResult is the outcome of importing a single item.
+// ID is only set if the item is in the database when the import is done.
+type BulkResult struct {
+	ID  int64
+	Err error
+}
+
+// bulkBatchSize is how many rows go into a single INSERT.
+const bulkBatchSize = 500
+
+// errBulkAborted rolls back the transaction of an atomic import with failed items.
+var errBulkAborted = errors.New("bulk import aborted")
+
+// AddAuthors inserts authors in batches, in a single transaction.
+// results line up with authors.
+func (adb *AuditDB) AddAuthors(ctx context.Context, authors []Author, mode BulkMode) (results []BulkResult, err error) {
+	defer observe(ctx, "AddAuthors", time.Now(), &err)
+
+	results = make([]BulkResult, len(authors))
+	insert := func(ctx context.Context, tx *sql.Tx, lo, hi int) error {
+		ids, err := nextIDs(ctx, tx, "authors", hi-lo)
+		if err != nil {
+			return err
+		}
+
+		var values []string
+		var args []interface{}
+		for i, a := range authors[lo:hi] {
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3))
+			args = append(args, ids[i], a.Name, time.Time(a.DateOfBirth))
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO authors (id, name, date_of_birth)
+             VALUES `+strings.Join(values, ", "),
+			args...)
+		if err != nil {
+			return fmt.Errorf("insert authors: %w", err)
+		}
+
+		err = adb.insertEvents(ctx, tx, "authors", AUDIT_OP_CREATE, ids)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			results[lo+i].ID = id
+		}
+		return nil
+	}
+
+	err = adb.bulk(ctx, "AddAuthors", len(authors), mode, results, insert)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AddBooks inserts books, each with their author, in batches in a single transaction.
+// results line up with books.
+func (adb *AuditDB) AddBooks(ctx context.Context, books []AuthorBook, mode BulkMode) (results []BulkResult, err error) {
+	defer observe(ctx, "AddBooks", time.Now(), &err)
+
+	results = make([]BulkResult, len(books))
+	insert := func(ctx context.Context, tx *sql.Tx, lo, hi int) error {
+		ids, err := nextIDs(ctx, tx, "books", hi-lo)
+		if err != nil {
+			return err
+		}
+
+		var values []string
+		var args []interface{}
+		for i, b := range books[lo:hi] {
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
+			args = append(args, ids[i], b.AuthorID, b.Title, time.Time(b.Published))
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO books (id, author_id, title, published)
+             VALUES `+strings.Join(values, ", "),
+			args...)
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("author: %w", ErrDoesNotExist)
+		}
+		if err != nil {
+			return fmt.Errorf("insert books: %w", err)
+		}
+
+		err = adb.insertEvents(ctx, tx, "books", AUDIT_OP_CREATE, ids)
+		if err != nil {
+			return err
+		}
+		for i, id := range ids {
+			results[lo+i].ID = id
+		}
+		return nil
+	}
+
+	err = adb.bulk(ctx, "AddBooks", len(books), mode, results, insert)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// bulk runs insert over [0, n) in batches within one transaction, the one of op.
+// A batch that fails is retried one item at a time to find out which items are at fault,
+// their errors are put in results. In atomic mode any such failure rolls back everything,
+// but the remaining batches are still tried so that all failing items are reported.
+func (adb *AuditDB) bulk(ctx context.Context, op string, n int, mode BulkMode, results []BulkResult, insert func(ctx context.Context, tx *sql.Tx, lo, hi int) error) error {
+
+	err := adb.wrapInTransaction(ctx, op, func(ctx context.Context, tx *sql.Tx) error {
+		// Start over if this is a retry.
+		for i := range results {
+			results[i] = BulkResult{}
+		}
+		for lo := 0; lo < n; lo += bulkBatchSize {
+			hi := lo + bulkBatchSize
+			if hi > n {
+				hi = n
+			}
+
+			err := savepoint(ctx, tx, "bulk_batch", func() error {
+				return insert(ctx, tx, lo, hi)
+			})
+			if err == nil {
+				continue
+			}
+
+			// Retry one by one to single out the failing items.
+			for i := lo; i < hi; i++ {
+				err := savepoint(ctx, tx, "bulk_item", func() error {
+					return insert(ctx, tx, i, i+1)
+				})
+				if err != nil {
+					results[i] = BulkResult{Err: translate(err)}
+				}
+			}
+		}
+
+		if mode == BulkAtomic {
+			for _, r := range results {
+				if r.Err != nil {
+					return errBulkAborted
+				}
+			}
+		}
+		return nil
+	})
+
+	if errors.Is(err, errBulkAborted) {
+		// Nothing made it in.
+		for i := range results {
+			results[i].ID = 0
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	return nil
+}
+
+// savepoint runs action such that if it fails, only its changes are undone,
+// leaving the transaction usable.
+func savepoint(ctx context.Context, tx *sql.Tx, name string, action func() error) error {
+	_, err := tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return fmt.Errorf("savepoint: %w", err)
+	}
+
+	err = action()
+	if err != nil {
+		_, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+		if rbErr != nil {
+			return fmt.Errorf("rollback to savepoint failed because '%v' after err: %w", rbErr, err)
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	if err != nil {
+		return fmt.Errorf("release savepoint: %w", err)
+	}
+	return nil
+}
+
+// nextIDs reserves n ids from the serial id column of table.
+// Explicit ids let us know which row got which id, regardless of insert order.
+func nextIDs(ctx context.Context, tx *sql.Tx, table string, n int) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT nextval(pg_get_serial_sequence($1, 'id'))
+         FROM generate_series(1, $2)`,
+		table, n)
+	if err != nil {
+		return nil, fmt.Errorf("reserve ids: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+	return ids, nil
+}
+
+// insertEvents records operation op on many objects of the same type with a single INSERT.
+func (adb *AuditDB) insertEvents(ctx context.Context, tx *sql.Tx, objType, op string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	events := make([]Event, len(ids))
+	for i := range ids {
+		events[i] = Event{When: now, Tenant: adb.tenant, User: adb.user, Operation: op, Type: objType, ID: &ids[i]}
+	}
+	return appendEvents(ctx, tx, events)
+}
@@ -0,0 +1,282 @@
+package krud
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events form a hash chain, making edits to the events table evident.
+// Every event has a seq, its position in the chain without gaps, and a hash
+// over its fields and the hash of the event before it. The tail of the chain,
+// in the event_chain table, is locked by whoever appends to the chain
+// so that events are linked one transaction at a time.
+// Time never goes backwards along the chain, so a month of events is a stretch of it,
+// and archiving the oldest months cuts the chain at a single place.
+
+// chainTimeFormat is how ts is hashed. The column has microsecond precision and no time zone.
+const chainTimeFormat = "2006-01-02T15:04:05.000000"
+
+// link is an event in the chain.
+type link struct {
+	Event
+	prev []byte
+	hash []byte
+}
+
+// chainHash is the hash of e, following the event with hash prev.
+// Fields are length prefixed so that no two events hash the same input.
+// Events from tenantFrom on hash their tenant, marked apart from no tenant. Events before it
+// leave out DefaultTenant and no tenant alike, as they were hashed when the chain began.
+func chainHash(prev []byte, e Event, tenantFrom int64) []byte {
+	id := ""
+	if e.ID != nil {
+		id = strconv.FormatInt(*e.ID, 10)
+	}
+	fields := []string{
+		string(prev),
+		strconv.FormatInt(e.Seq, 10),
+		e.When.Format(chainTimeFormat),
+		e.User,
+		e.Operation,
+		e.Type,
+		id,
+	}
+	switch {
+	case e.Seq >= tenantFrom && e.Tenant == "":
+		fields = append(fields, "\x00")
+	case e.Seq >= tenantFrom:
+		fields = append(fields, "\x01"+e.Tenant)
+	case e.Tenant != "" && e.Tenant != DefaultTenant:
+		fields = append(fields, e.Tenant)
+	}
+
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	for _, field := range fields {
+		n := binary.PutUvarint(buf[:], uint64(len(field)))
+		h.Write(buf[:n])
+		h.Write([]byte(field))
+	}
+	return h.Sum(nil)
+}
+
+// linkEvents appends events to the chain in tx, locking its tail until tx ends.
+// The returned links are what should be inserted, in order, before advanceChain.
+// Tenants cannot touch event_chain, so its tail is locked through lock_event_chain().
+func linkEvents(ctx context.Context, tx *sql.Tx, events []Event) ([]link, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+
+	var seq, tenantFrom int64
+	var prev []byte
+	var last sql.NullTime
+	err := tx.QueryRowContext(ctx,
+		"SELECT seq, hash, ts, tenant_hashed_from FROM lock_event_chain()").
+		Scan(&seq, &prev, &last, &tenantFrom)
+	if err != nil {
+		return nil, fmt.Errorf("lock event chain: %w", err)
+	}
+
+	links := make([]link, len(events))
+	for i, e := range events {
+		seq++
+		e.Seq = seq
+		// What the database keeps, so that the hash can be checked later.
+		e.When = e.When.UTC().Truncate(time.Microsecond)
+		// Events made before, but linked after, another event.
+		if last.Valid && e.When.Before(last.Time) {
+			e.When = last.Time
+		}
+		last = sql.NullTime{Time: e.When, Valid: true}
+		hash := chainHash(prev, e, tenantFrom)
+		links[i] = link{Event: e, prev: prev, hash: hash}
+		prev = hash
+	}
+	return links, nil
+}
+
+// advanceChain moves the tail of the chain onto the last of links, once they are inserted in tx.
+// advance_event_chain takes the tail from the inserted event, so it cannot be set to anything else.
+func advanceChain(ctx context.Context, tx *sql.Tx, links []link) error {
+	if len(links) == 0 {
+		return nil
+	}
+	seq := links[len(links)-1].Seq
+	if _, err := tx.ExecContext(ctx, "SELECT advance_event_chain($1)", seq); err != nil {
+		return fmt.Errorf("advance event chain: %w", err)
+	}
+	// Delivered when, and if, tx commits.
+	_, err := tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", EventsChannel, strconv.FormatInt(seq, 10))
+	if err != nil {
+		return fmt.Errorf("notify events: %w", err)
+	}
+	return nil
+}
+
+// appendEvents inserts events, linked onto the chain, in tx.
+func appendEvents(ctx context.Context, tx *sql.Tx, events []Event) error {
+	links, err := linkEvents(ctx, tx, events)
+	if err != nil {
+		return err
+	}
+
+	// Stay well below the max number of parameters in a statement.
+	const maxRows = 1000
+	for lo := 0; lo < len(links); lo += maxRows {
+		hi := lo + maxRows
+		if hi > len(links) {
+			hi = len(links)
+		}
+
+		values := make([]string, 0, hi-lo)
+		args := make([]interface{}, 0, 9*(hi-lo))
+		for _, l := range links[lo:hi] {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, NULLIF($%d, ''), $%d, $%d, $%d, $%d, $%d, $%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9))
+			args = append(args, l.Seq, l.When, l.Tenant, l.User, l.Operation, l.Type, l.ID, l.prev, l.hash)
+		}
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO events (seq, ts, tenant_id, username, operation, obj_type, obj_id, prev_hash, hash)
+             VALUES `+strings.Join(values, ", "),
+			args...)
+		if err != nil {
+			return fmt.Errorf("insert events: %w", err)
+		}
+	}
+	if err := advanceChain(ctx, tx, links); err != nil {
+		return err
+	}
+
+	if err := enqueueWebhooks(ctx, tx, links); err != nil {
+		return err
+	}
+
+	return afterCommit(ctx, func() error {
+		for _, e := range events {
+			auditEvents.WithLabelValues(e.Operation, e.Type).Inc()
+		}
+		return nil
+	})
+}
+
+// VerifyChain walks the chain of events in db, stopping at the first broken link.
+// The chain runs through every tenant, so db must not be kept to one.
+// Edited, removed or inserted events break the chain, as does cutting off its end,
+// unless the tail in event_chain is edited to match.
+// Archived events are not checked, the chain is picked up where they end.
+func VerifyChain(ctx context.Context, db *sql.DB) (*ChainVerification, error) {
+	// Same snapshot for the tail and the events.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("create transaction: %w", err)
+	}
+	// Read only, nothing to commit.
+	defer tx.Rollback()
+
+	var tailSeq, archivedSeq, tenantFrom int64
+	var tailHash, archivedHash []byte
+	err = tx.QueryRowContext(ctx,
+		"SELECT seq, hash, archived_seq, archived_hash, tenant_hashed_from FROM event_chain WHERE id = 1").
+		Scan(&tailSeq, &tailHash, &archivedSeq, &archivedHash, &tenantFrom)
+	if err != nil {
+		return nil, fmt.Errorf("select event chain: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT seq, ts, COALESCE(tenant_id, ''), username, operation, obj_type, obj_id, prev_hash, hash
+         FROM events
+         ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("select events: %w", err)
+	}
+	defer rows.Close()
+
+	v := &ChainVerification{}
+	broken := func(seq int64, format string, args ...interface{}) (*ChainVerification, error) {
+		v.Broken = &ChainBreak{Seq: seq, Reason: fmt.Sprintf(format, args...)}
+		return v, nil
+	}
+
+	next := archivedSeq + 1
+	prev := archivedHash
+	chained := len(prev) > 0
+	for rows.Next() {
+		var l link
+		err := rows.Scan(&l.Seq, &l.When, &l.Tenant, &l.User, &l.Operation, &l.Type, &l.ID, &l.prev, &l.hash)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+
+		if l.Seq != next {
+			return broken(next, "events %d to %d are missing", next, l.Seq-1)
+		}
+		next++
+
+		if l.hash == nil {
+			if chained {
+				return broken(l.Seq, "event is not chained")
+			}
+			v.Unchained++
+			continue
+		}
+		chained = true
+
+		if !bytes.Equal(l.prev, prev) {
+			return broken(l.Seq, "event does not link to the event before it")
+		}
+		if !bytes.Equal(chainHash(prev, l.Event, tenantFrom), l.hash) {
+			return broken(l.Seq, "hash does not match, the event was changed")
+		}
+		prev = l.hash
+		v.Checked++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+
+	if tailSeq != next-1 {
+		return broken(next, "chain ends at event %d, but its tail is at event %d", next-1, tailSeq)
+	}
+	if !bytes.Equal(tailHash, prev) {
+		return broken(tailSeq, "hash of the last event does not match the tail of the chain")
+	}
+	v.OK = true
+	return v, nil
+}
+
+// VerifyEvents checks the chain of events, see VerifyChain.
+// That is the whole chain, through every tenant, so only whether it holds is told.
+// Counts and where it breaks are logged, and told in full by VerifyChain to whoever runs it on the database.
+func (adb *AuditDB) VerifyEvents(ctx context.Context) (v *ChainVerification, err error) {
+	defer observe(ctx, "VerifyEvents", time.Now(), &err)
+
+	v, err = VerifyChain(ctx, adb.db)
+	if err != nil {
+		return nil, translate(err)
+	}
+	if !v.OK {
+		LoggerFrom(ctx).Warnf("audit chain broken at event %d: %s", v.Broken.Seq, v.Broken.Reason)
+	}
+	return &ChainVerification{OK: v.OK}, nil
+}
+
+// EventSeq is the seq of the last event, 0 if there are none.
+// The chain runs through every tenant, so this is the last event of any of them.
+func (adb *AuditDB) EventSeq(ctx context.Context) (seq int64, err error) {
+	defer observe(ctx, "EventSeq", time.Now(), &err)
+
+	err = adb.db.QueryRowContext(ctx, "SELECT seq FROM event_chain WHERE id = 1").Scan(&seq)
+	if err != nil {
+		return 0, translate(fmt.Errorf("select event chain: %w", err))
+	}
+	return seq, nil
+}
@@ -0,0 +1,300 @@
+// Package client is a Go client of the krud HTTP API, as served by krud.NewController.
+//
+// Methods mirror the krud.Databaser they end up calling on the server, but take and return
+// the bodies of the API, from package krudapi, which unlike krud needs nothing but the standard
+// library. Failed requests return an *Error, which matches the domain errors of krudapi with errors.Is:
+//
+//	c, err := client.New("http://localhost:8080/api", client.WithUser("alice"))
+//	...
+//	_, err = c.GetAuthor(ctx, 42)
+//	if errors.Is(err, krudapi.ErrDoesNotExist) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+// Defaults of a Client, see the options.
+const (
+	DefaultAttempts = 3
+	DefaultBackoff  = 100 * time.Millisecond
+	DefaultTimeout  = 30 * time.Second
+)
+
+// Limits of a Client.
+const (
+	// maxBackoff caps the wait between attempts.
+	maxBackoff = 5 * time.Second
+	// maxRetryAfter is the longest Retry-After waited for, later than that the error is returned.
+	maxRetryAfter = time.Minute
+	// maxErrorBody caps how much of an error response is read.
+	maxErrorBody = 1 << 20
+)
+
+// Client makes requests to the krud HTTP API. It is safe for concurrent use.
+type Client struct {
+	base *url.URL
+	http *http.Client
+	user string
+
+	attempts int
+	backoff  time.Duration
+}
+
+// Option configures optional parts of a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the client requests are made with.
+// Use it to authenticate with a client certificate, through the TLSClientConfig of its transport.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithUser makes requests as user, in the user header.
+func WithUser(user string) Option {
+	return func(c *Client) {
+		c.user = user
+	}
+}
+
+// WithRetry sets how many attempts an idempotent request gets, and the wait after the
+// first failed one, doubling after each. Only failures that may pass are tried again,
+// like a lost connection or a 503. A longer Retry-After from the server is waited for instead.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.attempts = attempts
+		c.backoff = backoff
+	}
+}
+
+// New is a Client of the API at baseURL, like http://localhost:8080/api.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parse base url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("base url must be http or https: '%s'", baseURL)
+	}
+	c := &Client{
+		base:     base,
+		http:     &http.Client{Timeout: DefaultTimeout},
+		attempts: DefaultAttempts,
+		backoff:  DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.attempts < 1 {
+		c.attempts = 1
+	}
+	return c, nil
+}
+
+// Error is a request the API responded to with an error status.
+// It unwraps to the domain error of its problem, if any, like krudapi.ErrDoesNotExist.
+type Error struct {
+	StatusCode int
+	Problem    krudapi.Problem
+	// RetryAfter is when the server asked to be tried again, like when rate limited.
+	RetryAfter time.Duration
+
+	// body is the JSON body of an error that is not a problem, like a failed atomic import.
+	body []byte
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("krud: %d %s", e.StatusCode, e.Problem.Code)
+	if e.Problem.Code == "" {
+		msg = fmt.Sprintf("krud: %d %s", e.StatusCode, e.Problem.Title)
+	}
+	if e.Problem.Detail != "" {
+		msg += ": " + e.Problem.Detail
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Problem.Err()
+}
+
+// request is a request to the API, its body is kept around to be sent again.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	// idempotent requests can be sent again, GETs and DELETEs always are.
+	idempotent bool
+}
+
+// newRequest is a request with v as JSON body, unless v is nil.
+func newRequest(method, path string, v interface{}) (*request, error) {
+	req := &request{
+		method:     method,
+		path:       path,
+		header:     http.Header{},
+		idempotent: method == http.MethodGet || method == http.MethodDelete,
+	}
+	if v != nil {
+		body, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("json encode body: %w", err)
+		}
+		req.body = body
+		req.header.Set("Content-Type", krudapi.MediaJSON)
+	}
+	return req, nil
+}
+
+// withIdempotencyKey makes a create safe to send again, the server replays the first response.
+func (req *request) withIdempotencyKey() error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("idempotency key: %w", err)
+	}
+	req.header.Set("Idempotency-Key", hex.EncodeToString(b))
+	req.idempotent = true
+	return nil
+}
+
+// do sends req, trying again if it is idempotent, and decodes a successful response into out,
+// unless it is nil. An io.Writer out gets the body as is.
+func (c *Client) do(ctx context.Context, req *request, out interface{}) error {
+	attempts := 1
+	if req.idempotent {
+		attempts = c.attempts
+	}
+	wait := c.backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = c.send(ctx, req, out)
+		if !retry || attempt >= attempts {
+			return err
+		}
+		pause := wait
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > pause {
+			if e.RetryAfter > maxRetryAfter {
+				return err
+			}
+			pause = e.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pause):
+		}
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// send makes a single attempt at req, and tells if another attempt may go better.
+func (c *Client) send(ctx context.Context, req *request, out interface{}) (retry bool, err error) {
+	u := *c.base
+	u.Path += req.path
+	u.RawQuery = req.query.Encode()
+
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	hr, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return false, err
+	}
+	for k, vs := range req.header {
+		hr.Header[k] = vs
+	}
+	hr.Header.Set("Accept", krudapi.MediaJSON)
+	if c.user != "" {
+		hr.Header.Set("user", c.user)
+	}
+
+	resp, err := c.http.Do(hr)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("%s %s: %w", req.method, req.path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retryable(resp.StatusCode), newError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	if w, ok := out.(io.Writer); ok {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return false, fmt.Errorf("%s %s: read response: %w", req.method, req.path, err)
+		}
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("%s %s: json decode response: %w", req.method, req.path, err)
+	}
+	return false, nil
+}
+
+// retryable tells if a request that failed with status may go through if sent again.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newError is the Error of resp, with its problem if there is one.
+func newError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return fmt.Errorf("%s: read response: %w", resp.Status, err)
+	}
+	media := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(media, krudapi.MediaProblem) && json.Unmarshal(data, &e.Problem) == nil {
+		return e
+	}
+
+	// Not a problem, the best we can do is the status.
+	e.Problem = krudapi.Problem{
+		Title:  http.StatusText(resp.StatusCode),
+		Status: resp.StatusCode,
+	}
+	if strings.HasPrefix(media, krudapi.MediaJSON) {
+		e.body = data
+	} else {
+		// Like the plain text of the router or a proxy.
+		e.Problem.Detail = strings.TrimSpace(string(data))
+	}
+	return e
+}
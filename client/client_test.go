@@ -0,0 +1,220 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"go/build"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vikblom/krud"
+	"github.com/vikblom/krud/client"
+	"github.com/vikblom/krud/krudtest"
+)
+
+func newClient(t *testing.T, srv *httptest.Server, opts ...client.Option) *client.Client {
+	t.Helper()
+	opts = append([]client.Option{client.WithUser("alice"), client.WithRetry(3, time.Millisecond)}, opts...)
+	c, err := client.New(srv.URL+"/api", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func date(s string) krud.Date {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return krud.Date(t)
+}
+
+func TestClientAuthorsAndBooks(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, krudtest.NewServer(t, krudtest.NewMemDB(), nil))
+
+	author, err := c.CreateAuthor(ctx, krud.Author{Name: "Ursula K. Le Guin", DateOfBirth: date("1929-10-21")})
+	if err != nil {
+		t.Fatalf("create author: %v", err)
+	}
+	if author.ID == 0 {
+		t.Fatalf("expected an id but got: %+v", author)
+	}
+
+	updated, err := c.UpdateAuthor(ctx, krud.Author{ID: author.ID, Name: "Ursula Le Guin"})
+	if err != nil {
+		t.Fatalf("update author: %v", err)
+	}
+	if updated.Name != "Ursula Le Guin" || updated.DateOfBirth.Format("2006-01-02") != "1929-10-21" {
+		t.Errorf("expected the name changed and the birthdate kept but got: %+v", updated)
+	}
+
+	book, err := c.CreateBook(ctx, author.ID, krud.Book{Title: "The Dispossessed", Published: date("1974-05-01")})
+	if err != nil {
+		t.Fatalf("create book: %v", err)
+	}
+	books, err := c.ListBooks(ctx, author.ID)
+	if err != nil {
+		t.Fatalf("list books: %v", err)
+	}
+	if len(books) != 1 || books[0].Title != "The Dispossessed" {
+		t.Errorf("expected the book but got: %+v", books)
+	}
+
+	if err := c.DeleteBook(ctx, author.ID, book.ID); err != nil {
+		t.Fatalf("delete book: %v", err)
+	}
+	_, err = c.GetBook(ctx, author.ID, book.ID)
+	if !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected the book to be gone but got: %v", err)
+	}
+
+	authors, err := c.ListAuthors(ctx)
+	if err != nil {
+		t.Fatalf("list authors: %v", err)
+	}
+	if len(authors) != 1 || authors[0].ID != author.ID {
+		t.Errorf("expected the author but got: %+v", authors)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := krudtest.NewServer(t, krudtest.NewMemDB(), nil, krud.WithAuthMode(krud.AuthHeader))
+	c := newClient(t, srv)
+
+	_, err := c.CreateAuthor(ctx, krud.Author{Name: "R2-D2", DateOfBirth: date("1977-05-25")})
+	if !errors.Is(err, krud.ErrInvalid) {
+		t.Errorf("expected invalid but got: %v", err)
+	}
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusBadRequest || e.Problem.Field != "name" {
+		t.Errorf("expected a bad request about the name but got: %#v", err)
+	}
+
+	_, err = c.GetAuthor(ctx, 1234)
+	if !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected not found but got: %v", err)
+	}
+
+	_, err = newClient(t, srv, client.WithUser("")).ListAuthors(ctx)
+	if !errors.Is(err, krud.ErrUnauthorized) {
+		t.Errorf("expected unauthorized but got: %v", err)
+	}
+
+	resp, err := c.CreateAuthors(ctx, []krud.Author{
+		{Name: "Iain M. Banks", DateOfBirth: date("1954-02-16")},
+		{Name: "", DateOfBirth: date("1954-02-16")},
+	}, krud.BulkAtomic)
+	if !errors.Is(err, krud.ErrInvalid) {
+		t.Errorf("expected an atomic import of an invalid author to fail but got: %v", err)
+	}
+	if resp == nil || resp.Failed != 1 || resp.Items[1].Problem == nil {
+		t.Errorf("expected the response to tell which item failed but got: %+v", resp)
+	}
+}
+
+// flaky responds with status to the first n requests, after handling them.
+func flaky(status, n int, requests *int) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*requests++
+			fail := *requests <= n
+			mu.Unlock()
+			if fail {
+				next.ServeHTTP(httptest.NewRecorder(), r)
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	ctx := context.Background()
+	db := krudtest.NewMemDB()
+	requests := 0
+	c := newClient(t, krudtest.NewServer(t, db, flaky(http.StatusBadGateway, 2, &requests)))
+
+	// The first two creates go through but their responses are lost,
+	// the idempotency key keeps the retries from creating it again.
+	author, err := c.CreateAuthor(ctx, krud.Author{Name: "Octavia E. Butler", DateOfBirth: date("1947-06-22")})
+	if err != nil {
+		t.Fatalf("create author: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests but got: %d", requests)
+	}
+	if authors := db.Authors(); len(authors) != 1 || authors[0].ID != author.ID {
+		t.Errorf("expected a single author but got: %+v", authors)
+	}
+}
+
+func TestClientNoRetries(t *testing.T) {
+	ctx := context.Background()
+	db := krudtest.NewMemDB()
+	id, _ := db.AddAuthor(ctx, krud.Author{Name: "Octavia E. Butler", DateOfBirth: date("1947-06-22")})
+
+	tests := []struct {
+		name     string
+		status   int
+		call     func(c *client.Client) error
+		requests int
+	}{
+		{"not idempotent", http.StatusServiceUnavailable, func(c *client.Client) error {
+			_, err := c.UpdateAuthor(ctx, krud.Author{ID: id, Name: "Octavia Butler"})
+			return err
+		}, 1},
+		{"not transient", http.StatusInternalServerError, func(c *client.Client) error {
+			_, err := c.GetAuthor(ctx, id)
+			return err
+		}, 1},
+		{"out of attempts", http.StatusServiceUnavailable, func(c *client.Client) error {
+			_, err := c.GetAuthor(ctx, id)
+			return err
+		}, 3},
+	}
+	for _, tt := range tests {
+		requests := 0
+		c := newClient(t, krudtest.NewServer(t, db, flaky(tt.status, 10, &requests)))
+		err := tt.call(c)
+		var e *client.Error
+		if !errors.As(err, &e) || e.StatusCode != tt.status {
+			t.Errorf("%s: expected a %d but got: %v", tt.name, tt.status, err)
+		}
+		if requests != tt.requests {
+			t.Errorf("%s: expected %d requests but got: %d", tt.name, tt.requests, requests)
+		}
+	}
+}
+
+func TestNewClientBadURL(t *testing.T) {
+	for _, u := range []string{"localhost:8080", "ftp://example.com", "http://[::1"} {
+		if _, err := client.New(u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+// TestClientDependencies keeps the client from importing the server, or anything but the standard library.
+func TestClientDependencies(t *testing.T) {
+	for _, dir := range []string{".", "../krudapi"} {
+		pkg, err := build.ImportDir(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range pkg.Imports {
+			if strings.Contains(strings.SplitN(path, "/", 2)[0], ".") && path != "github.com/vikblom/krud/krudapi" {
+				t.Errorf("%s: expected only the standard library and krudapi but imports: %s", pkg.ImportPath, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+// CreateAuthor adds author, its id is ignored. Creates carry an idempotency key,
+// so they are tried again like other idempotent requests.
+func (c *Client) CreateAuthor(ctx context.Context, author krudapi.Author) (*krudapi.Author, error) {
+	req, err := c.create("/authors", author)
+	if err != nil {
+		return nil, err
+	}
+	var created krudapi.Author
+	if err := c.do(ctx, req, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) GetAuthor(ctx context.Context, id int64) (*krudapi.Author, error) {
+	req, err := newRequest(http.MethodGet, fmt.Sprintf("/authors/%d", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var author krudapi.Author
+	if err := c.do(ctx, req, &author); err != nil {
+		return nil, err
+	}
+	return &author, nil
+}
+
+func (c *Client) ListAuthors(ctx context.Context) ([]krudapi.Author, error) {
+	req, err := newRequest(http.MethodGet, "/authors", nil)
+	if err != nil {
+		return nil, err
+	}
+	var authors []krudapi.Author
+	if err := c.do(ctx, req, &authors); err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+// UpdateAuthor changes the author with the id of author, fields left at their zero value are kept.
+func (c *Client) UpdateAuthor(ctx context.Context, author krudapi.Author) (*krudapi.Author, error) {
+	changes := struct {
+		Name        string        `json:"name,omitempty"`
+		DateOfBirth *krudapi.Date `json:"dateofbirth,omitempty"`
+	}{Name: author.Name}
+	if !time.Time(author.DateOfBirth).IsZero() {
+		changes.DateOfBirth = &author.DateOfBirth
+	}
+	req, err := newRequest(http.MethodPatch, fmt.Sprintf("/authors/%d", author.ID), changes)
+	if err != nil {
+		return nil, err
+	}
+	var updated krudapi.Author
+	if err := c.do(ctx, req, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteAuthor deletes the author with id, and their books.
+func (c *Client) DeleteAuthor(ctx context.Context, id int64) error {
+	req, err := newRequest(http.MethodDelete, fmt.Sprintf("/authors/%d", id), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, req, nil)
+}
+
+// CreateBook adds book by the author with authorID, its id is ignored.
+func (c *Client) CreateBook(ctx context.Context, authorID int64, book krudapi.Book) (*krudapi.Book, error) {
+	req, err := c.create(fmt.Sprintf("/authors/%d/books", authorID), book)
+	if err != nil {
+		return nil, err
+	}
+	var created krudapi.Book
+	if err := c.do(ctx, req, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) GetBook(ctx context.Context, authorID, bookID int64) (*krudapi.Book, error) {
+	req, err := newRequest(http.MethodGet, fmt.Sprintf("/authors/%d/books/%d", authorID, bookID), nil)
+	if err != nil {
+		return nil, err
+	}
+	var book krudapi.Book
+	if err := c.do(ctx, req, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// ListBooks lists the books by the author with authorID.
+func (c *Client) ListBooks(ctx context.Context, authorID int64) ([]krudapi.Book, error) {
+	req, err := newRequest(http.MethodGet, fmt.Sprintf("/authors/%d/books", authorID), nil)
+	if err != nil {
+		return nil, err
+	}
+	var books []krudapi.Book
+	if err := c.do(ctx, req, &books); err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+func (c *Client) DeleteBook(ctx context.Context, authorID, bookID int64) error {
+	req, err := newRequest(http.MethodDelete, fmt.Sprintf("/authors/%d/books/%d", authorID, bookID), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, req, nil)
+}
+
+// CreateAuthors imports authors in one request. Items that fail are in the response.
+// An atomic import with failed items is an error, and the response tells which.
+func (c *Client) CreateAuthors(ctx context.Context, authors []krudapi.Author, mode krudapi.BulkMode) (*krudapi.BulkResponse, error) {
+	return c.bulk(ctx, "/authors:bulk", authors, mode)
+}
+
+// CreateBooks is like CreateAuthors, for books of any author.
+func (c *Client) CreateBooks(ctx context.Context, books []krudapi.AuthorBook, mode krudapi.BulkMode) (*krudapi.BulkResponse, error) {
+	return c.bulk(ctx, "/books:bulk", books, mode)
+}
+
+func (c *Client) bulk(ctx context.Context, path string, items interface{}, mode krudapi.BulkMode) (*krudapi.BulkResponse, error) {
+	req, err := newRequest(http.MethodPost, path, items)
+	if err != nil {
+		return nil, err
+	}
+	req.query = url.Values{"mode": {mode.String()}}
+	var resp krudapi.BulkResponse
+	err = c.do(ctx, req, &resp)
+	if e, ok := err.(*Error); ok && e.body != nil {
+		// Rolled back, the items tell why.
+		if json.Unmarshal(e.body, &resp) == nil && len(resp.Items) > 0 {
+			for _, item := range resp.Items {
+				if item.Problem != nil {
+					e.Problem = *item.Problem
+					break
+				}
+			}
+			return &resp, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// QueryEvents lists the audit events between after and before, either zero to not limit it.
+func (c *Client) QueryEvents(ctx context.Context, after, before time.Time) ([]krudapi.Event, error) {
+	filters := struct {
+		After  *time.Time `json:"after,omitempty"`
+		Before *time.Time `json:"before,omitempty"`
+	}{}
+	if !after.IsZero() {
+		filters.After = &after
+	}
+	if !before.IsZero() {
+		filters.Before = &before
+	}
+	req, err := newRequest(http.MethodPost, "/events", filters)
+	if err != nil {
+		return nil, err
+	}
+	// Only reads.
+	req.idempotent = true
+	var events []krudapi.Event
+	if err := c.do(ctx, req, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// VerifyEvents checks the chain of audit events, the server only tells whether it holds.
+func (c *Client) VerifyEvents(ctx context.Context) (*krudapi.ChainVerification, error) {
+	req, err := newRequest(http.MethodGet, "/events/verify", nil)
+	if err != nil {
+		return nil, err
+	}
+	var v krudapi.ChainVerification
+	if err := c.do(ctx, req, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// Export writes a consistent snapshot of all authors and books to w, as NDJSON
+// or a tar.gz by format. It is not tried again, some of it may already be written.
+func (c *Client) Export(ctx context.Context, format string, w io.Writer) error {
+	req, err := newRequest(http.MethodGet, "/export", nil)
+	if err != nil {
+		return err
+	}
+	req.query = url.Values{"format": {format}}
+	req.idempotent = false
+	return c.do(ctx, req, w)
+}
+
+// CreateWebhook subscribes hook, a secret is generated unless it has one.
+func (c *Client) CreateWebhook(ctx context.Context, hook krudapi.Webhook) (*krudapi.Webhook, error) {
+	req, err := newRequest(http.MethodPost, "/webhooks", hook)
+	if err != nil {
+		return nil, err
+	}
+	var created krudapi.Webhook
+	if err := c.do(ctx, req, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) GetWebhook(ctx context.Context, id int64) (*krudapi.Webhook, error) {
+	req, err := newRequest(http.MethodGet, fmt.Sprintf("/webhooks/%d", id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var hook krudapi.Webhook
+	if err := c.do(ctx, req, &hook); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (c *Client) ListWebhooks(ctx context.Context) ([]krudapi.Webhook, error) {
+	req, err := newRequest(http.MethodGet, "/webhooks", nil)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []krudapi.Webhook
+	if err := c.do(ctx, req, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id int64) error {
+	req, err := newRequest(http.MethodDelete, fmt.Sprintf("/webhooks/%d", id), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, req, nil)
+}
+
+// create is a POST of v to path, with a random idempotency key.
+func (c *Client) create(path string, v interface{}) (*request, error) {
+	req, err := newRequest(http.MethodPost, path, v)
+	if err != nil {
+		return nil, err
+	}
+	return req, req.withIdempotencyKey()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/vikblom/krud"
+)
+
+// auditCommand runs "audit query", "audit verify" or "audit archive". Query prints events as
+// NDJSON, the others print their outcome as JSON. Returns the exit code, verify exits 1 if
+// the chain is broken so it can run from cron or CI.
+func auditCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "query" && args[0] != "verify" && args[0] != "archive") {
+		fmt.Fprintln(os.Stderr, "usage: audit query|verify|archive [flags]")
+		return 2
+	}
+	sub := args[0]
+	var q eventQuery
+	var extra []func(*flag.FlagSet)
+	if sub == "query" {
+		extra = append(extra, q.flags)
+	}
+	cfg, err := commandConfig("audit "+sub, args[1:], os.Stderr, extra...)
+	if err == nil && sub == "query" && q.as == "" {
+		err = fmt.Errorf("audit query needs -as, reading the audit log is for users too")
+	}
+	if err == nil && sub == "archive" && cfg.Audit.RetentionMonths == 0 {
+		err = fmt.Errorf("audit archive needs a retention, nothing expires")
+	}
+	if err != nil {
+		return configExitCode(os.Stderr, err)
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var out interface{}
+	ok := true
+	switch sub {
+	case "query":
+		if err := queryEvents(ctx, db, q, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "query: %v\n", err)
+			return 1
+		}
+		return 0
+	case "verify":
+		v, err := krud.VerifyChain(ctx, db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+			return 1
+		}
+		out, ok = v, v.OK
+	case "archive":
+		archived, err := archiveEvents(ctx, db, cfg.Audit, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "archive: %v\n", err)
+			return 1
+		}
+		out = archived
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(out); err != nil {
+		fmt.Fprintf(os.Stderr, "print: %v\n", err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// eventQuery is what "audit query" is asked for.
+type eventQuery struct {
+	as       string
+	after    timeFlag
+	before   timeFlag
+	afterSeq int64
+}
+
+func (q *eventQuery) flags(fs *flag.FlagSet) {
+	fs.StringVar(&q.as, "as", "", "user reading the events")
+	fs.Var(&q.after, "after", "only events after this time, RFC 3339")
+	fs.Var(&q.before, "before", "only events before this time, RFC 3339")
+	fs.Int64Var(&q.afterSeq, "after-seq", 0, "only events after this one in the chain")
+}
+
+// queryEvents writes the events matching q to w as NDJSON, oldest first.
+// They are read through an AuditDB so only users may read them.
+func queryEvents(ctx context.Context, db *sql.DB, q eventQuery, w io.Writer) error {
+	adb, err := krud.NewAuditDB(ctx, db, q.as)
+	if err != nil {
+		return err
+	}
+	var filters []krud.Filter
+	if !q.after.IsZero() {
+		filters = append(filters, krud.EventsAfter(q.after.Time))
+	}
+	if !q.before.IsZero() {
+		filters = append(filters, krud.EventsBefore(q.before.Time))
+	}
+	if q.afterSeq > 0 {
+		filters = append(filters, krud.EventsAfterSeq(q.afterSeq))
+	}
+	enc := json.NewEncoder(w)
+	return adb.EachEvent(ctx, func(e krud.Event) error {
+		return enc.Encode(e)
+	}, filters...)
+}
+
+// timeFlag is a flag of a time in RFC 3339, zero if not set.
+type timeFlag struct{ time.Time }
+
+func (t *timeFlag) String() string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(s string) error {
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	t.Time = v
+	return nil
+}
+
+// archiveEvents makes partitions ahead and, with a retention, archives the expired ones.
+func archiveEvents(ctx context.Context, db *sql.DB, cfg auditConfig, now time.Time) ([]krud.ArchivedPartition, error) {
+	if err := krud.EnsureEventPartitions(ctx, db, now); err != nil {
+		return nil, err
+	}
+	if cfg.RetentionMonths == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.ArchiveDir, 0o750); err != nil {
+		return nil, fmt.Errorf("archive dir: %w", err)
+	}
+	return krud.ArchiveEvents(ctx, db, cfg.ArchiveDir, krud.RetentionCutoff(now, cfg.RetentionMonths))
+}
+
+// maintainEvents runs archiveEvents every interval until ctx is done.
+// Failures are logged and tried again next time.
+func maintainEvents(ctx context.Context, logger *log.Logger, db *sql.DB, cfg auditConfig) {
+	ctx = krud.WithLogger(ctx, log.NewEntry(logger))
+	ticker := time.NewTicker(time.Duration(cfg.MaintenanceInterval))
+	defer ticker.Stop()
+	for {
+		if _, err := archiveEvents(ctx, db, cfg, time.Now()); err != nil {
+			logger.Errorf("audit maintenance: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
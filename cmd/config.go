@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/vikblom/krud"
+)
+
+// config is everything the server can be configured with.
+// Layers are applied in order, later wins: defaults, YAML file, KRUD_* env vars, flags.
+// The env var for a flag is its name in upper case, with '-' as '_', e.g. KRUD_TLS_CERT for -tls-cert.
+type config struct {
+	Addr string `yaml:"addr"`
+	// GRPCAddr is where gRPC is served, empty to not serve it.
+	GRPCAddr       string          `yaml:"grpc_addr"`
+	LogLevel       string          `yaml:"log_level"`
+	IdempotencyTTL duration        `yaml:"idempotency_ttl"`
+	Database       databaseConfig  `yaml:"database"`
+	Timeouts       timeoutsConfig  `yaml:"timeouts"`
+	Auth           authConfig      `yaml:"auth"`
+	TLS            tlsConfig       `yaml:"tls"`
+	Tracing        tracingConfig   `yaml:"tracing"`
+	Audit          auditConfig     `yaml:"audit"`
+	Webhooks       webhooksConfig  `yaml:"webhooks"`
+	RateLimit      rateLimitConfig `yaml:"rate_limit"`
+}
+
+type databaseConfig struct {
+	// URL may leave out the password, to read it from PasswordFile instead.
+	URL          string `yaml:"url"`
+	PasswordFile string `yaml:"password_file"`
+	// MaxOpenConns of 0 means no limit.
+	MaxOpenConns int `yaml:"max_open_conns"`
+	MaxIdleConns int `yaml:"max_idle_conns"`
+	// ConnMaxLifetime and ConnMaxIdleTime of 0 means forever.
+	ConnMaxLifetime duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime duration `yaml:"conn_max_idle_time"`
+	// RetryAttempts is how many times a transaction is tried on serialization failures and deadlocks.
+	RetryAttempts int      `yaml:"retry_attempts"`
+	RetryBackoff  duration `yaml:"retry_backoff"`
+	// Isolation sets the isolation level by operation, like UpdateAuthor: serializable.
+	Isolation isolationLevels `yaml:"isolation"`
+}
+
+// isolationLevels maps operations to isolation levels.
+// As a flag or env var it is written like "UpdateAuthor=serializable,AddBook=repeatable-read".
+type isolationLevels map[string]string
+
+func (il isolationLevels) String() string {
+	return joinPairs(il)
+}
+
+// Set adds to, rather than replaces, levels from earlier layers.
+func (il *isolationLevels) Set(s string) error {
+	if *il == nil {
+		*il = isolationLevels{}
+	}
+	return splitPairs(*il, s, "operation=level")
+}
+
+// joinPairs writes m like "a=1,b=2", sorted by key.
+func joinPairs(m map[string]string) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(m))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+m[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// splitPairs adds the pairs of s, written like "a=1,b=2", to m. Expected is how a pair looks, for errors.
+func splitPairs(m map[string]string, s, expected string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected %s but got: '%s'", expected, pair)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return nil
+}
+
+// routeQuotas maps route templates onto quotas, like krud.ParseQuota reads them.
+// As a flag or env var it is written like "/api/authors=10/1m,/api/export=none".
+type routeQuotas map[string]string
+
+func (rq routeQuotas) String() string {
+	return joinPairs(rq)
+}
+
+// Set adds to, rather than replaces, quotas from earlier layers.
+func (rq *routeQuotas) Set(s string) error {
+	if *rq == nil {
+		*rq = routeQuotas{}
+	}
+	return splitPairs(*rq, s, "route=quota")
+}
+
+// options are how AuditDBs should be set up.
+// Isolation levels are assumed to be valid.
+func (dc databaseConfig) options() []krud.AuditDBOption {
+	opts := []krud.AuditDBOption{
+		krud.WithRetry(dc.RetryAttempts, time.Duration(dc.RetryBackoff)),
+	}
+	for op, name := range dc.Isolation {
+		level, _ := krud.ParseIsolationLevel(name)
+		opts = append(opts, krud.WithIsolation(op, level))
+	}
+	return opts
+}
+
+type timeoutsConfig struct {
+	ReadHeader duration `yaml:"read_header"`
+	Read       duration `yaml:"read"`
+	Write      duration `yaml:"write"`
+	Idle       duration `yaml:"idle"`
+	DrainDelay duration `yaml:"drain_delay"`
+	Shutdown   duration `yaml:"shutdown"`
+}
+
+type authConfig struct {
+	// Mode is one of krud.AuthMode.
+	Mode string `yaml:"mode"`
+}
+
+type tlsConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+	// ClientAuth is one of none, optional or require.
+	ClientAuth string `yaml:"client_auth"`
+}
+
+type auditConfig struct {
+	// Async writes read events in the background, in batches.
+	Async         bool     `yaml:"async"`
+	Buffer        int      `yaml:"buffer"`
+	BatchSize     int      `yaml:"batch_size"`
+	FlushInterval duration `yaml:"flush_interval"`
+	// RetentionMonths is how many months of events are kept besides the current one,
+	// older ones are archived to ArchiveDir. 0 keeps them forever.
+	RetentionMonths int    `yaml:"retention_months"`
+	ArchiveDir      string `yaml:"archive_dir"`
+	// MaintenanceInterval is how often partitions are made ahead and expired ones archived.
+	MaintenanceInterval duration `yaml:"maintenance_interval"`
+}
+
+type webhooksConfig struct {
+	// MaxAttempts is how many times a message is tried before it is dead.
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the wait after the first failed attempt, doubling after each.
+	Backoff duration `yaml:"backoff"`
+	Timeout duration `yaml:"timeout"`
+}
+
+type rateLimitConfig struct {
+	// Store is one of none, memory or postgres, which shares quotas between replicas.
+	Store string `yaml:"store"`
+	// Quota is of every route without one in Routes, like 100/1m.
+	Quota  string      `yaml:"quota"`
+	Routes routeQuotas `yaml:"routes"`
+	// Unauthorized is of every request by a user who is not known, together.
+	Unauthorized string `yaml:"unauthorized"`
+}
+
+// limiter is a RateLimiter as configured, with buckets in db for the postgres store.
+// Quotas are assumed to be valid.
+func (rc rateLimitConfig) limiter(logger *log.Logger, db *sql.DB) *krud.RateLimiter {
+	var store krud.RateLimitStore = krud.NewMemoryRateLimitStore(krud.DefaultMaxRateLimitBuckets)
+	if rc.Store == "postgres" {
+		store = krud.NewPostgresRateLimitStore(db)
+	}
+	quota, _ := krud.ParseQuota(rc.Quota)
+	unauthorized, _ := krud.ParseQuota(rc.Unauthorized)
+	opts := []krud.RateLimitOption{krud.WithUnauthorizedQuota(unauthorized)}
+	for route, s := range rc.Routes {
+		q, _ := krud.ParseQuota(s)
+		opts = append(opts, krud.WithRouteQuota(route, q))
+	}
+	return krud.NewRateLimiter(logger, store, quota, opts...)
+}
+
+type tracingConfig struct {
+	// Exporter is one of none, stdout or file, which is OTLP JSON.
+	Exporter string `yaml:"exporter"`
+	File     string `yaml:"file"`
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:           ":8080",
+		GRPCAddr:       ":9090",
+		LogLevel:       "info",
+		IdempotencyTTL: duration(krud.DefaultIdempotencyTTL),
+		Database: databaseConfig{
+			MaxIdleConns:  2,
+			RetryAttempts: krud.DefaultRetryAttempts,
+			RetryBackoff:  duration(krud.DefaultRetryBackoff),
+		},
+		Timeouts: timeoutsConfig{
+			ReadHeader: duration(10 * time.Second),
+			Read:       duration(30 * time.Second),
+			Write:      duration(5 * time.Minute),
+			Idle:       duration(2 * time.Minute),
+			DrainDelay: duration(5 * time.Second),
+			Shutdown:   duration(30 * time.Second),
+		},
+		Auth:    authConfig{Mode: string(krud.AuthAny)},
+		TLS:     tlsConfig{ClientAuth: "none"},
+		Tracing: tracingConfig{Exporter: "none"},
+		Audit: auditConfig{
+			Buffer:              krud.DefaultAuditBuffer,
+			BatchSize:           krud.DefaultAuditBatchSize,
+			FlushInterval:       duration(krud.DefaultAuditFlushInterval),
+			MaintenanceInterval: duration(time.Hour),
+		},
+		Webhooks: webhooksConfig{
+			MaxAttempts: krud.DefaultWebhookAttempts,
+			Backoff:     duration(krud.DefaultWebhookBackoff),
+			Timeout:     duration(krud.DefaultWebhookTimeout),
+		},
+		RateLimit: rateLimitConfig{
+			Store:        "none",
+			Quota:        "300/1m",
+			Unauthorized: "30/1m",
+		},
+	}
+}
+
+// duration is a time.Duration written like "5s" in YAML, env vars and flags.
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// flags binds every setting in cfg to a flag of fs.
+func (cfg *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "HTTP server addr")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "gRPC server addr, empty to not serve gRPC")
+	fs.StringVar(&cfg.LogLevel, "loglevel", cfg.LogLevel, "log verbosity")
+	fs.Var(&cfg.IdempotencyTTL, "idempotency-ttl", "how long Idempotency-Key headers are remembered")
+
+	fs.StringVar(&cfg.Database.URL, "url", cfg.Database.URL, "postgresql URL")
+	fs.StringVar(&cfg.Database.PasswordFile, "db-password-file", cfg.Database.PasswordFile, "file with the database password, instead of in the URL")
+	fs.IntVar(&cfg.Database.MaxOpenConns, "db-max-open-conns", cfg.Database.MaxOpenConns, "max open database connections, 0 is unlimited")
+	fs.IntVar(&cfg.Database.MaxIdleConns, "db-max-idle-conns", cfg.Database.MaxIdleConns, "max idle database connections")
+	fs.Var(&cfg.Database.ConnMaxLifetime, "db-conn-max-lifetime", "max time to reuse a database connection, 0 is forever")
+	fs.Var(&cfg.Database.ConnMaxIdleTime, "db-conn-max-idle-time", "max time a database connection may be idle, 0 is forever")
+	fs.IntVar(&cfg.Database.RetryAttempts, "db-retry-attempts", cfg.Database.RetryAttempts, "times to try transactions failing on serialization failures or deadlocks")
+	fs.Var(&cfg.Database.RetryBackoff, "db-retry-backoff", "initial wait between attempts, doubling for each retry")
+	fs.Var(&cfg.Database.Isolation, "db-isolation", "isolation levels by operation, like UpdateAuthor=serializable")
+
+	fs.Var(&cfg.Timeouts.ReadHeader, "read-header-timeout", "max time to read request headers")
+	fs.Var(&cfg.Timeouts.Read, "read-timeout", "max time to read a whole request")
+	fs.Var(&cfg.Timeouts.Write, "write-timeout", "max time to write a response, or each part of a streamed one")
+	fs.Var(&cfg.Timeouts.Idle, "idle-timeout", "max time to keep idle connections")
+	fs.Var(&cfg.Timeouts.DrainDelay, "drain-delay", "time between failing readiness and closing listeners on shutdown")
+	fs.Var(&cfg.Timeouts.Shutdown, "shutdown-timeout", "max time to wait for requests in flight on shutdown")
+
+	fs.StringVar(&cfg.Auth.Mode, "auth-mode", cfg.Auth.Mode, "who the user is: any, header or cert")
+
+	fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "TLS certificate file, serves HTTPS if set")
+	fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "TLS private key file")
+	fs.StringVar(&cfg.TLS.ClientCA, "tls-client-ca", cfg.TLS.ClientCA, "CA file to verify client certificates against")
+	fs.StringVar(&cfg.TLS.ClientAuth, "tls-client-auth", cfg.TLS.ClientAuth, "client certificates: none, optional or require")
+
+	fs.StringVar(&cfg.Tracing.Exporter, "trace-exporter", cfg.Tracing.Exporter, "where to send traces: none, stdout or file")
+	fs.StringVar(&cfg.Tracing.File, "trace-file", cfg.Tracing.File, "file to write traces to as OTLP JSON lines, with -trace-exporter file")
+
+	fs.BoolVar(&cfg.Audit.Async, "audit-async", cfg.Audit.Async, "write read events in the background, in batches")
+	fs.IntVar(&cfg.Audit.Buffer, "audit-buffer", cfg.Audit.Buffer, "read events waiting to be written before requests block")
+	fs.IntVar(&cfg.Audit.BatchSize, "audit-batch-size", cfg.Audit.BatchSize, "max read events written at once")
+	fs.Var(&cfg.Audit.FlushInterval, "audit-flush-interval", "max time a read event waits for its batch to fill up")
+	fs.IntVar(&cfg.Audit.RetentionMonths, "audit-retention-months", cfg.Audit.RetentionMonths, "months of events to keep besides the current one, 0 is forever")
+	fs.StringVar(&cfg.Audit.ArchiveDir, "audit-archive-dir", cfg.Audit.ArchiveDir, "directory to archive expired events to")
+	fs.Var(&cfg.Audit.MaintenanceInterval, "audit-maintenance-interval", "how often to make event partitions and archive expired ones")
+
+	fs.IntVar(&cfg.Webhooks.MaxAttempts, "webhook-max-attempts", cfg.Webhooks.MaxAttempts, "times to try delivering a webhook message before it is dead")
+	fs.Var(&cfg.Webhooks.Backoff, "webhook-backoff", "initial wait between webhook attempts, doubling for each retry")
+	fs.Var(&cfg.Webhooks.Timeout, "webhook-timeout", "max time for a webhook to respond")
+
+	fs.StringVar(&cfg.RateLimit.Store, "rate-limit", cfg.RateLimit.Store, "where to keep rate limits: none, memory or postgres to share them between replicas")
+	fs.StringVar(&cfg.RateLimit.Quota, "rate-limit-quota", cfg.RateLimit.Quota, "requests per user and route, like 300/1m")
+	fs.Var(&cfg.RateLimit.Routes, "rate-limit-routes", "quotas by route template, like /api/authors=10/1m")
+	fs.StringVar(&cfg.RateLimit.Unauthorized, "rate-limit-unauthorized", cfg.RateLimit.Unauthorized, "requests by unknown users, together, past which they get 429 instead of 401")
+}
+
+// envName is the environment variable for the flag called name.
+func envName(name string) string {
+	return "KRUD_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configFile finds the -config flag in args, before flags are parsed,
+// since the file has to be read before flags can override it.
+func configFile(args []string, lookupEnv func(string) (string, bool)) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	path, _ := lookupEnv(envName("config"))
+	return path
+}
+
+// loadConfig layers the config file, env vars and flags in args over the defaults.
+// It does not validate the result. Flags of a subcommand are added by extra,
+// they are only taken from args since they are not part of the config.
+func loadConfig(name string, args []string, lookupEnv func(string) (string, bool), output io.Writer, extra ...func(*flag.FlagSet)) (config, error) {
+	cfg := defaultConfig()
+
+	path := configFile(args, lookupEnv)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read config: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.String("config", path, "YAML config file")
+	cfg.flags(fs)
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := lookupEnv(envName(f.Name))
+		if !ok || envErr != nil {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			envErr = fmt.Errorf("env %s: %w", envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return cfg, envErr
+	}
+	for _, add := range extra {
+		add(fs)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	return cfg, nil
+}
+
+// validate checks that cfg makes sense on its own, before anything is started.
+func (cfg config) validate() error {
+	if _, err := log.ParseLevel(cfg.LogLevel); err != nil {
+		return err
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency ttl must be positive")
+	}
+
+	if cfg.Database.URL == "" {
+		return fmt.Errorf("database url is required")
+	}
+	if _, err := cfg.Database.connConfig(); err != nil {
+		return err
+	}
+	if cfg.Database.MaxOpenConns < 0 || cfg.Database.MaxIdleConns < 0 {
+		return fmt.Errorf("database pool sizes cannot be negative")
+	}
+	if cfg.Database.ConnMaxLifetime < 0 || cfg.Database.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("database connection lifetimes cannot be negative")
+	}
+	if cfg.Database.RetryAttempts < 1 {
+		return fmt.Errorf("database retry attempts must be at least 1")
+	}
+	if cfg.Database.RetryBackoff < 0 {
+		return fmt.Errorf("database retry backoff cannot be negative")
+	}
+	for op, name := range cfg.Database.Isolation {
+		if !krud.IsTransaction(op) {
+			return fmt.Errorf("isolation: unknown operation: '%s'", op)
+		}
+		if _, err := krud.ParseIsolationLevel(name); err != nil {
+			return fmt.Errorf("isolation of %s: %w", op, err)
+		}
+	}
+
+	for _, d := range []duration{
+		cfg.Timeouts.ReadHeader, cfg.Timeouts.Read, cfg.Timeouts.Write,
+		cfg.Timeouts.Idle, cfg.Timeouts.DrainDelay, cfg.Timeouts.Shutdown,
+	} {
+		if d < 0 {
+			return fmt.Errorf("timeouts cannot be negative")
+		}
+	}
+
+	mode, err := krud.ParseAuthMode(cfg.Auth.Mode)
+	if err != nil {
+		return err
+	}
+
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("tls cert and key go together")
+	}
+	switch cfg.TLS.ClientAuth {
+	case "", "none":
+		if mode == krud.AuthCertificate {
+			return fmt.Errorf("auth mode '%s' needs tls client auth", mode)
+		}
+	case "optional", "require":
+		if cfg.TLS.Cert == "" || cfg.TLS.ClientCA == "" {
+			return fmt.Errorf("tls client auth '%s' needs a cert, key and client CA", cfg.TLS.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown tls client auth: '%s'", cfg.TLS.ClientAuth)
+	}
+
+	if cfg.Audit.Buffer < 0 || cfg.Audit.BatchSize < 1 || cfg.Audit.FlushInterval <= 0 {
+		return fmt.Errorf("audit buffer cannot be negative, batch size and flush interval must be positive")
+	}
+	if cfg.Audit.RetentionMonths < 0 {
+		return fmt.Errorf("audit retention cannot be negative")
+	}
+	if cfg.Audit.RetentionMonths > 0 && cfg.Audit.ArchiveDir == "" {
+		return fmt.Errorf("audit retention needs an archive dir")
+	}
+	if cfg.Audit.MaintenanceInterval <= 0 {
+		return fmt.Errorf("audit maintenance interval must be positive")
+	}
+
+	if cfg.Webhooks.MaxAttempts < 1 {
+		return fmt.Errorf("webhook max attempts must be at least 1")
+	}
+	if cfg.Webhooks.Backoff < 0 || cfg.Webhooks.Timeout <= 0 {
+		return fmt.Errorf("webhook backoff cannot be negative and timeout must be positive")
+	}
+
+	switch cfg.RateLimit.Store {
+	case "none", "memory", "postgres":
+	default:
+		return fmt.Errorf("unknown rate limit store: '%s'", cfg.RateLimit.Store)
+	}
+	if _, err := krud.ParseQuota(cfg.RateLimit.Quota); err != nil {
+		return fmt.Errorf("rate limit: %w", err)
+	}
+	if _, err := krud.ParseQuota(cfg.RateLimit.Unauthorized); err != nil {
+		return fmt.Errorf("unauthorized rate limit: %w", err)
+	}
+	for route, s := range cfg.RateLimit.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("rate limit: route templates start with /: '%s'", route)
+		}
+		if _, err := krud.ParseQuota(s); err != nil {
+			return fmt.Errorf("rate limit of %s: %w", route, err)
+		}
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if cfg.Tracing.File == "" {
+			return fmt.Errorf("trace exporter file needs a trace file")
+		}
+	default:
+		return fmt.Errorf("unknown trace exporter: '%s'", cfg.Tracing.Exporter)
+	}
+	return nil
+}
+
+// connConfig parses the database URL, with the password from PasswordFile if set.
+func (dc databaseConfig) connConfig() (*pgx.ConnConfig, error) {
+	cc, err := pgx.ParseConfig(dc.URL)
+	if err != nil {
+		// pgconn redacts the password in its errors.
+		return nil, fmt.Errorf("parse database url: %w", err)
+	}
+	if dc.PasswordFile != "" {
+		pw, err := ioutil.ReadFile(dc.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read database password: %w", err)
+		}
+		cc.Password = strings.TrimRight(string(pw), "\r\n")
+	}
+	return cc, nil
+}
+
+const redacted = "REDACTED"
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// redactURL hides any password in a database URL, or keyword/value connection string.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(s, "password="+redacted)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	q := u.Query()
+	if q.Get("password") != "" {
+		q.Set("password", redacted)
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// redacted is cfg safe to show, without secrets.
+func (cfg config) redacted() config {
+	cfg.Database.URL = redactURL(cfg.Database.URL)
+	return cfg
+}
+
+// printConfig writes cfg as YAML, without secrets.
+func printConfig(w io.Writer, cfg config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// globalFlags take a value each, which completion skips over.
+var globalFlags = []string{"-config", "-profile", "-server", "-user", "-output", "-database"}
+
+func completion(e *env, args []string) error {
+	pos, err := parseArgs(newFlags(e, "completion"), args, 1)
+	if err != nil {
+		return err
+	}
+	switch pos[0] {
+	case "bash":
+		return writeBashCompletion(e.stdout)
+	case "zsh":
+		fmt.Fprintln(e.stdout, "autoload -U +X bashcompinit && bashcompinit")
+		return writeBashCompletion(e.stdout)
+	}
+	return usagef("unknown shell: '%s'", pos[0])
+}
+
+// writeBashCompletion writes a bash completion of the commands, for "source <(krudctl completion bash)".
+func writeBashCompletion(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`# bash completion for krudctl
+_krudctl() {
+    local cur words=() i w skip=
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    # The words before the cursor, without global flags and their values.
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        w="${COMP_WORDS[i]}"
+        if [[ -n "$skip" ]]; then
+            skip=
+        elif [[ "$w" == -* ]]; then
+            [[ "$w" != *=* ]] && skip=1
+        else
+            words+=("$w")
+        fi
+    done
+
+    case "${#words[@]}" in
+`)
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	fmt.Fprintf(&b, "    0)\n        if [[ \"$cur\" == -* ]]; then\n            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(globalFlags, " "))
+	fmt.Fprintf(&b, "        else\n            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n        fi\n        ;;\n", strings.Join(names, " "))
+
+	b.WriteString("    1)\n        case \"${words[0]}\" in\n")
+	for _, c := range commands {
+		var subs []string
+		for _, s := range c.subs {
+			subs = append(subs, s.name)
+		}
+		switch {
+		case c.name == "completion":
+			subs = []string{"bash", "zsh"}
+		case len(subs) == 0:
+			continue
+		}
+		fmt.Fprintf(&b, "        %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", c.name, strings.Join(subs, " "))
+	}
+	b.WriteString("        esac\n        ;;\n")
+
+	// Files to import from.
+	b.WriteString("    2)\n        [[ \"${words[0]}\" == import ]] && COMPREPLY=($(compgen -f -- \"$cur\"))\n        ;;\n")
+	b.WriteString("    esac\n}\ncomplete -F _krudctl krudctl\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
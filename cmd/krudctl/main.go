@@ -0,0 +1,250 @@
+// Command krudctl manages a krud server from the command line, see "krudctl help".
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vikblom/krud/client"
+)
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.LookupEnv))
+}
+
+// command is a command of krudctl, either with subcommands or run.
+type command struct {
+	name    string
+	args    string
+	summary string
+	subs    []*command
+	run     func(e *env, args []string) error
+}
+
+// commands are all of krudctl, set up in init since completion refers back to them.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "authors", subs: []*command{
+			{name: "list", summary: "list all authors", run: authorsList},
+			{name: "get", args: "ID", summary: "show an author", run: authorsGet},
+			{name: "create", args: "-name NAME -born YYYY-MM-DD", summary: "create an author", run: authorsCreate},
+			{name: "update", args: "ID [-name NAME] [-born YYYY-MM-DD]", summary: "change an author", run: authorsUpdate},
+			{name: "delete", args: "ID", summary: "delete an author and their books", run: authorsDelete},
+		}},
+		{name: "books", subs: []*command{
+			{name: "list", args: "AUTHOR", summary: "list the books by an author", run: booksList},
+			{name: "get", args: "AUTHOR ID", summary: "show a book", run: booksGet},
+			{name: "create", args: "AUTHOR -title TITLE -published YYYY-MM-DD", summary: "create a book", run: booksCreate},
+			{name: "delete", args: "AUTHOR ID", summary: "delete a book", run: booksDelete},
+		}},
+		{name: "events", subs: []*command{
+			{name: "list", args: "[-after TIME] [-before TIME]", summary: "list audit events", run: eventsList},
+			{name: "verify", summary: "check the hash chain of the audit log, exits 1 if broken", run: eventsVerify},
+		}},
+		{name: "import", subs: []*command{
+			{name: "authors", args: "FILE [-mode atomic|best-effort]", summary: "import authors from a JSON array or NDJSON, - for stdin", run: importAuthors},
+			{name: "books", args: "FILE [-mode atomic|best-effort]", summary: "import books, with their author_id", run: importBooks},
+		}},
+		{name: "export", args: "[-format ndjson|tar.gz] [-o FILE]", summary: "export all authors and books", run: export},
+		// Users are not in the API, these need a database in the profile.
+		{name: "users", subs: []*command{
+			{name: "list", summary: "list users", run: usersList},
+			{name: "add", args: "NAME", summary: "let a user in", run: usersAdd},
+			{name: "remove", args: "NAME", summary: "keep a user out", run: usersRemove},
+		}},
+		{name: "completion", args: "bash|zsh", summary: "print a shell completion script", run: completion},
+	}
+}
+
+// usageError is a command used wrong, which exits 2. Without msg, the flag package has told why.
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, a ...interface{}) error {
+	return usageError{fmt.Sprintf(format, a...)}
+}
+
+// env is what commands run with.
+type env struct {
+	ctx     context.Context
+	profile profile
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+
+	client *client.Client
+	db     *sql.DB
+}
+
+// run runs krudctl with args, returning the exit code.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, lookupEnv func(string) (string, bool)) int {
+	fs := flag.NewFlagSet("krudctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "config file with profiles, default "+defaultConfigPath(lookupEnv))
+	profileName := fs.String("profile", "", "profile to use, default the one set in the config or $KRUDCTL_PROFILE")
+	var over profile
+	fs.StringVar(&over.Server, "server", "", "URL of the API, like http://localhost:8080/api")
+	fs.StringVar(&over.User, "user", "", "user to make requests as")
+	fs.StringVar(&over.Output, "output", "", "output format: table, json or csv")
+	fs.StringVar(&over.Database, "database", "", "database URL, for users")
+	fs.Usage = func() { printUsage(stderr, fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cmd, rest := lookup(fs.Args())
+	if cmd == nil || cmd.run == nil {
+		if len(fs.Args()) > 0 && fs.Arg(0) != "help" {
+			fmt.Fprintf(stderr, "krudctl: unknown command: %s\n", strings.Join(fs.Args(), " "))
+			printUsage(stderr, fs)
+			return 2
+		}
+		printUsage(stderr, fs)
+		return 0
+	}
+
+	if *configPath == "" {
+		*configPath = defaultConfigPath(lookupEnv)
+	}
+	if *profileName == "" {
+		*profileName, _ = lookupEnv("KRUDCTL_PROFILE")
+	}
+	p, err := loadProfile(*configPath, *profileName)
+	if err == nil {
+		p = p.override(over)
+		err = p.validate()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "krudctl: config: %v\n", err)
+		return 2
+	}
+
+	e := &env{ctx: ctx, profile: p, stdin: stdin, stdout: stdout, stderr: stderr}
+	defer func() {
+		if e.db != nil {
+			e.db.Close()
+		}
+	}()
+	err = cmd.run(e, rest)
+	var ue usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &ue):
+		if ue.msg != "" {
+			fmt.Fprintf(stderr, "krudctl: %v\nusage: krudctl %s %s\n", err, commandPath(cmd), cmd.args)
+		}
+		return 2
+	case errors.Is(err, errReported):
+		return 1
+	}
+	fmt.Fprintf(stderr, "krudctl: %v\n", err)
+	return 1
+}
+
+// errReported is a failure which the output already tells about.
+var errReported = errors.New("reported")
+
+// lookup finds the command to run in args, and what is left of them.
+func lookup(args []string) (*command, []string) {
+	cmds := commands
+	var found *command
+	for len(args) > 0 {
+		var next *command
+		for _, c := range cmds {
+			if c.name == args[0] {
+				next = c
+			}
+		}
+		if next == nil {
+			break
+		}
+		found, args, cmds = next, args[1:], next.subs
+		if found.run != nil {
+			break
+		}
+	}
+	return found, args
+}
+
+// commandPath is the words that run cmd, like "authors list".
+func commandPath(cmd *command) string {
+	for _, c := range commands {
+		if c == cmd {
+			return c.name
+		}
+		for _, s := range c.subs {
+			if s == cmd {
+				return c.name + " " + s.name
+			}
+		}
+	}
+	return cmd.name
+}
+
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: krudctl [flags] COMMAND [args]\n\ncommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		subs := c.subs
+		if c.run != nil {
+			subs = []*command{c}
+		}
+		for _, s := range subs {
+			fmt.Fprintf(tw, "  %s\t%s\n", strings.TrimSpace(commandPath(s)+" "+s.args), s.summary)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nflags:\n")
+	fs.PrintDefaults()
+}
+
+// parseArgs parses the flags of fs in args, before or after the positional arguments,
+// which there must be n of.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		} else if err != nil {
+			return nil, usageError{}
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != n {
+		return nil, usagef("expected %d arguments but got %d", n, len(positional))
+	}
+	return positional, nil
+}
+
+// newFlags is a flag set for the command run by name, like "authors create",
+// writing errors to the stderr of e.
+func newFlags(e *env, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		cmd, _ := lookup(strings.Fields(name))
+		fmt.Fprintf(e.stderr, "usage: krudctl %s %s\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
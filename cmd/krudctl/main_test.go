@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vikblom/krud/krudtest"
+)
+
+// krudctl runs the command line against the Controller at srv, returning the exit code and output.
+func krudctl(t *testing.T, srv *httptest.Server, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	env := func(name string) (string, bool) {
+		if name == "KRUDCTL_CONFIG" {
+			return filepath.Join(t.TempDir(), "missing.yaml"), true
+		}
+		return "", false
+	}
+	args = append([]string{"-server", srv.URL + "/api", "-user", "alice"}, args...)
+	code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr, env)
+	return code, stdout.String(), stderr.String()
+}
+
+func newServer(t *testing.T) *httptest.Server {
+	return krudtest.NewServer(t, krudtest.NewMemDB(), nil)
+}
+
+func TestAuthors(t *testing.T) {
+	srv := newServer(t)
+
+	code, out, errOut := krudctl(t, srv, "", "authors", "create", "-name", "Ada Lovelace", "-born", "1815-12-10")
+	if code != 0 {
+		t.Fatalf("create: exit %d: %s", code, errOut)
+	}
+	expected := "ID  NAME          DATEOFBIRTH\n1   Ada Lovelace  1815-12-10\n"
+	if out != expected {
+		t.Errorf("expected a table:\n%s\nbut got:\n%s", expected, out)
+	}
+
+	code, out, errOut = krudctl(t, srv, "", "-output", "csv", "authors", "list")
+	if code != 0 {
+		t.Fatalf("list: exit %d: %s", code, errOut)
+	}
+	if out != "id,name,dateofbirth\n1,Ada Lovelace,1815-12-10\n" {
+		t.Errorf("unexpected csv: %s", out)
+	}
+
+	code, out, _ = krudctl(t, srv, "", "-output", "json", "authors", "get", "1")
+	if code != 0 || !strings.Contains(out, `"dateofbirth": "1815-12-10"`) {
+		t.Errorf("unexpected json, exit %d: %s", code, out)
+	}
+
+	code, _, errOut = krudctl(t, srv, "", "authors", "get", "2")
+	if code != 1 || !strings.Contains(errOut, "404 not_found") {
+		t.Errorf("expected not found, exit %d: %s", code, errOut)
+	}
+
+	code, _, errOut = krudctl(t, srv, "", "authors", "get")
+	if code != 2 || !strings.Contains(errOut, "usage: krudctl authors get ID") {
+		t.Errorf("expected usage, exit %d: %s", code, errOut)
+	}
+}
+
+func TestImport(t *testing.T) {
+	srv := newServer(t)
+	authors := `{"name": "Ada Lovelace", "dateofbirth": "1815-12-10"}
+{"name": "", "dateofbirth": "1815-12-10"}
+`
+	code, out, errOut := krudctl(t, srv, authors, "-output", "csv", "import", "authors", "-", "-mode", "best-effort")
+	if code != 1 || !strings.Contains(errOut, "1 of 2 items failed") {
+		t.Errorf("expected a failed item, exit %d: %s", code, errOut)
+	}
+	if !strings.Contains(out, "0,201,1,,\n") || !strings.Contains(out, "1,400,,validation_failed,") {
+		t.Errorf("unexpected outcome: %s", out)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+profile: local
+profiles:
+  local:
+    server: http://localhost:8080/api
+    user: miles
+  prod:
+    server: https://krud.example.com/api
+    cert: client.pem
+    key: client-key.pem
+    output: json
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := loadProfile(path, "")
+	if err != nil || p.User != "miles" || p.Output != "table" {
+		t.Errorf("expected the default profile but got: %+v, %v", p, err)
+	}
+	p, err = loadProfile(path, "prod")
+	if err != nil || p.Server != "https://krud.example.com/api" || p.Output != "json" {
+		t.Errorf("expected the prod profile but got: %+v, %v", p, err)
+	}
+	if p = p.override(profile{Output: "csv"}); p.Output != "csv" || p.Cert != "client.pem" {
+		t.Errorf("expected flags to override the profile but got: %+v", p)
+	}
+
+	if _, err := loadProfile(path, "staging"); err == nil {
+		t.Errorf("expected a missing profile to fail")
+	}
+	if _, err := loadProfile(filepath.Join(t.TempDir(), "missing.yaml"), "prod"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing config to fail when asking for a profile but got: %v", err)
+	}
+	if p, err := loadProfile(filepath.Join(t.TempDir(), "missing.yaml"), ""); err != nil || p.Server != defaultServer {
+		t.Errorf("expected defaults without a config but got: %+v, %v", p, err)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	code, out, _ := krudctl(t, newServer(t), "", "completion", "zsh")
+	if code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	for _, s := range []string{"bashcompinit", "complete -F _krudctl krudctl", `authors) COMPREPLY=($(compgen -W "list get create update delete"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in:\n%s", s, out)
+		}
+	}
+}
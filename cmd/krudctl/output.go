@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/vikblom/krud"
+)
+
+// print writes v in the output format of the profile, as JSON or as the rows under header.
+func (e *env) print(v interface{}, header []string, rows [][]string) error {
+	switch e.profile.Output {
+	case "json":
+		enc := json.NewEncoder(e.stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(v)
+
+	case "csv":
+		w := csv.NewWriter(e.stdout)
+		if err := w.Write(header); err != nil {
+			return err
+		}
+		if err := w.WriteAll(rows); err != nil {
+			return err
+		}
+		return w.Error()
+	}
+
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printRecords is print for records of the API, with the CSV header of their type.
+func (e *env) printRecords(v interface{}, header []string, records ...krud.Record) error {
+	rows := make([][]string, len(records))
+	for i, r := range records {
+		rows[i] = r.CSVRecord()
+	}
+	return e.print(v, header, rows)
+}
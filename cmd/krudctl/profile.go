@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"gopkg.in/yaml.v3"
+
+	"github.com/vikblom/krud/client"
+)
+
+// config is the file with profiles, like:
+//
+//	profile: prod
+//	profiles:
+//	  prod:
+//	    server: https://krud.example.com/api
+//	    cert: ~/.krud/client.pem
+//	    key: ~/.krud/client-key.pem
+//	    ca: ~/.krud/ca.pem
+//	  local:
+//	    server: http://localhost:8080/api
+//	    user: miles
+//	    database: postgres://postgres@localhost:5432/postgres
+type config struct {
+	// Profile is used unless another one is asked for.
+	Profile  string             `yaml:"profile"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+// profile is a server and how to talk to it.
+type profile struct {
+	Server string `yaml:"server"`
+	// User is sent in the user header, Cert and Key authenticate with a client certificate instead.
+	User string `yaml:"user"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// CA verifies the server, the system roots are used if empty.
+	CA string `yaml:"ca"`
+	// Database is the URL of the database, for managing users.
+	Database string `yaml:"database"`
+	// Output is the default output format.
+	Output string `yaml:"output"`
+}
+
+const defaultServer = "http://localhost:8080/api"
+
+// defaultConfigPath is where the config is unless told otherwise, $KRUDCTL_CONFIG
+// or krudctl/config.yaml in the user config dir.
+func defaultConfigPath(lookupEnv func(string) (string, bool)) string {
+	if path, ok := lookupEnv("KRUDCTL_CONFIG"); ok {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "krudctl", "config.yaml")
+}
+
+// loadProfile reads the profile called name from the config at path, or the default one
+// if name is empty. A missing config is fine as long as no profile is asked for.
+func loadProfile(path, name string) (profile, error) {
+	var cfg config
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !(errors.Is(err, os.ErrNotExist) && name == "") {
+		return profile{}, fmt.Errorf("read config: %w", err)
+	}
+	if err == nil {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return profile{}, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+
+	if name == "" {
+		name = cfg.Profile
+	}
+	p := profile{Server: defaultServer, Output: "table"}
+	if name == "" {
+		return p, nil
+	}
+	found, ok := cfg.Profiles[name]
+	if !ok {
+		return p, fmt.Errorf("no profile '%s' in %s", name, path)
+	}
+	return p.override(found), nil
+}
+
+// override is p with the fields set in o.
+func (p profile) override(o profile) profile {
+	for _, f := range []struct{ dst, src *string }{
+		{&p.Server, &o.Server},
+		{&p.User, &o.User},
+		{&p.Cert, &o.Cert},
+		{&p.Key, &o.Key},
+		{&p.CA, &o.CA},
+		{&p.Database, &o.Database},
+		{&p.Output, &o.Output},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	return p
+}
+
+func (p profile) validate() error {
+	switch p.Output {
+	case "table", "json", "csv":
+	default:
+		return fmt.Errorf("unknown output format: '%s'", p.Output)
+	}
+	if (p.Cert == "") != (p.Key == "") {
+		return fmt.Errorf("cert and key go together")
+	}
+	return nil
+}
+
+// apiClient is a client of the API in the profile, made on first use.
+func (e *env) apiClient() (*client.Client, error) {
+	if e.client != nil {
+		return e.client, nil
+	}
+	opts := []client.Option{client.WithUser(e.profile.User)}
+	if e.profile.Cert != "" || e.profile.CA != "" {
+		cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+		if e.profile.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(e.profile.Cert, e.profile.Key)
+			if err != nil {
+				return nil, fmt.Errorf("client certificate: %w", err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		if e.profile.CA != "" {
+			pem, err := ioutil.ReadFile(e.profile.CA)
+			if err != nil {
+				return nil, fmt.Errorf("read ca: %w", err)
+			}
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates in %s", e.profile.CA)
+			}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport, Timeout: client.DefaultTimeout}))
+	}
+	c, err := client.New(e.profile.Server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	e.client = c
+	return c, nil
+}
+
+// database is the database in the profile, opened on first use.
+func (e *env) database() (*sql.DB, error) {
+	if e.db != nil {
+		return e.db, nil
+	}
+	if e.profile.Database == "" {
+		return nil, fmt.Errorf("no database in the profile, set one or use -database")
+	}
+	connConfig, err := pgx.ParseConfig(e.profile.Database)
+	if err != nil {
+		return nil, fmt.Errorf("parse database url: %w", err)
+	}
+	e.db = stdlib.OpenDB(*connConfig)
+	return e.db, nil
+}
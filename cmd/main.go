@@ -1,61 +1,110 @@
 package main
 
 import (
-	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/gorilla/mux"
-	_ "github.com/jackc/pgx/v4/stdlib"
-	log "github.com/sirupsen/logrus"
-
-	"github.com/vikblom/krud"
+	"github.com/jackc/pgx/v4/stdlib"
 )
 
+// usage is formatted with the name of the binary.
+const usage = `usage: %[1]s [command] [flags]
+
+Commands:
+  serve                    serve the API, also without a command
+  migrate up|down|status   change or show the version of the schema
+  seed                     load fixture users, authors and books
+  audit query|verify       read or check the audit log
+  audit archive            make partitions of events and archive expired ones
+  config print             show the effective config
+
+Every command takes the flags of serve, run "%[1]s serve -h" to list them.
+`
+
 func main() {
-	// Inputs
-	addr := flag.String("addr", ":8080", "HTTP server addr")
-	url := flag.String("url", "", "postgresql URL")
-	loglevel := flag.String("loglevel", "info", "log verbosity")
-	flag.Parse()
-	if *url == "" {
-		flag.Usage()
+	args := os.Args[1:]
+	// Flags right away is serve, like before there were commands.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		serveCommand(os.Args[0], args)
 		return
 	}
-	logger := log.New()
-	lvl, err := log.ParseLevel(*loglevel)
-	if err != nil {
-		println(err.Error())
-		return
+	switch args[0] {
+	case "serve":
+		serveCommand("serve", args[1:])
+	case "migrate":
+		os.Exit(migrateCommand(args[1:]))
+	case "seed":
+		os.Exit(seedCommand(args[1:]))
+	case "audit":
+		os.Exit(auditCommand(args[1:]))
+	case "config":
+		os.Exit(configCommand(args[1:]))
+	case "help":
+		fmt.Fprintf(os.Stdout, usage, filepath.Base(os.Args[0]))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: '%s'\n\n", args[0])
+		fmt.Fprintf(os.Stderr, usage, filepath.Base(os.Args[0]))
+		os.Exit(2)
 	}
-	logger.SetLevel(lvl)
+}
 
-	// Krud
-	db, err := sql.Open("pgx", *url)
+// commandConfig loads and validates the config of a command, see loadConfig.
+func commandConfig(name string, args []string, output io.Writer, extra ...func(*flag.FlagSet)) (config, error) {
+	cfg, err := loadConfig(name, args, os.LookupEnv, output, extra...)
 	if err != nil {
-		logger.Fatalf("open DB: %v", err)
-	}
-	defer db.Close()
-	// Wrap actual db to match endpoint controller API.
-	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
-		logger.Debug("dialing DB conn for user: %s", user)
-		return krud.NewAuditDB(ctx, db, user)
+		return cfg, err
 	}
+	return cfg, cfg.validate()
+}
 
-	r := mux.NewRouter()
-
-	r.HandleFunc("/", HandleHello)
-
-	// "Proper" endpoint w/ user checking.
-	sr := r.PathPrefix("/api").Subrouter()
-	_ = krud.NewController(logger, sr, krud.DialFunc(dial))
+// configExitCode is what a command exits with when its config fails to load,
+// after saying why. Asking for help is not a failure.
+func configExitCode(stderr io.Writer, err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	fmt.Fprintf(stderr, "config: %v\n", err)
+	return 2
+}
 
-	logger.Infof("Serving HTTP at: %s", *addr)
-	logger.Fatal(http.ListenAndServe(*addr, r))
+// openDB opens the database of cfg for a command, without the tracing and pool settings of serve.
+func openDB(cfg config) (*sql.DB, error) {
+	connConfig, err := cfg.Database.connConfig()
+	if err != nil {
+		return nil, fmt.Errorf("DB config: %w", err)
+	}
+	return stdlib.OpenDB(*connConfig), nil
 }
 
-func HandleHello(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "HELLO\n")
+// configCommand runs "config print", showing the effective config without secrets.
+// Returns the exit code.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: config print [flags]")
+		return 2
+	}
+	cfg, err := loadConfig("config print", args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 2
+	}
+	if err := printConfig(os.Stdout, cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "print config: %v\n", err)
+		return 1
+	}
+	// Still show what is there, to help fixing it.
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "config: invalid: %v\n", err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vikblom/krud"
+)
+
+// migrateCommand runs "migrate up", "migrate down" or "migrate status", printing the status
+// of every migration as JSON when done. Returns the exit code.
+func migrateCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, "usage: migrate up|down|status [-to VERSION] [-baseline VERSION] [flags]")
+		return 2
+	}
+	sub := args[0]
+	to := -1
+	baseline := 0
+	cfg, err := commandConfig("migrate "+sub, args[1:], os.Stderr, func(fs *flag.FlagSet) {
+		if sub != "status" {
+			fs.IntVar(&to, "to", to, "version to migrate to, the latest if up, required if down")
+		}
+		if sub == "up" {
+			fs.IntVar(&baseline, "baseline", baseline,
+				"record the migrations up to this version as applied without running them, for a database which already has their schema")
+		}
+	})
+	if err == nil && sub == "down" && to < 0 {
+		err = fmt.Errorf("migrate down needs -to, 0 reverts everything")
+	}
+	if err != nil {
+		return configExitCode(os.Stderr, err)
+	}
+	if to < 0 {
+		to = 0
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	switch sub {
+	case "up":
+		if baseline > 0 {
+			done, err := krud.MigrateBaseline(ctx, db, baseline)
+			logMigrations(os.Stderr, "baselined", done)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "migrate baseline: %v\n", err)
+				return 1
+			}
+		}
+		done, err := krud.MigrateUp(ctx, db, to)
+		logMigrations(os.Stderr, "applied", done)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate up: %v\n", err)
+			return 1
+		}
+	case "down":
+		done, err := krud.MigrateDown(ctx, db, to)
+		logMigrations(os.Stderr, "reverted", done)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate down: %v\n", err)
+			return 1
+		}
+	}
+
+	status, err := krud.MigrationsStatus(ctx, db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate status: %v\n", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(status); err != nil {
+		fmt.Fprintf(os.Stderr, "print: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// logMigrations writes a line per migration that was done, even if a later one failed.
+func logMigrations(w io.Writer, what string, done []krud.Migration) {
+	for _, m := range done {
+		fmt.Fprintf(w, "%s %03d_%s\n", what, m.Version, m.Name)
+	}
+}
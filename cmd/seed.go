@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vikblom/krud"
+)
+
+// fixtures are what seed loads, like:
+//
+//	{
+//	    "tenant": "penguin",
+//	    "users": ["miles", "bill"],
+//	    "authors": [
+//	        {
+//	            "name": "Ada Lovelace",
+//	            "dateofbirth": "1815-12-10",
+//	            "books": [{"title": "Notes", "published": "1843-09-01"}]
+//	        }
+//	    ]
+//	}
+//
+// Users go in the tenant, DefaultTenant if not given. Authors and books go in the tenant of
+// the user seeding them, like any other change.
+type fixtures struct {
+	Tenant  string          `json:"tenant"`
+	Users   []string        `json:"users"`
+	Authors []fixtureAuthor `json:"authors"`
+}
+
+type fixtureAuthor struct {
+	krud.Author
+	Books []krud.Book `json:"books"`
+}
+
+// seeded counts what seed added.
+type seeded struct {
+	Users   int `json:"users"`
+	Authors int `json:"authors"`
+	Books   int `json:"books"`
+}
+
+// seedCommand runs "seed", loading fixtures as the user of -as so that they are audited
+// like any other change. Returns the exit code.
+func seedCommand(args []string) int {
+	var file, as string
+	cfg, err := commandConfig("seed", args, os.Stderr, func(fs *flag.FlagSet) {
+		fs.StringVar(&file, "file", "", "JSON file of fixtures, - for stdin")
+		fs.StringVar(&as, "as", "", "user making the changes, may be one of the fixtures")
+	})
+	if err == nil && (file == "" || as == "") {
+		err = fmt.Errorf("seed needs -file and -as")
+	}
+	if err != nil {
+		return configExitCode(os.Stderr, err)
+	}
+
+	var data []byte
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read fixtures: %v\n", err)
+		return 2
+	}
+	var fx fixtures
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fx); err != nil {
+		fmt.Fprintf(os.Stderr, "parse fixtures %s: %v\n", file, err)
+		return 2
+	}
+
+	db, err := openDB(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	n, err := seed(context.Background(), db, as, fx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seed: %v\n", err)
+		return 1
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(n); err != nil {
+		fmt.Fprintf(os.Stderr, "print: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// seed adds the users, authors and books of fx that are missing, the latter through an AuditDB of as.
+// It is safe to run again, like in an init job, but not twice at once: authors are told apart by name
+// and date of birth among those as sees, and books by title and date within their author.
+func seed(ctx context.Context, db *sql.DB, as string, fx fixtures) (seeded, error) {
+	var n seeded
+	// Authors and books go in with a transaction each, check them all before either.
+	for i, a := range fx.Authors {
+		if err := a.Author.Validate(); err != nil {
+			return n, fmt.Errorf("author %d: %w", i, err)
+		}
+		for j, b := range a.Books {
+			if err := b.Validate(); err != nil {
+				return n, fmt.Errorf("author %d, book %d: %w", i, j, err)
+			}
+		}
+	}
+
+	tenant := fx.Tenant
+	if tenant == "" {
+		tenant = krud.DefaultTenant
+	}
+	for _, user := range fx.Users {
+		err := krud.AddUser(ctx, db, as, tenant, user)
+		if errors.Is(err, krud.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return n, fmt.Errorf("user '%s': %w", user, err)
+		}
+		n.Users++
+	}
+	if len(fx.Authors) == 0 {
+		return n, nil
+	}
+
+	adb, err := krud.NewAuditDB(ctx, db, as)
+	if err != nil {
+		return n, err
+	}
+
+	// Ids of the authors there already are.
+	ids := map[string]int64{}
+	err = adb.EachAuthor(ctx, func(a krud.Author) error {
+		ids[a.Name+" "+a.DateOfBirth.Format("2006-01-02")] = a.ID
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	keys := make([]string, len(fx.Authors))
+	var missing []string
+	var authors []krud.Author
+	for i, a := range fx.Authors {
+		keys[i] = a.Name + " " + a.DateOfBirth.Format("2006-01-02")
+		if _, ok := ids[keys[i]]; ok {
+			continue
+		}
+		// Taken, in case the fixtures have it twice.
+		ids[keys[i]] = 0
+		missing = append(missing, keys[i])
+		authors = append(authors, a.Author)
+	}
+	if len(authors) > 0 {
+		results, err := adb.AddAuthors(ctx, authors, krud.BulkAtomic)
+		if err != nil {
+			return n, err
+		}
+		for i, r := range results {
+			if r.Err != nil {
+				return n, fmt.Errorf("author '%s': %w", authors[i].Name, r.Err)
+			}
+			ids[missing[i]] = r.ID
+		}
+		n.Authors = len(authors)
+	}
+
+	var books []krud.AuthorBook
+	for i, a := range fx.Authors {
+		if len(a.Books) == 0 {
+			continue
+		}
+		id := ids[keys[i]]
+		titles := map[string]bool{}
+		err := adb.EachBook(ctx, id, func(b krud.Book) error {
+			titles[b.Title+" "+b.Published.Format("2006-01-02")] = true
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		for _, b := range a.Books {
+			title := b.Title + " " + b.Published.Format("2006-01-02")
+			if titles[title] {
+				continue
+			}
+			titles[title] = true
+			books = append(books, krud.AuthorBook{AuthorID: id, Book: b})
+		}
+	}
+	if len(books) == 0 {
+		return n, nil
+	}
+	results, err := adb.AddBooks(ctx, books, krud.BulkAtomic)
+	if err != nil {
+		return n, err
+	}
+	for i, r := range results {
+		if r.Err != nil {
+			return n, fmt.Errorf("book '%s': %w", books[i].Title, r.Err)
+		}
+	}
+	n.Books = len(books)
+	return n, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/vikblom/krud"
+)
+
+// serveCommand runs the server until SIGINT or SIGTERM, name is for the usage of its flags.
+func serveCommand(name string, args []string) {
+	cfg, err := loadConfig(name, args, os.LookupEnv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	logger := log.New()
+	// Validated above.
+	lvl, _ := log.ParseLevel(cfg.LogLevel)
+	logger.SetLevel(lvl)
+
+	shutdownTracing, err := setupTracing(cfg.Tracing.Exporter, cfg.Tracing.File)
+	if err != nil {
+		logger.Fatalf("tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("flush traces: %v", err)
+		}
+	}()
+
+	// Krud
+	connConfig, err := cfg.Database.connConfig()
+	if err != nil {
+		logger.Fatalf("DB config: %v", err)
+	}
+	// Every statement becomes a span, pgx only reports them through its logger.
+	connConfig.Logger = krud.QueryTracer{}
+	connConfig.LogLevel = pgx.LogLevelInfo
+	db := stdlib.OpenDB(*connConfig)
+	defer db.Close()
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(cfg.Database.ConnMaxLifetime))
+	db.SetConnMaxIdleTime(time.Duration(cfg.Database.ConnMaxIdleTime))
+	dbOpts := cfg.Database.options()
+
+	var audit *krud.AuditWriter
+	if cfg.Audit.Async {
+		audit = krud.NewAuditWriter(logger, db,
+			krud.WithAuditBuffer(cfg.Audit.Buffer),
+			krud.WithAuditBatch(cfg.Audit.BatchSize, time.Duration(cfg.Audit.FlushInterval)),
+		)
+		dbOpts = append(dbOpts, krud.WithAuditWriter(audit))
+	}
+	// Wrap actual db to match endpoint controller API.
+	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+		krud.LoggerFrom(ctx).Debugf("dialing DB conn for user: %s", user)
+		return krud.NewAuditDB(ctx, db, user, dbOpts...)
+	}
+
+	r := mux.NewRouter()
+	r.Use(krud.MetricsMiddleware)
+	r.Use(krud.TracingMiddleware)
+
+	r.HandleFunc("/", HandleHello)
+
+	// Metrics, without user checking.
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "krud"))
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+
+	// Probes, without user checking.
+	health := krud.NewHealth(db)
+	r.HandleFunc("/healthz", health.Live).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", health.Ready).Methods(http.MethodGet)
+
+	// API description and docs, without user checking.
+	r.HandleFunc("/openapi.json", krud.ServeOpenAPI).Methods(http.MethodGet)
+	r.HandleFunc("/docs", krud.ServeDocs).Methods(http.MethodGet)
+	r.PathPrefix("/docs/").HandlerFunc(krud.ServeDocsAssets).Methods(http.MethodGet)
+
+	// Wakes up streams of events when events are committed.
+	listener := krud.NewEventListener(logger, connConfig.Copy())
+
+	// "Proper" endpoint w/ user checking.
+	sr := r.PathPrefix("/api").Subrouter()
+	// Validated above.
+	authMode, _ := krud.ParseAuthMode(cfg.Auth.Mode)
+	ctlOpts := []krud.ControllerOption{
+		krud.WithIdempotencyTTL(time.Duration(cfg.IdempotencyTTL)),
+		krud.WithAuthMode(authMode),
+		krud.WithNotifier(listener),
+	}
+	var limiter *krud.RateLimiter
+	if cfg.RateLimit.Store != "none" {
+		limiter = cfg.RateLimit.limiter(logger, db)
+		ctlOpts = append(ctlOpts, krud.WithRateLimiter(limiter))
+	}
+	_ = krud.NewController(logger, sr, krud.DialFunc(dial), ctlOpts...)
+
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           r,
+		ReadHeaderTimeout: time.Duration(cfg.Timeouts.ReadHeader),
+		ReadTimeout:       time.Duration(cfg.Timeouts.Read),
+		WriteTimeout:      time.Duration(cfg.Timeouts.Write),
+		IdleTimeout:       time.Duration(cfg.Timeouts.Idle),
+		// Streams push the write timeout out as they go, through their connection.
+		ConnContext: krud.ConnContext,
+	}
+	if cfg.TLS.Cert != "" {
+		srv.TLSConfig, err = newTLSConfig(logger, cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA, cfg.TLS.ClientAuth)
+		if err != nil {
+			logger.Fatalf("TLS config: %v", err)
+		}
+		// HTTP/2 shares a connection between requests, so streams could not push out its timeout.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+
+	// Typed RPCs for other services, authenticated like the HTTP API.
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddr != "" {
+		var grpcOpts []grpc.ServerOption
+		if srv.TLSConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(srv.TLSConfig)))
+		}
+		grpcSrv = krud.NewGRPCServer(logger, krud.DialFunc(dial), authMode, limiter, grpcOpts...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Partitions for new events, and archiving old ones.
+	go maintainEvents(ctx, logger, db, cfg.Audit)
+	go sweepIdempotencyKeys(ctx, logger, db, time.Duration(cfg.IdempotencyTTL))
+	go listener.Run(ctx)
+	if limiter != nil {
+		go limiter.Run(ctx)
+	}
+
+	// Webhooks are woken up by the same notifications, messages are committed with their events.
+	dispatcher := krud.NewWebhookDispatcher(logger, db,
+		krud.WithWebhookClient(krud.NewWebhookClient(time.Duration(cfg.Webhooks.Timeout))),
+		krud.WithWebhookRetry(cfg.Webhooks.MaxAttempts, time.Duration(cfg.Webhooks.Backoff)),
+		krud.WithWebhookNotifier(listener, krud.DefaultWebhookInterval),
+	)
+	go dispatcher.Run(ctx)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			logger.Infof("Serving HTTPS at: %s", cfg.Addr)
+			// Certificates come from TLSConfig.
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			logger.Infof("Serving HTTP at: %s", cfg.Addr)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	if grpcSrv != nil {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			logger.Fatalf("listen for gRPC: %v", err)
+		}
+		go func() {
+			logger.Infof("Serving gRPC at: %s", cfg.GRPCAddr)
+			serveErr <- grpcSrv.Serve(lis)
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		logger.Fatalf("serve: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Let load balancers notice that we are going away before we stop accepting.
+	logger.Infof("Shutting down, draining for %s", cfg.Timeouts.DrainDelay)
+	health.Drain()
+	time.Sleep(time.Duration(cfg.Timeouts.DrainDelay))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Shutdown))
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("shutdown: %v", err)
+	}
+	if grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			// Cut off streams still going.
+			grpcSrv.Stop()
+		}
+	}
+	// No more requests, write what they left behind.
+	if audit != nil {
+		flushCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Shutdown))
+		defer cancel()
+		if err := audit.Close(flushCtx); err != nil {
+			logger.Errorf("audit: %v", err)
+		}
+	}
+	logger.Info("Shut down")
+}
+
+// sweepIdempotencyKeys deletes expired idempotency keys every krud.DefaultIdempotencySweep until ctx is done.
+func sweepIdempotencyKeys(ctx context.Context, logger *log.Logger, db *sql.DB, ttl time.Duration) {
+	ctx = krud.WithLogger(ctx, log.NewEntry(logger))
+	ticker := time.NewTicker(krud.DefaultIdempotencySweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := krud.SweepIdempotencyKeys(ctx, db, ttl)
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("sweep idempotency keys: %v", err)
+			continue
+		}
+		logger.Debugf("swept %d idempotency keys", n)
+	}
+}
+
+func HandleHello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "HELLO\n")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves a certificate from disk and picks up rotated files
+// without a restart. Files are checked for changes at most once per interval.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	log      *log.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(logger *log.Logger, certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: 10 * time.Second,
+		log:      logger,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the key pair from disk. Callers must hold mu, or be the constructor.
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("stat: %w", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate fits tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checked) < cr.interval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+
+	modTime, err := cr.latestModTime()
+	if err != nil || !modTime.After(cr.modTime) {
+		// Keep serving what we have, a rotation might be half way done.
+		return cr.cert, nil
+	}
+	if err := cr.reload(); err != nil {
+		cr.log.Errorf("reloading TLS certificate, keeping the old one: %v", err)
+		return cr.cert, nil
+	}
+	cr.log.Infof("reloaded TLS certificate from: %s", cr.certFile)
+	return cr.cert, nil
+}
+
+// newTLSConfig sets up serving certFile/keyFile, optionally verifying clients against clientCA.
+// clientAuth is one of "none", "optional" or "require".
+func newTLSConfig(logger *log.Logger, certFile, keyFile, clientCA, clientAuth string) (*tls.Config, error) {
+	cr, err := newCertReloader(logger, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+
+	switch clientAuth {
+	case "", "none":
+		return cfg, nil
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth: '%s'", clientAuth)
+	}
+
+	if clientCA == "" {
+		return nil, fmt.Errorf("client auth '%s' needs a client CA", clientAuth)
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in client CA: %s", clientCA)
+	}
+	cfg.ClientCAs = pool
+	return cfg, nil
+}
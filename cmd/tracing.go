@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// setupTracing sets the global TracerProvider to export spans as selected by exporter:
+// none, stdout (JSON for people to read) or file (OTLP JSON lines to path).
+// The returned func flushes and stops exporting, call it on shutdown.
+func setupTracing(exporter, path string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("trace exporter file needs a path")
+		}
+		f, ferr := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if ferr != nil {
+			return nil, ferr
+		}
+		closer = f
+		exp, err = otlptrace.New(context.Background(), &otlpFile{w: f})
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(attribute.String("service.name", "krud"))
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// otlpFile is an otlptrace.Client writing each batch of spans as a line of OTLP JSON,
+// a TracesData object, like the file exporter of the OpenTelemetry Collector does.
+// Collectors read them back with the otlpjsonfile receiver.
+type otlpFile struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *otlpFile) Start(context.Context) error { return nil }
+
+func (f *otlpFile) Stop(context.Context) error { return nil }
+
+func (f *otlpFile) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	line, err := otlpJSON(&tracepb.TracesData{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.w.Write(append(line, '\n'))
+	return err
+}
+
+// otlpJSON is data in the JSON encoding of OTLP, which is protojson
+// except that enums are numbers and trace and span ids are hex rather than base64.
+func otlpJSON(data *tracepb.TracesData) ([]byte, error) {
+	b, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("marshal spans: %w", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, fmt.Errorf("unmarshal spans: %w", err)
+	}
+	hexIDs(v)
+	return json.Marshal(v)
+}
+
+// hexIDs re-encodes the base64 trace and span ids in v, as decoded by encoding/json, as hex.
+func hexIDs(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			s, ok := x.(string)
+			if ok && (k == "traceId" || k == "spanId" || k == "parentSpanId") {
+				if id, err := base64.StdEncoding.DecodeString(s); err == nil {
+					v[k] = hex.EncodeToString(id)
+				}
+				continue
+			}
+			hexIDs(x)
+		}
+	case []interface{}:
+		for _, x := range v {
+			hexIDs(x)
+		}
+	}
+}
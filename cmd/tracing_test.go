@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestTracingFileIsOTLP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := setupTracing("file", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "op")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var data struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Name    string `json:"name"`
+					Kind    int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		t.Fatalf("expected a line of spans: %v", sc.Err())
+	}
+	if err := json.Unmarshal(sc.Bytes(), &data); err != nil {
+		t.Fatalf("expected OTLP JSON but got: %v", err)
+	}
+	if len(data.ResourceSpans) != 1 || len(data.ResourceSpans[0].ScopeSpans) != 1 || len(data.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected a single span but got: %s", sc.Bytes())
+	}
+	s := data.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	// Ids are hex, not base64 like protojson.
+	if s.Name != "op" || len(s.TraceID) != 32 || len(s.SpanID) != 16 || s.Kind != 1 {
+		t.Errorf("unexpected span: %+v", s)
+	}
+}
@@ -1,6 +1,9 @@
 package krud
 
 import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,9 +11,11 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	graphql "github.com/graph-gophers/graphql-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,9 +35,48 @@ type Databaser interface {
 	AddBook(ctx context.Context, author int64, book Book) (id int64, err error)
 	GetBook(ctx context.Context, authorID, bookID int64) (book *Book, err error)
 	UpdateBook(ctx context.Context, authorID int64, book Book) (err error)
+	// Patch* change only the fields that are set, reading and writing in one transaction.
+	PatchAuthor(ctx context.Context, id int64, changes AuthorChanges) (author *Author, err error)
+	PatchBook(ctx context.Context, authorID, bookID int64, changes BookChanges) (book *Book, err error)
 	AllBooks(ctx context.Context) (books []Book, err error)
 	DeleteBook(ctx context.Context, authorID, bookID int64) (err error)
 	QueryEvents(ctx context.Context, filters ...Filter) (events []Event, err error)
+
+	// Each* variants hand over one item at a time, straight from the db cursor,
+	// so large collections can be streamed without buffering them.
+	EachAuthor(ctx context.Context, fn func(Author) error) (err error)
+	EachBook(ctx context.Context, authorID int64, fn func(Book) error) (err error)
+	EachEvent(ctx context.Context, fn func(Event) error, filters ...Filter) (err error)
+
+	// BooksOf are the books of many authors at once, to avoid a query per author.
+	BooksOf(ctx context.Context, authorIDs []int64) (books []AuthorBook, err error)
+
+	// VerifyEvents checks that no event has been tampered with, telling only whether the chain holds.
+	VerifyEvents(ctx context.Context) (v *ChainVerification, err error)
+	// EventSeq is the seq of the last event, to follow events from.
+	// Events of every tenant share one seq, so it is not the last event of the caller.
+	EventSeq(ctx context.Context) (seq int64, err error)
+
+	// Bulk imports, results line up with the input.
+	AddAuthors(ctx context.Context, authors []Author, mode BulkMode) (results []BulkResult, err error)
+	AddBooks(ctx context.Context, books []AuthorBook, mode BulkMode) (results []BulkResult, err error)
+
+	// Export hands over a consistent snapshot of the whole catalog.
+	Export(ctx context.Context, fn func(ExportRecord) error) (err error)
+
+	// Webhooks of the user, and what has been sent to them.
+	AddWebhook(ctx context.Context, hook Webhook) (created *Webhook, err error)
+	GetWebhook(ctx context.Context, id int64) (hook *Webhook, err error)
+	UpdateWebhook(ctx context.Context, hook Webhook) (err error)
+	EachWebhook(ctx context.Context, fn func(Webhook) error) (err error)
+	DeleteWebhook(ctx context.Context, id int64) (err error)
+	EachWebhookMessage(ctx context.Context, hookID int64, state string, fn func(WebhookMessage) error) (err error)
+	EachWebhookDelivery(ctx context.Context, hookID int64, fn func(WebhookDelivery) error) (err error)
+	RetryWebhookMessage(ctx context.Context, hookID, msgID int64) (err error)
+
+	// IdempotentResponse is what a create with key stored in the last ttl,
+	// see WithIdempotencyKey. ErrDoesNotExist if nothing.
+	IdempotentResponse(ctx context.Context, key string, ttl time.Duration) (resp *IdempotentResponse, err error)
 }
 
 // Dialer lets us setup and API that does not have to know what kind of Database is used.
@@ -53,51 +97,144 @@ type Controller struct {
 	dial Dialer
 	// log is an injected logger.
 	log *log.Logger
+	// idempotencyTTL is how long Idempotency-Key headers are remembered.
+	idempotencyTTL time.Duration
+	// authMode is how the user making a request is identified.
+	authMode AuthMode
+	// notifier wakes up streams of events when there are new ones.
+	notifier Notifier
+	// graphql is the schema served at /graphql.
+	graphql *graphql.Schema
+	// limiter limits requests by user and route, nil for no limits.
+	limiter *RateLimiter
+}
+
+// AuthMode is how the user making a request is identified.
+type AuthMode string
+
+const (
+	// AuthAny takes the user from a verified client certificate, or else the "user" header.
+	AuthAny AuthMode = "any"
+	// AuthHeader only trusts the "user" header, for use behind a proxy that sets it.
+	AuthHeader AuthMode = "header"
+	// AuthCertificate only trusts verified client certificates.
+	AuthCertificate AuthMode = "cert"
+)
+
+// ParseAuthMode checks that s is a known AuthMode, empty means AuthAny.
+func ParseAuthMode(s string) (AuthMode, error) {
+	switch m := AuthMode(s); m {
+	case "":
+		return AuthAny, nil
+	case AuthAny, AuthHeader, AuthCertificate:
+		return m, nil
+	}
+	return AuthAny, fmt.Errorf("unknown auth mode: '%s'", s)
+}
+
+// ControllerOption configures optional parts of a Controller.
+type ControllerOption func(*Controller)
+
+// WithAuthMode sets how users are identified, the default is AuthAny.
+func WithAuthMode(mode AuthMode) ControllerOption {
+	return func(c *Controller) {
+		c.authMode = mode
+	}
+}
+
+// WithIdempotencyTTL sets how long idempotency keys are remembered.
+func WithIdempotencyTTL(ttl time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.idempotencyTTL = ttl
+	}
 }
 
 type contextKrudDatabaser struct{}
 
 // NewController adds endpoints under r and hooks them up to the resources behind dial.
-func NewController(log *log.Logger, r *mux.Router, dial Dialer) *Controller {
+func NewController(log *log.Logger, r *mux.Router, dial Dialer, opts ...ControllerOption) *Controller {
 
 	c := Controller{
-		dial: dial,
-		log:  log,
+		dial:           dial,
+		log:            log,
+		idempotencyTTL: DefaultIdempotencyTTL,
+		authMode:       AuthAny,
+		notifier:       PollNotifier(DefaultEventPollInterval),
+		graphql:        newGraphQLSchema(),
+	}
+	for _, opt := range opts {
+		opt(&c)
 	}
 
+	// Request ids and loggers first, so that auth failures are logged too.
+	r.Use(c.LoggingMiddleware)
 	// Make sure any request is from an approved user.
 	r.Use(c.AuthMiddleware)
+	// Turn away users over their quota, once they are known to be who they claim.
+	if c.limiter != nil {
+		r.Use(c.RateLimitMiddleware)
+	}
 
-	r.HandleFunc("/authors", c.CreateAuthor).Methods(http.MethodPost)
+	r.Handle("/authors", c.Idempotent(http.HandlerFunc(c.CreateAuthor))).Methods(http.MethodPost)
 	r.HandleFunc("/authors", c.ReadAuthor).Methods(http.MethodGet) // Two get routes for w/ and w/o id.
 	r.HandleFunc("/authors/{authorID:[0-9]+}", c.ReadAuthor).Methods(http.MethodGet)
 	r.HandleFunc("/authors/{authorID:[0-9]+}", c.UpdateAuthor).Methods(http.MethodPatch)
 	r.HandleFunc("/authors/{authorID:[0-9]+}", c.DeleteAuthor).Methods(http.MethodDelete)
 
-	r.HandleFunc("/authors/{authorID:[0-9]+}/books", c.CreateBook).Methods(http.MethodPost)
+	r.Handle("/authors/{authorID:[0-9]+}/books", c.Idempotent(http.HandlerFunc(c.CreateBook))).Methods(http.MethodPost)
 	r.HandleFunc("/authors/{authorID:[0-9]+}/books", c.ReadBook).Methods(http.MethodGet) // Two get routes for w/ and w/o id.
 	r.HandleFunc("/authors/{authorID:[0-9]+}/books/{bookID:[0-9]+}", c.ReadBook).Methods(http.MethodGet)
 	r.HandleFunc("/authors/{authorID:[0-9]+}/books/{bookID:[0-9]+}", c.UpdateBook).Methods(http.MethodPatch)
 	r.HandleFunc("/authors/{authorID:[0-9]+}/books/{bookID:[0-9]+}", c.DeleteBook).Methods(http.MethodDelete)
 
+	r.HandleFunc("/authors:bulk", c.CreateAuthors).Methods(http.MethodPost)
+	r.HandleFunc("/books:bulk", c.CreateBooks).Methods(http.MethodPost)
+
 	r.HandleFunc("/events", c.Events).Methods(http.MethodPost)
+	r.HandleFunc("/events/verify", c.VerifyEvents).Methods(http.MethodGet)
+	r.HandleFunc("/events/stream", c.StreamEvents).Methods(http.MethodGet)
+	r.HandleFunc("/events/ws", c.EventsWebSocket).Methods(http.MethodGet)
+
+	r.HandleFunc("/export", c.Export).Methods(http.MethodGet)
+
+	r.HandleFunc("/graphql", c.GraphQL).Methods(http.MethodPost)
+
+	r.HandleFunc("/webhooks", c.CreateWebhook).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks", c.ReadWebhook).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}", c.ReadWebhook).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}", c.UpdateWebhook).Methods(http.MethodPatch)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}", c.DeleteWebhook).Methods(http.MethodDelete)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}/messages", c.WebhookMessages).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}/messages/{messageID:[0-9]+}:retry", c.RetryWebhookMessage).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks/{webhookID:[0-9]+}/deliveries", c.WebhookDeliveries).Methods(http.MethodGet)
 
 	return &c
 }
 
+// AuthMiddleware puts the Databaser of the user making the request in its context, or turns it away.
+// With a RateLimiter, requests turned away past its unauthorized quota get 429 rather than 401.
 func (api Controller) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Even more basic than r.BasicAuth()...
-		user := r.Header.Get("user")
+		user := api.principal(r)
+		addLogFields(r.Context(), log.Fields{"user": user})
 
 		// Needs to create DB for this user...
 		db, err := api.dial.Dial(r.Context(), user)
 		if err != nil {
-			api.log.Infof("auth rejected '%s' (%s) access to %s", user, r.RemoteAddr, r.RequestURI)
-			http.Error(w, "specify approved user in header", http.StatusUnauthorized)
+			LoggerFrom(r.Context()).Infof("auth rejected (%s) access to %s", r.RemoteAddr, r.RequestURI)
+			if errors.Is(err, ErrUnauthorized) {
+				if api.limiter != nil {
+					q, res, err := api.limiter.TakeUnauthorized(r.Context())
+					if api.limited(w, r, routeOf(r), q, res, err) {
+						return
+					}
+				}
+				err = fmt.Errorf("specify approved user in header: %w", err)
+			}
+			api.writeError(w, r, err)
 			return
 		}
-		api.log.Infof("auth approved '%s' (%s) access to %s", user, r.RemoteAddr, r.RequestURI)
+		LoggerFrom(r.Context()).Debugf("auth approved (%s) access to %s", r.RemoteAddr, r.RequestURI)
 
 		// Propagate db decorated for this approved user.
 		ctx := context.WithValue(r.Context(), contextKrudDatabaser{}, db)
@@ -106,62 +243,83 @@ func (api Controller) AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// WriteJsonError pack cause in a json body of http response with code set in header.
-func WriteJsonError(w http.ResponseWriter, cause error, code int) {
-	w.WriteHeader(code)
-	w.Header().Set("Content-Type", "application/json")
-
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "    ")
-	// Use anonymous struct to put error string a json.
-	err := enc.Encode(struct {
-		Error string `json:"error"`
-	}{Error: cause.Error()})
-	if err != nil {
-		// FIXME: What is the fallback error handling?
-		return
+// principal is who is making request r, according to the auth mode.
+// A verified client certificate wins over the "user" header,
+// so that mTLS callers cannot pose as someone else.
+func (api Controller) principal(r *http.Request) string {
+	if api.authMode != AuthHeader && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if api.authMode == AuthCertificate {
+		return ""
 	}
+	// Even more basic than r.BasicAuth()...
+	return r.Header.Get("user")
 }
 
+// WriteJson encodes item in the body of the http response with code set in header.
 func WriteJson(w http.ResponseWriter, item interface{}, code int) {
-	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "    ")
 	err := enc.Encode(item)
 	if err != nil {
-		// FIXME: What is the fallback error handling?
+		// Headers are already out, nothing left to tell the client.
 		return
 	}
 }
 
+// decodeBody strictly decodes the JSON body of r into v.
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return &ValidationError{Reason: "json decode body: " + err.Error(), Err: err}
+	}
+	return nil
+}
+
+// databaser gets the Databaser put in the context by AuthMiddleware.
+func databaser(r *http.Request) (Databaser, error) {
+	return databaserFrom(r.Context())
+}
+
+// databaserFrom is the Databaser of the user making the request or call being served with ctx.
+func databaserFrom(ctx context.Context) (Databaser, error) {
+	db, ok := ctx.Value(contextKrudDatabaser{}).(Databaser)
+	if !ok {
+		return nil, errors.New("no databaser in request context")
+	}
+	return db, nil
+}
+
 func (api *Controller) CreateAuthor(w http.ResponseWriter, r *http.Request) {
 
 	author := Author{}
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&author)
+	err := decodeBody(r, &author)
 	if err != nil {
-		WriteJsonError(w, fmt.Errorf("json decode body: %w", err), http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	}
 
 	err = author.Validate()
 	if err != nil {
-		WriteJsonError(w, err, http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	}
 
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	author.ID, err = db.AddAuthor(r.Context(), author)
 	if err != nil {
-		WriteJson(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
@@ -170,64 +328,49 @@ func (api *Controller) CreateAuthor(w http.ResponseWriter, r *http.Request) {
 
 func (api *Controller) ReadAuthor(w http.ResponseWriter, r *http.Request) {
 
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	if _, ok := mux.Vars(r)["authorID"]; ok { // List specific
 		id, err := GetIntFromRequest(r, "authorID")
 		if err != nil {
-			WriteJsonError(w, err, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
 
 		author, err := db.GetAuthor(r.Context(), int64(id))
 		if err != nil {
-			if errors.Is(err, ErrDoesNotExist) {
-				WriteJsonError(w, err, http.StatusNotFound)
-				return
-			}
-			WriteJsonError(w, err, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
 		WriteJson(w, author, http.StatusOK)
 
 	} else { // List all
-		authors, err := db.AllAuthors(r.Context())
-		if err != nil {
-			WriteJsonError(w, err, http.StatusInternalServerError)
-			return
-		}
-		// Always return some json.
-		if authors == nil {
-			authors = []Author{}
-		}
-		WriteJson(w, authors, http.StatusOK)
+		api.writeCollection(w, r, AuthorCSVHeader, func(emit func(Record) error) error {
+			return db.EachAuthor(r.Context(), func(a Author) error { return emit(a) })
+		})
 	}
 }
 
 func (api *Controller) DeleteAuthor(w http.ResponseWriter, r *http.Request) {
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	id, err := GetIntFromRequest(r, "authorID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
 	err = db.DeleteAuthor(r.Context(), int64(id))
 	if err != nil {
-		if errors.Is(err, ErrDoesNotExist) {
-			WriteJsonError(w, err, http.StatusNotFound)
-			return
-		}
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 	// Should we return repr of deleted resource?
@@ -238,110 +381,91 @@ func (api *Controller) UpdateAuthor(w http.ResponseWriter, r *http.Request) {
 
 	id, err := GetIntFromRequest(r, "authorID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
-		return
-	}
-
-	// This is a hack because of limited HTTP and database APIs.
-	// DB update is all or nothing, so write request changes onto existing record.
-	author, err := db.GetAuthor(r.Context(), int64(id))
+	db, err := databaser(r)
 	if err != nil {
-		if errors.Is(err, ErrDoesNotExist) {
-			WriteJsonError(w, err, http.StatusNotFound)
-			return
-		}
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
-	// Hack #2, use anon struct to the request cannot contain som ID conflicting with the URL.
-	changes := struct {
+
+	// Anon struct so the request cannot contain some ID conflicting with the URL.
+	body := struct {
 		Name        string `json:"name"`
 		DateOfBirth Date   `json:"dateofbirth"`
 	}{}
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	err = dec.Decode(&changes)
+	err = decodeBody(r, &body)
 	if err != nil {
-		WriteJsonError(w, fmt.Errorf("json decode body: %w", err), http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	}
 	// Only override fields which are in the request.
-	if changes.Name != "" {
-		author.Name = changes.Name
+	var changes AuthorChanges
+	if body.Name != "" {
+		changes.Name = &body.Name
 	}
-	if !time.Time(changes.DateOfBirth).IsZero() {
-		author.DateOfBirth = changes.DateOfBirth
+	if !time.Time(body.DateOfBirth).IsZero() {
+		changes.DateOfBirth = &body.DateOfBirth
 	}
 
 	// This is a bit brittle. We block changes if the author is invalid, but this author is
 	// a combination of the request and current state. If the invalid-ness comes from state
 	// (after something like a policy change or schema migration) we cannot fix anything through
 	// the api.
-	err = author.Validate()
+	author, err := db.PatchAuthor(r.Context(), int64(id), changes)
 	if err != nil {
-		WriteJsonError(w, err, http.StatusBadRequest)
-		return
-	}
-
-	err = db.UpdateAuthor(r.Context(), *author)
-	if err != nil {
-		if errors.Is(err, ErrDoesNotExist) {
-			WriteJsonError(w, err, http.StatusNotFound)
-			return
-		}
-		WriteJson(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
 	WriteJson(w, author, http.StatusOK)
 }
 
+// GetIntFromRequest parses the route variable key of r.
 func GetIntFromRequest(r *http.Request, key string) (int, error) {
 	vars := mux.Vars(r)
 	id, ok := vars[key]
 	if !ok {
 		return 0, fmt.Errorf("handler did not populate: %s", key)
 	}
-	return strconv.Atoi(id)
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, invalid(key, "parse %s: %v", key, err)
+	}
+	return n, nil
 }
 
 func (api *Controller) CreateBook(w http.ResponseWriter, r *http.Request) {
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	authorID, err := GetIntFromRequest(r, "authorID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
 	book := Book{}
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	err = dec.Decode(&book)
+	err = decodeBody(r, &book)
 	if err != nil {
-		WriteJsonError(w, fmt.Errorf("json decode body: %w", err), http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	}
 
 	err = book.Validate()
 	if err != nil {
-		WriteJsonError(w, err, http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	}
 
 	book.ID, err = db.AddBook(r.Context(), int64(authorID), book)
 	if err != nil {
-		WriteJson(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
@@ -349,78 +473,106 @@ func (api *Controller) CreateBook(w http.ResponseWriter, r *http.Request) {
 }
 
 func (api *Controller) ReadBook(w http.ResponseWriter, r *http.Request) {
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	authorID, err := GetIntFromRequest(r, "authorID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
+		return
 	}
 
 	if _, ok := mux.Vars(r)["bookID"]; ok { // List specific
 		bookID, err := GetIntFromRequest(r, "bookID")
 		if err != nil {
-			WriteJsonError(w, err, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
 
 		book, err := db.GetBook(r.Context(), int64(authorID), int64(bookID))
 		if err != nil {
-			if errors.Is(err, ErrDoesNotExist) {
-				WriteJsonError(w, err, http.StatusNotFound)
-				return
-			}
-			WriteJsonError(w, err, http.StatusInternalServerError)
+			api.writeError(w, r, err)
 			return
 		}
 		WriteJson(w, book, http.StatusOK)
 
-	} else { // List all
-		books, err := db.AllBooks(r.Context())
-		if err != nil {
-			WriteJsonError(w, err, http.StatusInternalServerError)
-			return
-		}
-		// Always return some json.
-		if books == nil {
-			books = []Book{}
-		}
-		WriteJson(w, books, http.StatusOK)
+	} else { // List all by this author
+		api.writeCollection(w, r, BookCSVHeader, func(emit func(Record) error) error {
+			return db.EachBook(r.Context(), int64(authorID), func(b Book) error { return emit(b) })
+		})
 	}
 }
 
+// UpdateBook changes the fields of a book which are in the request, like UpdateAuthor.
 func (api *Controller) UpdateBook(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusServiceUnavailable)
+	authorID, err := GetIntFromRequest(r, "authorID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	bookID, err := GetIntFromRequest(r, "bookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	body := struct {
+		Title     string `json:"title"`
+		Published Date   `json:"published"`
+	}{}
+	err = decodeBody(r, &body)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	var changes BookChanges
+	if body.Title != "" {
+		changes.Title = &body.Title
+	}
+	if !time.Time(body.Published).IsZero() {
+		changes.Published = &body.Published
+	}
+
+	book, err := db.PatchBook(r.Context(), int64(authorID), int64(bookID), changes)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	WriteJson(w, book, http.StatusOK)
 }
 
 func (api *Controller) DeleteBook(w http.ResponseWriter, r *http.Request) {
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
 	authorID, err := GetIntFromRequest(r, "authorID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 
 	bookID, err := GetIntFromRequest(r, "bookID")
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
+		return
 	}
 
 	err = db.DeleteBook(r.Context(), int64(authorID), int64(bookID))
 	if err != nil {
-		if errors.Is(err, ErrDoesNotExist) {
-			WriteJsonError(w, err, http.StatusNotFound)
-			return
-		}
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
 		return
 	}
 	// Should we return repr of deleted resource?
@@ -429,9 +581,9 @@ func (api *Controller) DeleteBook(w http.ResponseWriter, r *http.Request) {
 
 func (api *Controller) Events(w http.ResponseWriter, r *http.Request) {
 
-	db, ok := r.Context().Value(contextKrudDatabaser{}).(Databaser)
-	if !ok {
-		WriteJson(w, errors.New("internal error"), http.StatusInternalServerError)
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
 		return
 	}
 
@@ -440,13 +592,11 @@ func (api *Controller) Events(w http.ResponseWriter, r *http.Request) {
 		Before time.Time `json:"before"`
 		After  time.Time `json:"after"`
 	}{}
-	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&queries)
-	if err == io.EOF {
+	err = decodeBody(r, &queries)
+	if errors.Is(err, io.EOF) {
 		// Indicates no body, i.e. no filters, skip ahead.
 	} else if err != nil {
-		WriteJsonError(w, err, http.StatusBadRequest)
+		api.writeError(w, r, err)
 		return
 	} else {
 		if !queries.Before.IsZero() {
@@ -457,9 +607,335 @@ func (api *Controller) Events(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	events, err := db.QueryEvents(r.Context(), filters...)
+	api.writeCollection(w, r, EventCSVHeader, func(emit func(Record) error) error {
+		return db.EachEvent(r.Context(), func(e Event) error { return emit(e) }, filters...)
+	})
+}
+
+// VerifyEvents reports if the chain of events holds. The chain runs through every tenant,
+// so where it breaks is left to the logs and `main audit verify`.
+// A broken chain is still a successful check, see ChainVerification.OK.
+func (api *Controller) VerifyEvents(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	v, err := db.VerifyEvents(r.Context())
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	WriteJson(w, v, http.StatusOK)
+}
+
+// maxBulkItems caps the number of items in a single bulk request.
+const maxBulkItems = 10000
+
+// maxBulkBytes caps the body of a bulk request, since a single item may be of any size.
+const maxBulkBytes = 32 << 20
+
+// decodeBulk decodes the body of r, either a JSON array or NDJSON, calling fn for each item.
+// Bodies over maxBulkBytes are rejected, w is told to close the connection.
+func decodeBulk(w http.ResponseWriter, r *http.Request, fn func(dec *json.Decoder) error) error {
+	br := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBulkBytes))
+	// Peek past any leading whitespace to see what we got.
+	var first byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return &ValidationError{Reason: "json decode body: " + err.Error(), Err: err}
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		first = b
+		br.UnreadByte()
+		break
+	}
+
+	dec := json.NewDecoder(br)
+	dec.DisallowUnknownFields()
+	if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return invalid("", "json decode body: %v", err)
+		}
+	}
+
+	n := 0
+	for dec.More() {
+		if n == maxBulkItems {
+			return invalid("", "more than %d items", maxBulkItems)
+		}
+		if err := fn(dec); err != nil {
+			return invalid("", "json decode item %d: %v", n, err)
+		}
+		n++
+	}
+
+	if first == '[' {
+		if _, err := dec.Token(); err != nil {
+			return invalid("", "json decode body: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeBulk reports the outcome of a bulk request, one item per result.
+func (api *Controller) writeBulk(w http.ResponseWriter, r *http.Request, mode BulkMode, results []BulkResult) {
+	resp := BulkResponse{Mode: mode.String(), Items: make([]BulkItem, len(results))}
+	var firstFailure *Problem
+	for i, res := range results {
+		item := BulkItem{Index: i, Status: http.StatusCreated, ID: res.ID}
+		if res.Err != nil {
+			p := NewProblem(res.Err)
+			item.Status = p.Status
+			item.Problem = &p
+			resp.Failed++
+			if firstFailure == nil {
+				firstFailure = &p
+			}
+		} else if res.ID == 0 {
+			// Fine on its own, but not created since other items failed.
+			item.Status = http.StatusFailedDependency
+		} else {
+			resp.Created++
+		}
+		resp.Items[i] = item
+	}
+
+	code := http.StatusCreated
+	if firstFailure != nil {
+		code = http.StatusMultiStatus
+		if mode == BulkAtomic {
+			code = firstFailure.Status
+		}
+	}
+	WriteJson(w, resp, code)
+}
+
+// bulkImport validates count items with validate and hands the valid ones, by index, to add.
+// In atomic mode nothing is added unless all items are valid.
+func (api *Controller) bulkImport(w http.ResponseWriter, r *http.Request, count int, validate func(i int) error, add func(mode BulkMode, valid []int) ([]BulkResult, error)) {
+	mode, err := ParseBulkMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	results := make([]BulkResult, count)
+	var valid []int
+	for i := range results {
+		if err := validate(i); err != nil {
+			results[i].Err = err
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	if len(valid) > 0 && (mode == BulkBestEffort || len(valid) == count) {
+		added, err := add(mode, valid)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		for j, i := range valid {
+			results[i] = added[j]
+		}
+	}
+
+	api.writeBulk(w, r, mode, results)
+}
+
+func (api *Controller) CreateAuthors(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	var authors []Author
+	err = decodeBulk(w, r, func(dec *json.Decoder) error {
+		var a Author
+		if err := dec.Decode(&a); err != nil {
+			return err
+		}
+		authors = append(authors, a)
+		return nil
+	})
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	api.bulkImport(w, r, len(authors),
+		func(i int) error { return authors[i].Validate() },
+		func(mode BulkMode, valid []int) ([]BulkResult, error) {
+			batch := make([]Author, len(valid))
+			for j, i := range valid {
+				batch[j] = authors[i]
+			}
+			return db.AddAuthors(r.Context(), batch, mode)
+		})
+}
+
+func (api *Controller) CreateBooks(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	var books []AuthorBook
+	err = decodeBulk(w, r, func(dec *json.Decoder) error {
+		var b AuthorBook
+		if err := dec.Decode(&b); err != nil {
+			return err
+		}
+		books = append(books, b)
+		return nil
+	})
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	api.bulkImport(w, r, len(books),
+		func(i int) error {
+			if books[i].AuthorID <= 0 {
+				return invalid("author_id", "author_id missing")
+			}
+			return books[i].Validate()
+		},
+		func(mode BulkMode, valid []int) ([]BulkResult, error) {
+			batch := make([]AuthorBook, len(valid))
+			for j, i := range valid {
+				batch[j] = books[i]
+			}
+			return db.AddBooks(r.Context(), batch, mode)
+		})
+}
+
+// MediaGzip is the media type of a tar.gz export.
+const MediaGzip = "application/gzip"
+
+// Export streams a snapshot of the catalog, as NDJSON or as a tar.gz with one JSON file per object.
+// Pick with ?format=ndjson|tar.gz or the Accept header.
+func (api *Controller) Export(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
 	if err != nil {
-		WriteJsonError(w, err, http.StatusInternalServerError)
+		api.writeError(w, r, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+		if strings.Contains(r.Header.Get("Accept"), MediaGzip) {
+			format = "tar.gz"
+		}
+	}
+
+	var write func(ExportRecord) error
+	var finish func() error
+	started := false
+	switch format {
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		write = func(rec ExportRecord) error {
+			if !started {
+				started = true
+				w.Header().Set("Content-Type", MediaNDJSON)
+				w.WriteHeader(http.StatusOK)
+			}
+			return enc.Encode(rec)
+		}
+		finish = func() error {
+			if !started {
+				w.Header().Set("Content-Type", MediaNDJSON)
+				w.WriteHeader(http.StatusOK)
+			}
+			return nil
+		}
+
+	case "tar.gz":
+		var gz *gzip.Writer
+		var tw *tar.Writer
+		exportedAt := time.Now().UTC()
+		counts := map[string]int{}
+		start := func() {
+			if started {
+				return
+			}
+			started = true
+			w.Header().Set("Content-Type", MediaGzip)
+			w.Header().Set("Content-Disposition",
+				fmt.Sprintf(`attachment; filename="krud-export-%s.tar.gz"`, exportedAt.Format("20060102T150405Z")))
+			w.WriteHeader(http.StatusOK)
+			gz = gzip.NewWriter(w)
+			tw = tar.NewWriter(gz)
+		}
+		file := func(name string, v interface{}) error {
+			data, err := json.MarshalIndent(v, "", "    ")
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    int64(len(data)),
+				ModTime: exportedAt,
+			})
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(data)
+			return err
+		}
+		write = func(rec ExportRecord) error {
+			start()
+			counts[rec.Type]++
+			if rec.Type == ExportTypeAuthor {
+				return file(fmt.Sprintf("authors/%d.json", rec.Author.ID), rec.Author)
+			}
+			return file(fmt.Sprintf("books/%d.json", rec.Book.ID), rec.Book)
+		}
+		finish = func() error {
+			start()
+			manifest := struct {
+				ExportedAt time.Time `json:"exported_at"`
+				Authors    int       `json:"authors"`
+				Books      int       `json:"books"`
+			}{exportedAt, counts[ExportTypeAuthor], counts[ExportTypeBook]}
+			if err := file("manifest.json", manifest); err != nil {
+				return err
+			}
+			if err := tw.Close(); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+
+	default:
+		api.writeError(w, r, invalid("format", "unknown export format: '%s'", format))
+		return
+	}
+
+	err = db.Export(r.Context(), func(rec ExportRecord) error {
+		keepWriting(r)
+		return write(rec)
+	})
+	if err == nil {
+		keepWriting(r)
+		err = finish()
+	}
+	if err != nil {
+		if !started {
+			api.writeError(w, r, err)
+			return
+		}
+		// Too late to change the status code, a truncated export is the best signal left.
+		LoggerFrom(r.Context()).Errorf("export as %s: %v", format, err)
 	}
-	WriteJson(w, events, http.StatusOK)
 }
@@ -1,16 +1,26 @@
 package krud_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/vikblom/krud"
@@ -22,19 +32,57 @@ type MockDatabase struct {
 
 	latestBook int64
 	books      map[int64]krud.Book
+	// bookAuthors are the author ids of books.
+	bookAuthors map[int64]int64
+	// booksOfCalls counts calls to BooksOf, to check that it batches.
+	booksOfCalls int
+
+	idempotent map[string]krud.IdempotentResponse
+
+	// events are handed out by EachEvent, whatever the filters.
+	events []krud.Event
+
+	latestWebhook int64
+	webhooks      map[int64]krud.Webhook
 }
 
 func EmptyMock() *MockDatabase {
-	return &MockDatabase{1, map[int64]krud.Author{}, 1, map[int64]krud.Book{}}
+	return &MockDatabase{
+		latestAuthor: 1,
+		authors:      map[int64]krud.Author{},
+		latestBook:   1,
+		books:        map[int64]krud.Book{},
+		bookAuthors:  map[int64]int64{},
+		idempotent:   map[string]krud.IdempotentResponse{},
+		webhooks:     map[int64]krud.Webhook{},
+	}
 }
 
-func (mock *MockDatabase) AddAuthor(ctx context.Context, author krud.Author) (id int64, err error) {
+// storeIdempotent mimics how a real database keeps the response for an idempotency key.
+func (mock *MockDatabase) storeIdempotent(ctx context.Context, created interface{}) {
+	key, ok := krud.IdempotencyKeyFrom(ctx)
+	if !ok {
+		return
+	}
+	data, _ := json.Marshal(created)
+	mock.idempotent[key.Key] = krud.IdempotentResponse{RequestHash: key.RequestHash, Response: data}
+}
 
-	return 0, nil
+func (mock *MockDatabase) AddAuthor(ctx context.Context, author krud.Author) (id int64, err error) {
+	mock.latestAuthor += 1
+	mock.authors[mock.latestAuthor] = author
+	author.ID = mock.latestAuthor
+	mock.storeIdempotent(ctx, author)
+	return mock.latestAuthor, nil
 }
 
 func (mock *MockDatabase) GetAuthor(ctx context.Context, id int64) (author *krud.Author, err error) {
-	return &krud.Author{}, nil
+	a, ok := mock.authors[id]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	a.ID = id
+	return &a, nil
 }
 
 func (mock *MockDatabase) UpdateAuthor(ctx context.Context, author krud.Author) (err error) {
@@ -52,6 +100,9 @@ func (mock *MockDatabase) DeleteAuthor(ctx context.Context, id int64) (err error
 func (mock *MockDatabase) AddBook(ctx context.Context, author int64, book krud.Book) (id int64, err error) {
 	mock.latestBook += 1
 	mock.books[mock.latestBook] = book
+	mock.bookAuthors[mock.latestBook] = author
+	book.ID = mock.latestBook
+	mock.storeIdempotent(ctx, book)
 	return mock.latestBook, nil
 }
 
@@ -63,6 +114,44 @@ func (mock *MockDatabase) UpdateBook(ctx context.Context, authorID int64, book k
 	return nil
 }
 
+func (mock *MockDatabase) PatchAuthor(ctx context.Context, id int64, changes krud.AuthorChanges) (author *krud.Author, err error) {
+	a, ok := mock.authors[id]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	if changes.Name != nil {
+		a.Name = *changes.Name
+	}
+	if changes.DateOfBirth != nil {
+		a.DateOfBirth = *changes.DateOfBirth
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	mock.authors[id] = a
+	a.ID = id
+	return &a, nil
+}
+
+func (mock *MockDatabase) PatchBook(ctx context.Context, authorID, bookID int64, changes krud.BookChanges) (book *krud.Book, err error) {
+	b, ok := mock.books[bookID]
+	if !ok || mock.bookAuthors[bookID] != authorID {
+		return nil, krud.ErrDoesNotExist
+	}
+	if changes.Title != nil {
+		b.Title = *changes.Title
+	}
+	if changes.Published != nil {
+		b.Published = *changes.Published
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	mock.books[bookID] = b
+	b.ID = bookID
+	return &b, nil
+}
+
 func (mock *MockDatabase) AllBooks(ctx context.Context) (books []krud.Book, err error) {
 	return nil, nil
 }
@@ -72,7 +161,165 @@ func (mock *MockDatabase) DeleteBook(ctx context.Context, authorID, bookID int64
 }
 
 func (mock *MockDatabase) QueryEvents(ctx context.Context, filters ...krud.Filter) (events []krud.Event, err error) {
-	return nil, nil
+	return mock.events, nil
+}
+
+func (mock *MockDatabase) EachAuthor(ctx context.Context, fn func(krud.Author) error) (err error) {
+	for id := int64(1); id <= mock.latestAuthor; id++ {
+		a, ok := mock.authors[id]
+		if !ok {
+			continue
+		}
+		a.ID = id
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockDatabase) EachBook(ctx context.Context, authorID int64, fn func(krud.Book) error) (err error) {
+	for id := int64(1); id <= mock.latestBook; id++ {
+		b, ok := mock.books[id]
+		if !ok {
+			continue
+		}
+		b.ID = id
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockDatabase) EachEvent(ctx context.Context, fn func(krud.Event) error, filters ...krud.Filter) (err error) {
+	for _, e := range mock.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockDatabase) BooksOf(ctx context.Context, authorIDs []int64) (books []krud.AuthorBook, err error) {
+	mock.booksOfCalls++
+	for _, authorID := range authorIDs {
+		for id := int64(1); id <= mock.latestBook; id++ {
+			b, ok := mock.books[id]
+			if !ok || mock.bookAuthors[id] != authorID {
+				continue
+			}
+			b.ID = id
+			books = append(books, krud.AuthorBook{AuthorID: authorID, Book: b})
+		}
+	}
+	return books, nil
+}
+
+func (mock *MockDatabase) VerifyEvents(ctx context.Context) (v *krud.ChainVerification, err error) {
+	return &krud.ChainVerification{OK: true}, nil
+}
+
+func (mock *MockDatabase) EventSeq(ctx context.Context) (seq int64, err error) {
+	if len(mock.events) > 0 {
+		seq = mock.events[len(mock.events)-1].Seq
+	}
+	return seq, nil
+}
+
+func (mock *MockDatabase) AddAuthors(ctx context.Context, authors []krud.Author, mode krud.BulkMode) (results []krud.BulkResult, err error) {
+	for _, a := range authors {
+		id, _ := mock.AddAuthor(ctx, a)
+		results = append(results, krud.BulkResult{ID: id})
+	}
+	return results, nil
+}
+
+func (mock *MockDatabase) AddBooks(ctx context.Context, books []krud.AuthorBook, mode krud.BulkMode) (results []krud.BulkResult, err error) {
+	for _, b := range books {
+		id, _ := mock.AddBook(ctx, b.AuthorID, b.Book)
+		results = append(results, krud.BulkResult{ID: id})
+	}
+	return results, nil
+}
+
+func (mock *MockDatabase) Export(ctx context.Context, fn func(krud.ExportRecord) error) (err error) {
+	err = mock.EachAuthor(ctx, func(a krud.Author) error {
+		return fn(krud.ExportRecord{Type: krud.ExportTypeAuthor, Author: &a})
+	})
+	if err != nil {
+		return err
+	}
+	return mock.EachBook(ctx, 0, func(b krud.Book) error {
+		return fn(krud.ExportRecord{Type: krud.ExportTypeBook, Book: &krud.AuthorBook{Book: b}})
+	})
+}
+
+func (mock *MockDatabase) IdempotentResponse(ctx context.Context, key string, ttl time.Duration) (resp *krud.IdempotentResponse, err error) {
+	stored, ok := mock.idempotent[key]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	return &stored, nil
+}
+
+func (mock *MockDatabase) AddWebhook(ctx context.Context, hook krud.Webhook) (created *krud.Webhook, err error) {
+	mock.latestWebhook += 1
+	hook.ID = mock.latestWebhook
+	hook.Created = time.Now()
+	mock.webhooks[hook.ID] = hook
+	return &hook, nil
+}
+
+func (mock *MockDatabase) GetWebhook(ctx context.Context, id int64) (hook *krud.Webhook, err error) {
+	h, ok := mock.webhooks[id]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	h.Secret = ""
+	return &h, nil
+}
+
+func (mock *MockDatabase) UpdateWebhook(ctx context.Context, hook krud.Webhook) (err error) {
+	if _, ok := mock.webhooks[hook.ID]; !ok {
+		return krud.ErrDoesNotExist
+	}
+	mock.webhooks[hook.ID] = hook
+	return nil
+}
+
+func (mock *MockDatabase) EachWebhook(ctx context.Context, fn func(krud.Webhook) error) (err error) {
+	for id := int64(1); id <= mock.latestWebhook; id++ {
+		h, ok := mock.webhooks[id]
+		if !ok {
+			continue
+		}
+		h.Secret = ""
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockDatabase) DeleteWebhook(ctx context.Context, id int64) (err error) {
+	if _, ok := mock.webhooks[id]; !ok {
+		return krud.ErrDoesNotExist
+	}
+	delete(mock.webhooks, id)
+	return nil
+}
+
+func (mock *MockDatabase) EachWebhookMessage(ctx context.Context, hookID int64, state string, fn func(krud.WebhookMessage) error) (err error) {
+	return nil
+}
+
+func (mock *MockDatabase) EachWebhookDelivery(ctx context.Context, hookID int64, fn func(krud.WebhookDelivery) error) (err error) {
+	return nil
+}
+
+func (mock *MockDatabase) RetryWebhookMessage(ctx context.Context, hookID, msgID int64) (err error) {
+	return krud.ErrDoesNotExist
 }
 
 func (mock *MockDatabase) Dial(ctx context.Context, user string) (krud.Databaser, error) {
@@ -168,3 +415,687 @@ func TestRequestPostBook(t *testing.T) {
 	_ = actual
 	// TODO: Compare response and db book.
 }
+
+func TestRequestPatchBook(t *testing.T) {
+	mock := MockWithAuthors(t)
+	id, _ := mock.AddBook(context.Background(), 2, krud.Book{Title: "Orlando", Published: MakeDate(t, "1928-10-11")})
+
+	body := strings.NewReader(`{"title":"Orlando: A Biography"}`)
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/authors/2/books/%d", id), body)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	var book krud.Book
+	if err := json.NewDecoder(resp.Body).Decode(&book); err != nil {
+		t.Fatalf("decode book: %v", err)
+	}
+	if book.Title != "Orlando: A Biography" || book.Published.Format("2006-01-02") != "1928-10-11" {
+		t.Errorf("expected only the title changed but got: %+v", book)
+	}
+}
+
+// ParseProblem decodes a problem+json response.
+func ParseProblem(t *testing.T, resp *http.Response) krud.Problem {
+	t.Helper()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("expected problem content type but got: '%s'", ct)
+	}
+	var p krud.Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatalf("decode problem: %v", err)
+	}
+	if p.Status != resp.StatusCode {
+		t.Errorf("problem status %d does not match response %d", p.Status, resp.StatusCode)
+	}
+	return p
+}
+
+func TestRequestGetAuthorMissing(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors/7", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusNotFound)
+	p := ParseProblem(t, resp)
+	if p.Code != krud.CodeNotFound {
+		t.Errorf("expected code '%s' but got: '%s'", krud.CodeNotFound, p.Code)
+	}
+	if p.RequestID != "abc123" {
+		t.Errorf("expected request id to be kept but got: '%s'", p.RequestID)
+	}
+}
+
+func TestRequestPostAuthorInvalid(t *testing.T) {
+	body := strings.NewReader(`{"name":"F00", "dateofbirth":"1970-01-01"}`)
+	req := httptest.NewRequest(http.MethodPost, "/authors", body)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusBadRequest)
+	p := ParseProblem(t, resp)
+	if p.Code != krud.CodeValidation || p.Field != "name" {
+		t.Errorf("expected validation problem on name but got: %+v", p)
+	}
+	if p.RequestID == "" {
+		t.Error("expected a request id to be generated")
+	}
+}
+
+func TestProblemHidesInternalErrors(t *testing.T) {
+	p := krud.NewProblem(errors.New("pq: relation \"secret\" does not exist"))
+	if p.Status != http.StatusInternalServerError || p.Code != krud.CodeInternal {
+		t.Errorf("expected internal problem but got: %+v", p)
+	}
+	if strings.Contains(p.Detail, "secret") {
+		t.Errorf("internal error leaked into detail: '%s'", p.Detail)
+	}
+
+	p = krud.NewProblem(fmt.Errorf("transaction: %w", krud.ErrConflict))
+	if p.Status != http.StatusConflict || p.Code != krud.CodeConflict {
+		t.Errorf("expected conflict problem but got: %+v", p)
+	}
+}
+
+// MockWithAuthors has a couple of authors in it.
+func MockWithAuthors(t *testing.T) *MockDatabase {
+	t.Helper()
+
+	mock := EmptyMock()
+	mock.AddAuthor(context.Background(), krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1882-01-25")})
+	mock.AddAuthor(context.Background(), krud.Author{Name: "Leo Tolstoj", DateOfBirth: MakeDate(t, "1828-09-09")})
+	return mock
+}
+
+func TestRequestGetAuthorsCSV(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+	req.Header.Set("Accept", "text/csv")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	checkStatusCode(t, resp, http.StatusOK)
+	expected := "id,name,dateofbirth\n2,Virginia Woolf,1882-01-25\n3,Leo Tolstoj,1828-09-09\n"
+	if string(data) != expected {
+		t.Errorf("expected '%v' but got: '%v'", expected, string(data))
+	}
+}
+
+func TestRequestGetAuthorsNDJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+	req.Header.Set("Accept", "text/csv;q=0.5, application/x-ndjson")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != krud.MediaNDJSON {
+		t.Errorf("expected content type '%s' but got: '%s'", krud.MediaNDJSON, ct)
+	}
+	dec := json.NewDecoder(resp.Body)
+	n := 0
+	for dec.More() {
+		var a krud.Author
+		if err := dec.Decode(&a); err != nil {
+			t.Fatalf("decode line %d: %v", n, err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("expected 2 authors but got: %d", n)
+	}
+}
+
+// slowAuthors hands out its authors one at a time, with a pause before each.
+type slowAuthors struct {
+	*MockDatabase
+	pause time.Duration
+}
+
+func (s slowAuthors) EachAuthor(ctx context.Context, fn func(krud.Author) error) error {
+	return s.MockDatabase.EachAuthor(ctx, func(a krud.Author) error {
+		time.Sleep(s.pause)
+		return fn(a)
+	})
+}
+
+func TestRequestStreamOutlivesWriteTimeout(t *testing.T) {
+	mock := EmptyMock()
+	for i := 0; i < 5; i++ {
+		mock.AddAuthor(context.Background(), krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1882-01-25")})
+	}
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, krud.DialFunc(func(ctx context.Context, user string) (krud.Databaser, error) {
+		return slowAuthors{mock, 40 * time.Millisecond}, nil
+	}))
+	srv := httptest.NewUnstartedServer(r)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Config.ConnContext = krud.ConnContext
+	srv.Start()
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/authors", nil)
+	req.Header.Set("Accept", krud.MediaNDJSON)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	checkStatusCode(t, resp, http.StatusOK)
+
+	// Each author is within the timeout, all of them are not.
+	dec := json.NewDecoder(resp.Body)
+	n := 0
+	for dec.More() {
+		var a krud.Author
+		if err := dec.Decode(&a); err != nil {
+			t.Fatalf("decode line %d: %v", n, err)
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("expected 5 authors but got: %d", n)
+	}
+}
+
+func TestRequestGetAuthorsNotAcceptable(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+	req.Header.Set("Accept", "image/png")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusNotAcceptable)
+	p := ParseProblem(t, resp)
+	if p.Code != krud.CodeNotAcceptable {
+		t.Errorf("expected code '%s' but got: '%s'", krud.CodeNotAcceptable, p.Code)
+	}
+}
+
+func TestRequestBulkAuthorsBestEffort(t *testing.T) {
+	body := strings.NewReader(`[
+        {"name":"Virginia Woolf", "dateofbirth":"1882-01-25"},
+        {"name":"", "dateofbirth":"1900-01-01"},
+        {"name":"Leo Tolstoj", "dateofbirth":"1828-09-09"}
+    ]`)
+	req := httptest.NewRequest(http.MethodPost, "/authors:bulk?mode=best-effort", body)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	mock := EmptyMock()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusMultiStatus)
+	var br krud.BulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if br.Created != 2 || br.Failed != 1 {
+		t.Errorf("expected 2 created and 1 failed but got: %+v", br)
+	}
+	if br.Items[1].Problem == nil || br.Items[1].Problem.Code != krud.CodeValidation {
+		t.Errorf("expected item 1 to fail validation but got: %+v", br.Items[1])
+	}
+	if len(mock.authors) != 2 {
+		t.Errorf("expected 2 authors in database but got: %d", len(mock.authors))
+	}
+}
+
+func TestRequestBulkTooLarge(t *testing.T) {
+	// A single item, too large to be decoded.
+	body := strings.NewReader(`{"name":"` + strings.Repeat("a", 33<<20) + `", "dateofbirth":"1882-01-25"}`)
+	req := httptest.NewRequest(http.MethodPost, "/authors:bulk", body)
+	req.Header.Set("Content-Type", krud.MediaNDJSON)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	mock := EmptyMock()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusBadRequest)
+	if p := ParseProblem(t, resp); p.Code != krud.CodeValidation || !strings.Contains(p.Detail, "too large") {
+		t.Errorf("expected the body to be too large but got: %+v", p)
+	}
+	if len(mock.authors) != 0 {
+		t.Errorf("expected no authors in database but got: %d", len(mock.authors))
+	}
+}
+
+func TestRequestBulkBooksAtomicNDJSON(t *testing.T) {
+	body := strings.NewReader(`{"author_id":1, "title":"To the Lighthouse", "published":"1927-05-05"}
+{"author_id":1, "title":"", "published":"1931-10-08"}
+`)
+	req := httptest.NewRequest(http.MethodPost, "/books:bulk", body)
+	req.Header.Set("Content-Type", krud.MediaNDJSON)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	mock := EmptyMock()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusBadRequest)
+	var br krud.BulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&br); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if br.Created != 0 || br.Items[0].Status != http.StatusFailedDependency {
+		t.Errorf("expected nothing created but got: %+v", br)
+	}
+	if len(mock.books) != 0 {
+		t.Errorf("expected no books in database but got: %d", len(mock.books))
+	}
+}
+
+func TestRequestExportNDJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/export", nil)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	dec := json.NewDecoder(resp.Body)
+	var types []string
+	for dec.More() {
+		var rec krud.ExportRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode record: %v", err)
+		}
+		types = append(types, rec.Type)
+	}
+	if len(types) != 2 || types[0] != krud.ExportTypeAuthor {
+		t.Errorf("expected 2 authors but got: %v", types)
+	}
+}
+
+func TestRequestVerifyEvents(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/events/verify", nil)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	var v krud.ChainVerification
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("decode verification: %v", err)
+	}
+	if !v.OK || v.Broken != nil {
+		t.Errorf("expected an intact chain but got: %+v", v)
+	}
+}
+
+func TestRequestPostWebhook(t *testing.T) {
+	body := strings.NewReader(`{"url":"https://example.com/hook", "types":["books"]}`)
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", body)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	mock := EmptyMock()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusCreated)
+	var hook krud.Webhook
+	if err := json.NewDecoder(resp.Body).Decode(&hook); err != nil {
+		t.Fatalf("decode webhook: %v", err)
+	}
+	if hook.ID != 1 || !hook.Active || hook.Secret == "" {
+		t.Errorf("expected an active webhook with a secret but got: %+v", hook)
+	}
+	if mock.webhooks[1].Secret != hook.Secret {
+		t.Error("expected the secret to be stored")
+	}
+
+	// The secret is not shown again.
+	req = httptest.NewRequest(http.MethodGet, "/webhooks/1", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	resp = w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	var got krud.Webhook
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode webhook: %v", err)
+	}
+	if got.Secret != "" || got.URL != "https://example.com/hook" {
+		t.Errorf("expected the webhook without its secret but got: %+v", got)
+	}
+}
+
+func TestRequestPostWebhookInvalid(t *testing.T) {
+	tests := []struct {
+		body  string
+		field string
+	}{
+		{`{"url":"example.com/hook"}`, "url"},
+		{`{"url":"ftp://example.com/hook"}`, "url"},
+		{`{"url":"https://example.com/hook", "types":["events"]}`, "types"},
+		{`{"url":"http://localhost:5432/"}`, "url"},
+		{`{"url":"http://169.254.169.254/latest/meta-data/"}`, "url"},
+		{`{"url":"http://[::1]/hook"}`, "url"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+
+		r := mux.NewRouter()
+		log, _ := test.NewNullLogger()
+		krud.NewController(log, r, EmptyMock())
+		r.ServeHTTP(w, req)
+
+		resp := w.Result()
+		checkStatusCode(t, resp, http.StatusBadRequest)
+		p := ParseProblem(t, resp)
+		resp.Body.Close()
+		if p.Field != tt.field {
+			t.Errorf("%s: expected a problem with %s but got: %+v", tt.body, tt.field, p)
+		}
+	}
+}
+
+// MockWithEvents has two events, with seq 1 and 2.
+func MockWithEvents(t *testing.T) *MockDatabase {
+	t.Helper()
+
+	mock := EmptyMock()
+	for i, op := range []string{krud.AUDIT_OP_CREATE, krud.AUDIT_OP_READ} {
+		id := int64(1)
+		mock.events = append(mock.events, krud.Event{
+			Seq: int64(i + 1), When: time.Now(), User: "bill", Operation: op, Type: "author", ID: &id,
+		})
+	}
+	return mock
+}
+
+// neverNotifier never has news, streams send what they have and then wait.
+type neverNotifier struct{}
+
+func (neverNotifier) Subscribe() (<-chan struct{}, func()) {
+	return nil, func() {}
+}
+
+func TestRequestStreamEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events/stream", nil).WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "0")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithEvents(t), krud.WithNotifier(neverNotifier{}))
+	// Returns once the client, ctx, goes away.
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	checkStatusCode(t, resp, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream but got: %s", ct)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, id := range []string{"id: 1\ndata: {", "id: 2\ndata: {"} {
+		if !strings.Contains(string(body), id) {
+			t.Errorf("expected '%s' in stream but got:\n%s", id, body)
+		}
+	}
+}
+
+func TestRequestStreamEventsBadLastEventID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/events/stream", nil)
+	req.Header.Set("Last-Event-ID", "latest")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithEvents(t), krud.WithNotifier(neverNotifier{}))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	checkStatusCode(t, resp, http.StatusBadRequest)
+}
+
+func TestRequestEventsWebSocket(t *testing.T) {
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithEvents(t), krud.WithNotifier(neverNotifier{}))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Resume after the first event.
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/events/ws?last_event_id=1"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	checkStatusCode(t, resp, http.StatusSwitchingProtocols)
+
+	// The mock hands out every event, filtering on seq is up to the database.
+	for _, seq := range []int64{1, 2} {
+		var e krud.Event
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.ReadJSON(&e); err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		if e.Seq != seq {
+			t.Errorf("expected event %d but got: %+v", seq, e)
+		}
+	}
+}
+
+func TestRequestExportTarGz(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/export?format=tar.gz", nil)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	checkStatusCode(t, resp, http.StatusOK)
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	expected := []string{"authors/2.json", "authors/3.json", "manifest.json"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected files %v but got: %v", expected, names)
+	}
+}
+
+func TestRequestPostAuthorIdempotent(t *testing.T) {
+	r := mux.NewRouter()
+	mock := EmptyMock()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+
+	post := func(body string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, "/authors", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "retry-me")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		resp := w.Result()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp, string(data)
+	}
+
+	body := `{"name":"Virginia Woolf", "dateofbirth":"1882-01-25"}`
+	first, firstData := post(body)
+	checkStatusCode(t, first, http.StatusCreated)
+
+	retry, retryData := post(body)
+	checkStatusCode(t, retry, http.StatusCreated)
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("expected retry to be a replay")
+	}
+	if retryData != firstData {
+		t.Errorf("expected replay '%s' but got: '%s'", firstData, retryData)
+	}
+	if len(mock.authors) != 1 {
+		t.Errorf("expected 1 author in database but got: %d", len(mock.authors))
+	}
+
+	other, _ := post(`{"name":"Leo Tolstoj", "dateofbirth":"1828-09-09"}`)
+	checkStatusCode(t, other, http.StatusUnprocessableEntity)
+}
+
+func TestAuthFromClientCertificate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+	req.Header.Set("user", "someone-else")
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "miles"}}}},
+	}
+	w := httptest.NewRecorder()
+
+	var dialed string
+	mock := EmptyMock()
+	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+		dialed = user
+		return mock, nil
+	}
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, krud.DialFunc(dial))
+	r.ServeHTTP(w, req)
+
+	checkStatusCode(t, w.Result(), http.StatusOK)
+	if dialed != "miles" {
+		t.Errorf("expected certificate CN 'miles' to be the user but got: '%s'", dialed)
+	}
+}
+
+func TestAuthModes(t *testing.T) {
+	cert := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "miles"}}}},
+	}
+	tests := []struct {
+		mode     krud.AuthMode
+		header   string
+		tls      *tls.ConnectionState
+		expected string
+	}{
+		{krud.AuthAny, "someone-else", nil, "someone-else"},
+		{krud.AuthHeader, "someone-else", cert, "someone-else"},
+		{krud.AuthCertificate, "someone-else", cert, "miles"},
+		{krud.AuthCertificate, "someone-else", nil, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+		req.Header.Set("user", tt.header)
+		req.TLS = tt.tls
+
+		var dialed string
+		mock := EmptyMock()
+		dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+			dialed = user
+			return mock, nil
+		}
+
+		r := mux.NewRouter()
+		log, _ := test.NewNullLogger()
+		krud.NewController(log, r, krud.DialFunc(dial), krud.WithAuthMode(tt.mode))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		if dialed != tt.expected {
+			t.Errorf("mode %s: expected user '%s' but got: '%s'", tt.mode, tt.expected, dialed)
+		}
+	}
+}
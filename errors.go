@@ -0,0 +1,99 @@
+package krud
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+)
+
+// invalid is a ValidationError of field, with a reason like fmt.Sprintf.
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// PostgreSQL error codes we translate into domain errors.
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	pgForeignKeyViolation = "23503"
+	pgUniqueViolation     = "23505"
+	pgCheckViolation      = "23514"
+	pgNotNullViolation    = "23502"
+)
+
+// constraintFields are the fields of the API that constraints of the schema are about.
+var constraintFields = map[string]string{
+	"users_pkey":            "name",
+	"fk_author":             "author",
+	"idempotency_keys_pkey": "Idempotency-Key",
+}
+
+// dbError is a domain error caused by the database. It matches its domain error with errors.Is,
+// and unwraps to the driver error, which is in its message for logs. Problems only show
+// field and reason, constraint names and SQLSTATEs are not for clients.
+type dbError struct {
+	// kind is the domain error, like ErrConflict.
+	kind   error
+	field  string
+	reason string
+	err    error
+}
+
+func (de *dbError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", de.kind, de.detail(), de.err)
+}
+
+func (de *dbError) Is(target error) bool {
+	return target == de.kind
+}
+
+func (de *dbError) Unwrap() error {
+	return de.err
+}
+
+// detail is what went wrong, without any details of the database.
+func (de *dbError) detail() string {
+	if de.field == "" {
+		return de.reason
+	}
+	return de.field + ": " + de.reason
+}
+
+// translate maps driver errors onto domain errors, keeping the original
+// error in the chain. Errors that are not recognized are returned as is.
+func translate(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	field := constraintFields[pgErr.ConstraintName]
+	switch pgErr.Code {
+	case pgForeignKeyViolation:
+		return &dbError{kind: ErrConflict, field: field, reason: "conflicts with a related object", err: err}
+	case pgUniqueViolation:
+		return &dbError{kind: ErrConflict, field: field, reason: "already exists", err: err}
+	case pgCheckViolation:
+		return &dbError{kind: ErrInvalid, field: field, reason: "not allowed", err: err}
+	case pgNotNullViolation:
+		// About a column rather than a named constraint.
+		return &dbError{kind: ErrInvalid, field: pgErr.ColumnName, reason: "required", err: err}
+	case pgSerializationFailure, pgDeadlockDetected:
+		// Still failing after retries, the client may try again later.
+		return &dbError{kind: ErrConflict, reason: "concurrent update, try again", err: err}
+	}
+	return err
+}
+
+// publicDetail is the message of err that is safe to show to clients.
+func publicDetail(err error) string {
+	var de *dbError
+	if errors.As(err, &de) {
+		return de.detail()
+	}
+	return err.Error()
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgForeignKeyViolation
+}
@@ -0,0 +1,79 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ExportRecord is one object in a catalog snapshot.
+// Exactly one of Author and Book is set, as told by Type.
+type ExportRecord struct {
+	Type   string      `json:"type"`
+	Author *Author     `json:"author,omitempty"`
+	Book   *AuthorBook `json:"book,omitempty"`
+}
+
+const (
+	ExportTypeAuthor = "author"
+	ExportTypeBook   = "book"
+)
+
+// Export calls fn for every author, and then every book, as they were at a single point in time.
+// Writes that happen during the export are not seen.
+func (adb *AuditDB) Export(ctx context.Context, fn func(ExportRecord) error) (err error) {
+	defer observe(ctx, "Export", time.Now(), &err)
+
+	// Recorded on its own, the snapshot is read only.
+	if err := adb.readEventAlone(ctx, "ExportEvent", "export"); err != nil {
+		return err
+	}
+
+	// The isolation level is set in txOps, for all statements to see the same snapshot.
+	err = adb.wrapInTransaction(ctx, "Export", func(ctx context.Context, tx *sql.Tx) error {
+		authors, err := tx.QueryContext(ctx, "SELECT id, name, date_of_birth FROM authors ORDER BY id")
+		if err != nil {
+			return fmt.Errorf("select authors: %w", err)
+		}
+		defer authors.Close()
+
+		for authors.Next() {
+			var a Author
+			if err := authors.Scan(&a.ID, &a.Name, &a.DateOfBirth); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(ExportRecord{Type: ExportTypeAuthor, Author: &a}); err != nil {
+				return err
+			}
+		}
+		if err := authors.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+
+		books, err := tx.QueryContext(ctx, "SELECT id, author_id, title, published FROM books ORDER BY author_id, id")
+		if err != nil {
+			return fmt.Errorf("select books: %w", err)
+		}
+		defer books.Close()
+
+		for books.Next() {
+			var b AuthorBook
+			if err := books.Scan(&b.ID, &b.AuthorID, &b.Title, &b.Published); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(ExportRecord{Type: ExportTypeBook, Book: &b}); err != nil {
+				return err
+			}
+		}
+		if err := books.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,334 @@
+package krud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventsChannel is notified, with the seq of the last event, when events are committed.
+const EventsChannel = "krud_events"
+
+// Defaults of the event feed.
+const (
+	// DefaultEventPollInterval is how often streams look for new events, without a Notifier.
+	DefaultEventPollInterval = time.Second
+	// eventKeepAlive is how often an idle stream sends something, so that proxies keep it open.
+	eventKeepAlive = 15 * time.Second
+)
+
+// Notifier wakes up streams of events when new events may have been committed.
+type Notifier interface {
+	// Subscribe returns a channel that gets a value when there may be new events,
+	// and a func to call when no longer interested.
+	Subscribe() (wake <-chan struct{}, cancel func())
+}
+
+// WithNotifier sets what wakes up streams of events, by default they poll.
+func WithNotifier(n Notifier) ControllerOption {
+	return func(c *Controller) {
+		c.notifier = n
+	}
+}
+
+// PollNotifier wakes subscribers up at an interval, whether there are new events or not.
+type PollNotifier time.Duration
+
+func (p PollNotifier) Subscribe() (<-chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(p))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return wake, func() { once.Do(func() { close(done) }) }
+}
+
+// EventListener is a Notifier that LISTENs on EventsChannel, with a connection of its own.
+type EventListener struct {
+	connConfig *pgx.ConnConfig
+	log        *log.Logger
+
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func NewEventListener(log *log.Logger, connConfig *pgx.ConnConfig) *EventListener {
+	return &EventListener{
+		connConfig: connConfig,
+		log:        log,
+		subs:       map[chan struct{}]struct{}{},
+	}
+}
+
+func (el *EventListener) Subscribe() (<-chan struct{}, func()) {
+	wake := make(chan struct{}, 1)
+	el.mu.Lock()
+	el.subs[wake] = struct{}{}
+	el.mu.Unlock()
+	return wake, func() {
+		el.mu.Lock()
+		delete(el.subs, wake)
+		el.mu.Unlock()
+	}
+}
+
+// wakeAll wakes every subscriber, without waiting on those already awake.
+func (el *EventListener) wakeAll() {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	for wake := range el.subs {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run listens until ctx is done, connecting again when the connection is lost.
+func (el *EventListener) Run(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		err := el.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		wait := retryWait(100*time.Millisecond, attempt)
+		el.log.Errorf("listen for events, again in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (el *EventListener) listen(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, el.connConfig)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{EventsChannel}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	// Anything committed while not listening.
+	el.wakeAll()
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+		el.wakeAll()
+	}
+}
+
+// followFrom is where a stream of events should start, and which events it should have.
+// It picks up after the Last-Event-ID header, or the last_event_id query parameter for clients
+// that cannot set headers, and otherwise starts with the next event.
+// Query parameters before and after filter like in Events.
+func followFrom(r *http.Request, db Databaser) (seq int64, filters []Filter, err error) {
+	q := r.URL.Query()
+	for _, p := range []struct {
+		name   string
+		filter func(time.Time) Filter
+	}{
+		{"after", EventsAfter},
+		{"before", EventsBefore},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, nil, invalid(p.name, "expected RFC 3339 time but got: '%s'", v)
+		}
+		filters = append(filters, p.filter(t))
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("last_event_id")
+	}
+	if last == "" {
+		seq, err = db.EventSeq(r.Context())
+		return seq, filters, err
+	}
+	seq, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, nil, invalid("last_event_id", "expected the seq of an event but got: '%s'", last)
+	}
+	return seq, filters, nil
+}
+
+// followEvents calls emit for every event matching filters after seq, also those committed
+// later, until ctx is done or emit fails. idle is called when nothing has been emitted for a while.
+func (api *Controller) followEvents(ctx context.Context, db Databaser, seq int64, filters []Filter, emit func(Event) error, idle func() error) error {
+	wake, cancel := api.notifier.Subscribe()
+	defer cancel()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		fs := append([]Filter{EventsAfterSeq(seq)}, filters...)
+		err := db.EachEvent(ctx, func(e Event) error {
+			seq = e.Seq
+			keepAlive.Reset(eventKeepAlive)
+			return emit(e)
+		}, fs...)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-keepAlive.C:
+			if err := idle(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// StreamEvents pushes events as Server-Sent Events, as they are committed.
+// Each has the seq of the event as id, for clients to resume from with Last-Event-ID.
+// Every event and keep-alive gets the write timeout of the server anew, so the stream lasts
+// until the client goes away. Clients are expected to reconnect if it breaks.
+func (api *Controller) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		api.writeError(w, r, fmt.Errorf("streaming not supported by %T", w))
+		return
+	}
+	seq, filters, err := followFrom(r, db)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep proxies like nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	emit := func(e Event) error {
+		keepWriting(r)
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	idle := func() error {
+		keepWriting(r)
+		if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	err = api.followEvents(r.Context(), db, seq, filters, emit, idle)
+	if err != nil && r.Context().Err() == nil {
+		// Too late to change the status code, cut the stream short instead.
+		LoggerFrom(r.Context()).Errorf("streaming events: %v", err)
+	}
+}
+
+// upgrader turns requests into WebSockets.
+// Only browsers send an Origin, which then has to match the host like for any other request.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// wsWriteWait is how long a message may take to send before the client is given up on.
+const wsWriteWait = 10 * time.Second
+
+// EventsWebSocket pushes events over a WebSocket, one JSON message per event, as they are committed.
+// Takes the same query parameters as StreamEvents. Messages from the client are ignored.
+func (api *Controller) EventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	seq, filters, err := followFrom(r, db)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	// Upgrading clears the deadlines of the server from the connection, every write sets its own.
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded.
+		LoggerFrom(r.Context()).Debugf("upgrade to websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// A hijacked connection does not end the request context, reading does.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	emit := func(e Event) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(e)
+	}
+	idle := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+	}
+	err = api.followEvents(ctx, db, seq, filters, emit, idle)
+	if err != nil && ctx.Err() == nil {
+		LoggerFrom(ctx).Errorf("streaming events: %v", err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""), time.Now().Add(wsWriteWait))
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+}
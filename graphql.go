@@ -0,0 +1,563 @@
+package krud
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/graph-gophers/dataloader"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlotel "github.com/graph-gophers/graphql-go/trace/otel"
+)
+
+// graphqlSchema is what /graphql serves. Resolvers call the Databaser of the request,
+// so reads and changes are audited and validated just like through the rest of the API.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+# Date is a day, like 2006-01-02.
+scalar Date
+# Time is an RFC 3339 time.
+scalar Time
+
+type Query {
+	author(id: ID!): Author
+	authors: [Author!]!
+	book(authorId: ID!, id: ID!): Book
+	events(after: Time, before: Time): [Event!]!
+}
+
+type Mutation {
+	createAuthor(input: AuthorInput!): Author!
+	updateAuthor(id: ID!, input: AuthorChanges!): Author!
+	deleteAuthor(id: ID!): ID!
+	createBook(authorId: ID!, input: BookInput!): Book!
+	updateBook(authorId: ID!, id: ID!, input: BookChanges!): Book!
+	deleteBook(authorId: ID!, id: ID!): ID!
+}
+
+type Author {
+	id: ID!
+	name: String!
+	dateOfBirth: Date!
+	books: [Book!]!
+	# Events about the author, the last ones after a time, oldest first.
+	events(after: Time, last: Int = 20): [Event!]!
+}
+
+type Book {
+	id: ID!
+	title: String!
+	published: Date!
+	# Events about the book, the last ones after a time, oldest first.
+	events(after: Time, last: Int = 20): [Event!]!
+}
+
+type Event {
+	seq: ID!
+	ts: Time!
+	user: String!
+	operation: String!
+	type: String!
+	objectId: ID
+}
+
+input AuthorInput {
+	name: String!
+	dateOfBirth: Date!
+}
+
+input AuthorChanges {
+	name: String
+	dateOfBirth: Date
+}
+
+input BookInput {
+	title: String!
+	published: Date!
+}
+
+input BookChanges {
+	title: String
+	published: Date
+}
+`
+
+// graphqlMaxDepth caps how deeply queries may nest, books of authors of books...
+const graphqlMaxDepth = 8
+
+// newGraphQLSchema parses graphqlSchema, which is a constant, so any error is a bug.
+func newGraphQLSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphqlSchema, &graphqlResolver{},
+		graphql.MaxDepth(graphqlMaxDepth),
+		graphql.Tracer(&gqlotel.Tracer{Tracer: tracer()}),
+	)
+}
+
+// graphqlRequest is the body of a POST to /graphql.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	// Extensions are accepted, and ignored.
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+// GraphQL executes a query or mutation against graphqlSchema.
+// Errors from resolvers are classified like Problems, with code and field as extensions.
+func (api *Controller) GraphQL(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	var req graphqlRequest
+	err = decodeBody(r, &req)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	if req.Query == "" {
+		api.writeError(w, r, invalid("query", "query empty"))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), contextKrudLoaders{}, newLoaders(db))
+	resp := api.graphql.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	for _, qe := range resp.Errors {
+		if qe.ResolverError == nil {
+			// Like a syntax error in the query, which is already fit to show.
+			continue
+		}
+		p := NewProblem(qe.ResolverError)
+		if p.Status == http.StatusInternalServerError {
+			LoggerFrom(ctx).Errorf("graphql %v: %v", qe.Path, qe.ResolverError)
+		}
+		qe.Message = p.Detail
+		qe.Extensions = map[string]interface{}{"code": p.Code}
+		if p.Field != "" {
+			qe.Extensions["field"] = p.Field
+		}
+	}
+	// Errors are part of the response, partial data and all.
+	WriteJson(w, resp, http.StatusOK)
+}
+
+// int64Key is a dataloader.Key of an id.
+type int64Key int64
+
+func (k int64Key) String() string   { return strconv.FormatInt(int64(k), 10) }
+func (k int64Key) Raw() interface{} { return int64(k) }
+
+func int64Keys(keys dataloader.Keys) []int64 {
+	ids := make([]int64, len(keys))
+	for i, k := range keys {
+		ids[i] = k.Raw().(int64)
+	}
+	return ids
+}
+
+type contextKrudLoaders struct{}
+
+// loaders batch what resolvers load during one request, into a query for all of them.
+// Without them, listing authors with their books would be a query per author.
+type loaders struct {
+	db Databaser
+	// books of authors by author id.
+	books *dataloader.Loader
+
+	mu sync.Mutex
+	// events by object type, after and last, of objects by id.
+	events map[string]*dataloader.Loader
+}
+
+func newLoaders(db Databaser) *loaders {
+	l := &loaders{db: db, events: map[string]*dataloader.Loader{}}
+	l.books = dataloader.NewBatchedLoader(l.loadBooks)
+	return l
+}
+
+func loadersFrom(ctx context.Context) (*loaders, error) {
+	l, ok := ctx.Value(contextKrudLoaders{}).(*loaders)
+	if !ok {
+		return nil, errors.New("no loaders in request context")
+	}
+	return l, nil
+}
+
+func (l *loaders) loadBooks(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+	ids := int64Keys(keys)
+	books, err := l.db.BooksOf(ctx, ids)
+	byAuthor := map[int64][]Book{}
+	for _, b := range books {
+		byAuthor[b.AuthorID] = append(byAuthor[b.AuthorID], b.Book)
+	}
+	results := make([]*dataloader.Result, len(ids))
+	for i, id := range ids {
+		results[i] = &dataloader.Result{Data: byAuthor[id], Error: err}
+	}
+	return results
+}
+
+// eventsOf loads the last events of the object of objType with id, after a time if set.
+// Objects of the same type, after and last, are loaded together.
+func (l *loaders) eventsOf(ctx context.Context, objType string, id int64, after *graphql.Time, last int) ([]Event, error) {
+	key := objType + " " + strconv.Itoa(last)
+	if after != nil {
+		key += " " + after.Format(time.RFC3339Nano)
+	}
+	l.mu.Lock()
+	loader, ok := l.events[key]
+	if !ok {
+		loader = dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+			ids := int64Keys(keys)
+			filters := []Filter{EventsLastOn(objType, last, ids...)}
+			if after != nil {
+				filters = append(filters, EventsAfter(after.Time))
+			}
+			events, err := l.db.QueryEvents(ctx, filters...)
+			byID := map[int64][]Event{}
+			for _, e := range events {
+				if e.ID != nil {
+					byID[*e.ID] = append(byID[*e.ID], e)
+				}
+			}
+			results := make([]*dataloader.Result, len(ids))
+			for i, id := range ids {
+				results[i] = &dataloader.Result{Data: byID[id], Error: err}
+			}
+			return results
+		})
+		l.events[key] = loader
+	}
+	l.mu.Unlock()
+
+	data, err := loader.Load(ctx, int64Key(id))()
+	if err != nil {
+		return nil, err
+	}
+	events, _ := data.([]Event)
+	return events, nil
+}
+
+// parseID parses an ID argument called field.
+func parseID(field string, id graphql.ID) (int64, error) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil {
+		return 0, invalid(field, "expected a numeric id but got: '%s'", id)
+	}
+	return n, nil
+}
+
+func formatID(id int64) graphql.ID {
+	return graphql.ID(strconv.FormatInt(id, 10))
+}
+
+// graphqlResolver resolves Query and Mutation.
+type graphqlResolver struct{}
+
+func (*graphqlResolver) Author(ctx context.Context, args struct{ ID graphql.ID }) (*authorResolver, error) {
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	author, err := db.GetAuthor(ctx, id)
+	if errors.Is(err, ErrDoesNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authorResolver{*author}, nil
+}
+
+func (*graphqlResolver) Authors(ctx context.Context) ([]*authorResolver, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	authors := []*authorResolver{}
+	err = db.EachAuthor(ctx, func(a Author) error {
+		authors = append(authors, &authorResolver{a})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return authors, nil
+}
+
+func (*graphqlResolver) Book(ctx context.Context, args struct{ AuthorID, ID graphql.ID }) (*bookResolver, error) {
+	authorID, err := parseID("authorId", args.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	book, err := db.GetBook(ctx, authorID, id)
+	if errors.Is(err, ErrDoesNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bookResolver{*book}, nil
+}
+
+func (*graphqlResolver) Events(ctx context.Context, args struct{ After, Before *graphql.Time }) ([]*eventResolver, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var filters []Filter
+	if args.After != nil {
+		filters = append(filters, EventsAfter(args.After.Time))
+	}
+	if args.Before != nil {
+		filters = append(filters, EventsBefore(args.Before.Time))
+	}
+	events := []*eventResolver{}
+	err = db.EachEvent(ctx, func(e Event) error {
+		events = append(events, &eventResolver{e})
+		return nil
+	}, filters...)
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (*graphqlResolver) CreateAuthor(ctx context.Context, args struct {
+	Input struct {
+		Name        string
+		DateOfBirth Date
+	}
+}) (*authorResolver, error) {
+	author := Author{Name: args.Input.Name, DateOfBirth: args.Input.DateOfBirth}
+	err := author.Validate()
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	author.ID, err = db.AddAuthor(ctx, author)
+	if err != nil {
+		return nil, err
+	}
+	return &authorResolver{author}, nil
+}
+
+// UpdateAuthor only changes what is in the input, like a PATCH.
+func (*graphqlResolver) UpdateAuthor(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input AuthorChanges
+}) (*authorResolver, error) {
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	author, err := db.PatchAuthor(ctx, id, args.Input)
+	if err != nil {
+		return nil, err
+	}
+	return &authorResolver{*author}, nil
+}
+
+func (*graphqlResolver) DeleteAuthor(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return "", err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = db.DeleteAuthor(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return args.ID, nil
+}
+
+func (*graphqlResolver) CreateBook(ctx context.Context, args struct {
+	AuthorID graphql.ID
+	Input    struct {
+		Title     string
+		Published Date
+	}
+}) (*bookResolver, error) {
+	authorID, err := parseID("authorId", args.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+	book := Book{Title: args.Input.Title, Published: args.Input.Published}
+	err = book.Validate()
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	book.ID, err = db.AddBook(ctx, authorID, book)
+	if err != nil {
+		return nil, err
+	}
+	return &bookResolver{book}, nil
+}
+
+// UpdateBook only changes what is in the input, like a PATCH.
+func (*graphqlResolver) UpdateBook(ctx context.Context, args struct {
+	AuthorID graphql.ID
+	ID       graphql.ID
+	Input    BookChanges
+}) (*bookResolver, error) {
+	authorID, err := parseID("authorId", args.AuthorID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return nil, err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	book, err := db.PatchBook(ctx, authorID, id, args.Input)
+	if err != nil {
+		return nil, err
+	}
+	return &bookResolver{*book}, nil
+}
+
+func (*graphqlResolver) DeleteBook(ctx context.Context, args struct{ AuthorID, ID graphql.ID }) (graphql.ID, error) {
+	authorID, err := parseID("authorId", args.AuthorID)
+	if err != nil {
+		return "", err
+	}
+	id, err := parseID("id", args.ID)
+	if err != nil {
+		return "", err
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = db.DeleteBook(ctx, authorID, id)
+	if err != nil {
+		return "", err
+	}
+	return args.ID, nil
+}
+
+// eventsArgs are the arguments of events on objects.
+type eventsArgs struct {
+	After *graphql.Time
+	Last  int32
+}
+
+// lastEvents resolves the last of the events of the object of objType with id.
+func lastEvents(ctx context.Context, objType string, id int64, args eventsArgs) ([]*eventResolver, error) {
+	if args.Last < 0 {
+		return nil, invalid("last", "expected a positive number but got: %d", args.Last)
+	}
+	l, err := loadersFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events, err := l.eventsOf(ctx, objType, id, args.After, int(args.Last))
+	if err != nil {
+		return nil, err
+	}
+	// The query already keeps the last ones, other Databasers may not.
+	if len(events) > int(args.Last) {
+		events = events[len(events)-int(args.Last):]
+	}
+	resolvers := make([]*eventResolver, len(events))
+	for i, e := range events {
+		resolvers[i] = &eventResolver{e}
+	}
+	return resolvers, nil
+}
+
+type authorResolver struct {
+	a Author
+}
+
+func (r *authorResolver) ID() graphql.ID    { return formatID(r.a.ID) }
+func (r *authorResolver) Name() string      { return r.a.Name }
+func (r *authorResolver) DateOfBirth() Date { return r.a.DateOfBirth }
+
+func (r *authorResolver) Books(ctx context.Context) ([]*bookResolver, error) {
+	l, err := loadersFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := l.books.Load(ctx, int64Key(r.a.ID))()
+	if err != nil {
+		return nil, err
+	}
+	books, _ := data.([]Book)
+	resolvers := make([]*bookResolver, len(books))
+	for i, b := range books {
+		resolvers[i] = &bookResolver{b}
+	}
+	return resolvers, nil
+}
+
+func (r *authorResolver) Events(ctx context.Context, args eventsArgs) ([]*eventResolver, error) {
+	return lastEvents(ctx, "authors", r.a.ID, args)
+}
+
+type bookResolver struct {
+	b Book
+}
+
+func (r *bookResolver) ID() graphql.ID  { return formatID(r.b.ID) }
+func (r *bookResolver) Title() string   { return r.b.Title }
+func (r *bookResolver) Published() Date { return r.b.Published }
+
+func (r *bookResolver) Events(ctx context.Context, args eventsArgs) ([]*eventResolver, error) {
+	return lastEvents(ctx, "books", r.b.ID, args)
+}
+
+type eventResolver struct {
+	e Event
+}
+
+func (r *eventResolver) Seq() graphql.ID   { return formatID(r.e.Seq) }
+func (r *eventResolver) Ts() graphql.Time  { return graphql.Time{Time: r.e.When} }
+func (r *eventResolver) User() string      { return r.e.User }
+func (r *eventResolver) Operation() string { return r.e.Operation }
+func (r *eventResolver) Type() string      { return r.e.Type }
+
+func (r *eventResolver) ObjectID() *graphql.ID {
+	if r.e.ID == nil {
+		return nil
+	}
+	id := formatID(*r.e.ID)
+	return &id
+}
@@ -0,0 +1,126 @@
+package krud_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+// graphqlResponse is what /graphql responds, with data left for the test to decode.
+type graphqlResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, mock *MockDatabase, query string) graphqlResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]string{"query": query})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, mock)
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	checkStatusCode(t, resp, http.StatusOK)
+
+	var gr graphqlResponse
+	if err := json.NewDecoder(resp.Body).Decode(&gr); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	// Compact, to compare with.
+	var buf bytes.Buffer
+	json.Compact(&buf, gr.Data)
+	gr.Data = buf.Bytes()
+	return gr
+}
+
+func TestGraphQLAuthorsWithBooksBatched(t *testing.T) {
+	mock := MockWithAuthors(t)
+	mock.AddBook(context.Background(), 2, krud.Book{Title: "Orlando", Published: MakeDate(t, "1928-10-11")})
+	mock.AddBook(context.Background(), 3, krud.Book{Title: "War and Peace", Published: MakeDate(t, "1869-01-01")})
+	mock.AddBook(context.Background(), 2, krud.Book{Title: "The Waves", Published: MakeDate(t, "1931-10-08")})
+
+	gr := postGraphQL(t, mock, `{ authors { name books { title published } } }`)
+	if len(gr.Errors) != 0 {
+		t.Fatalf("unexpected errors: %+v", gr.Errors)
+	}
+	expected := `{"authors":[` +
+		`{"name":"Virginia Woolf","books":[{"title":"Orlando","published":"1928-10-11"},{"title":"The Waves","published":"1931-10-08"}]},` +
+		`{"name":"Leo Tolstoj","books":[{"title":"War and Peace","published":"1869-01-01"}]}]}`
+	if string(gr.Data) != expected {
+		t.Errorf("expected data:\n%s\nbut got:\n%s", expected, gr.Data)
+	}
+	if mock.booksOfCalls != 1 {
+		t.Errorf("expected books of all authors in 1 call but got: %d", mock.booksOfCalls)
+	}
+}
+
+func TestGraphQLAuthorWithEvents(t *testing.T) {
+	mock := MockWithEvents(t)
+	id, _ := mock.AddAuthor(context.Background(), krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1882-01-25")})
+	for i, op := range []string{krud.AUDIT_OP_CREATE, krud.AUDIT_OP_UPDATE} {
+		mock.events = append(mock.events, krud.Event{Seq: int64(i + 3), When: time.Now(), User: "bill", Operation: op, Type: "authors", ID: &id})
+	}
+
+	gr := postGraphQL(t, mock, `{ author(id: "2") { name events(last: 1) { seq operation } } missing: author(id: "99") { name } }`)
+	if len(gr.Errors) != 0 {
+		t.Fatalf("unexpected errors: %+v", gr.Errors)
+	}
+	expected := `{"author":{"name":"Virginia Woolf","events":[{"seq":"4","operation":"UPDATE"}]},"missing":null}`
+	if string(gr.Data) != expected {
+		t.Errorf("expected data:\n%s\nbut got:\n%s", expected, gr.Data)
+	}
+}
+
+func TestGraphQLCreateAuthorInvalid(t *testing.T) {
+	mock := EmptyMock()
+	gr := postGraphQL(t, mock, `mutation { createAuthor(input: {name: "F00", dateOfBirth: "1970-01-01"}) { id } }`)
+	if len(gr.Errors) != 1 {
+		t.Fatalf("expected an error but got: %+v", gr.Errors)
+	}
+	ext := gr.Errors[0].Extensions
+	if ext["code"] != krud.CodeValidation || ext["field"] != "name" {
+		t.Errorf("expected validation problem on name but got: %+v", gr.Errors[0])
+	}
+	if len(mock.authors) != 0 {
+		t.Errorf("expected no author to be added but got: %v", mock.authors)
+	}
+}
+
+func TestGraphQLUpdateBook(t *testing.T) {
+	mock := MockWithAuthors(t)
+	id, _ := mock.AddBook(context.Background(), 2, krud.Book{Title: "Orlando", Published: MakeDate(t, "1928-10-11")})
+
+	gr := postGraphQL(t, mock, fmt.Sprintf(`mutation { updateBook(authorId: "2", id: "%d", input: {title: "Orlando: A Biography"}) { title published } }`, id))
+	if len(gr.Errors) != 0 {
+		t.Fatalf("unexpected errors: %+v", gr.Errors)
+	}
+	expected := `{"updateBook":{"title":"Orlando: A Biography","published":"1928-10-11"}}`
+	if string(gr.Data) != expected {
+		t.Errorf("expected data:\n%s\nbut got:\n%s", expected, gr.Data)
+	}
+
+	gr = postGraphQL(t, mock, fmt.Sprintf(`mutation { updateBook(authorId: "3", id: "%d", input: {title: "Orlando"}) { title } }`, id))
+	if len(gr.Errors) != 1 || gr.Errors[0].Extensions["code"] != krud.CodeNotFound {
+		t.Errorf("expected the book missing for another author but got: %+v", gr.Errors)
+	}
+}
@@ -0,0 +1,417 @@
+package krud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/vikblom/krud/krudpb"
+)
+
+// grpcCodes lists, in order of precedence, how domain errors map onto gRPC, like problemTypes for HTTP.
+var grpcCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{ErrInvalid, codes.InvalidArgument},
+	{ErrDoesNotExist, codes.NotFound},
+	{ErrConflict, codes.Aborted},
+	{ErrUnauthorized, codes.Unauthenticated},
+	{ErrForbidden, codes.PermissionDenied},
+	{ErrRateLimited, codes.ResourceExhausted},
+}
+
+// grpcError is the single place where RPCs turn an error into a status.
+// Errors which are not domain errors are internal, and their details are not exposed.
+func grpcError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok {
+		// Like from sending on a stream, already a status.
+		return err
+	}
+	for _, gc := range grpcCodes {
+		if !errors.Is(err, gc.err) {
+			continue
+		}
+		var ve *ValidationError
+		if errors.As(err, &ve) && ve.Field != "" {
+			return status.Errorf(gc.code, "%s: %v", ve.Field, err)
+		}
+		return status.Error(gc.code, publicDetail(err))
+	}
+	LoggerFrom(ctx).Errorf("rpc: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// CatalogServer serves krudpb.CatalogServer over the Databaser of the user making each call.
+type CatalogServer struct {
+	krudpb.UnimplementedCatalogServer
+
+	dial     Dialer
+	log      *log.Logger
+	authMode AuthMode
+	// limiter limits calls by user and method, nil for no limits.
+	limiter *RateLimiter
+}
+
+// NewGRPCServer is a gRPC server with a CatalogServer registered, authenticating calls like the Controller
+// does requests, by mode. Calls are limited by limiter, unless nil, with the full method, like
+// "/krud.v1.Catalog/GetAuthor", as route. opts are passed on to grpc.NewServer, like credentials for TLS.
+func NewGRPCServer(log *log.Logger, dial Dialer, mode AuthMode, limiter *RateLimiter, opts ...grpc.ServerOption) *grpc.Server {
+	cs := &CatalogServer{dial: dial, log: log, authMode: mode, limiter: limiter}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(cs.unaryInterceptor),
+		grpc.ChainStreamInterceptor(cs.streamInterceptor),
+	)
+	s := grpc.NewServer(opts...)
+	krudpb.RegisterCatalogServer(s, cs)
+	return s
+}
+
+// principal is the user making a call, see Controller.principal.
+func (cs *CatalogServer) principal(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && cs.authMode != AuthHeader {
+		if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			chains := ti.State.VerifiedChains
+			if len(chains) > 0 && len(chains[0]) > 0 {
+				return chains[0][0].Subject.CommonName
+			}
+		}
+	}
+	if cs.authMode == AuthCertificate {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if users := md.Get("user"); len(users) > 0 {
+		return users[0]
+	}
+	return ""
+}
+
+// authenticate gives ctx a logger and the Databaser of the user making the call,
+// like the LoggingMiddleware, AuthMiddleware and RateLimitMiddleware of the Controller.
+func (cs *CatalogServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	fields := log.Fields{
+		"request_id": id,
+		"method":     "RPC",
+		"route":      method,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	ctx = context.WithValue(ctx, contextRequestID{}, id)
+	ctx = WithLogger(ctx, cs.log.WithFields(fields))
+
+	user := cs.principal(ctx)
+	addLogFields(ctx, log.Fields{"user": user})
+
+	db, err := cs.dial.Dial(ctx, user)
+	if err != nil {
+		LoggerFrom(ctx).Infof("auth rejected access to %s", method)
+		if errors.Is(err, ErrUnauthorized) {
+			if cs.limiter != nil {
+				q, res, err := cs.limiter.TakeUnauthorized(ctx)
+				if err := cs.limited(ctx, method, q, res, err); err != nil {
+					return ctx, err
+				}
+			}
+			err = fmt.Errorf("specify approved user in metadata: %w", err)
+		}
+		return ctx, grpcError(ctx, err)
+	}
+
+	if cs.limiter != nil {
+		q, res, err := cs.limiter.Take(ctx, user, method)
+		if err := cs.limited(ctx, method, q, res, err); err != nil {
+			return ctx, err
+		}
+	}
+	return context.WithValue(ctx, contextKrudDatabaser{}, db), nil
+}
+
+// limited is a ResourceExhausted status if the call to method is over quota q, after taking res
+// from its bucket, like Controller.limited. Calls go through if the store fails.
+func (cs *CatalogServer) limited(ctx context.Context, method string, q Quota, res RateLimitResult, err error) error {
+	if err != nil {
+		LoggerFrom(ctx).Errorf("rate limit: %v", err)
+		return nil
+	}
+	if res.Allowed {
+		return nil
+	}
+	return grpcError(ctx, fmt.Errorf("more than %s calls to %s, retry in %ds: %w", q, method, ceilSeconds(res.RetryAfter), ErrRateLimited))
+}
+
+// logCall logs a finished call, like the access log of the Controller.
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	LoggerFrom(ctx).WithFields(log.Fields{
+		"status":   status.Code(err).String(),
+		"duration": time.Since(start).String(),
+	}).Infof("RPC %s", method)
+}
+
+func (cs *CatalogServer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := cs.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		logCall(ctx, info.FullMethod, start, err)
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// contextStream is a grpc.ServerStream with another context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func (cs *CatalogServer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := cs.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		logCall(ctx, info.FullMethod, start, err)
+		return err
+	}
+	err = handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// parseDate parses a date of a message, named field.
+func parseDate(field, s string) (Date, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return Date{}, invalid(field, "expected a date like 2006-01-02 but got: '%s'", s)
+	}
+	return Date(t), nil
+}
+
+func authorToProto(a Author) *krudpb.Author {
+	return &krudpb.Author{Id: a.ID, Name: a.Name, DateOfBirth: a.DateOfBirth.Format("2006-01-02")}
+}
+
+func bookToProto(b Book) *krudpb.Book {
+	return &krudpb.Book{Id: b.ID, Title: b.Title, Published: b.Published.Format("2006-01-02")}
+}
+
+func eventToProto(e Event) *krudpb.Event {
+	return &krudpb.Event{
+		Seq:       e.Seq,
+		Ts:        timestamppb.New(e.When),
+		User:      e.User,
+		Operation: e.Operation,
+		Type:      e.Type,
+		ObjectId:  e.ID,
+	}
+}
+
+func (cs *CatalogServer) CreateAuthor(ctx context.Context, req *krudpb.CreateAuthorRequest) (*krudpb.Author, error) {
+	dob, err := parseDate("date_of_birth", req.GetAuthor().GetDateOfBirth())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	author := Author{Name: req.GetAuthor().GetName(), DateOfBirth: dob}
+	err = author.Validate()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	author.ID, err = db.AddAuthor(ctx, author)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return authorToProto(author), nil
+}
+
+func (cs *CatalogServer) GetAuthor(ctx context.Context, req *krudpb.GetAuthorRequest) (*krudpb.Author, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	author, err := db.GetAuthor(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return authorToProto(*author), nil
+}
+
+func (cs *CatalogServer) ListAuthors(req *krudpb.ListAuthorsRequest, stream krudpb.Catalog_ListAuthorsServer) error {
+	ctx := stream.Context()
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	err = db.EachAuthor(ctx, func(a Author) error {
+		return stream.Send(authorToProto(a))
+	})
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	return nil
+}
+
+// UpdateAuthor only changes the fields that are set, like a PATCH.
+func (cs *CatalogServer) UpdateAuthor(ctx context.Context, req *krudpb.UpdateAuthorRequest) (*krudpb.Author, error) {
+	changes := AuthorChanges{Name: req.Name}
+	if req.DateOfBirth != nil {
+		dob, err := parseDate("date_of_birth", req.GetDateOfBirth())
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		changes.DateOfBirth = &dob
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	author, err := db.PatchAuthor(ctx, req.GetId(), changes)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return authorToProto(*author), nil
+}
+
+func (cs *CatalogServer) DeleteAuthor(ctx context.Context, req *krudpb.DeleteAuthorRequest) (*emptypb.Empty, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	err = db.DeleteAuthor(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *CatalogServer) CreateBook(ctx context.Context, req *krudpb.CreateBookRequest) (*krudpb.Book, error) {
+	published, err := parseDate("published", req.GetBook().GetPublished())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	book := Book{Title: req.GetBook().GetTitle(), Published: published}
+	err = book.Validate()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	book.ID, err = db.AddBook(ctx, req.GetAuthorId(), book)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return bookToProto(book), nil
+}
+
+func (cs *CatalogServer) GetBook(ctx context.Context, req *krudpb.GetBookRequest) (*krudpb.Book, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	book, err := db.GetBook(ctx, req.GetAuthorId(), req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return bookToProto(*book), nil
+}
+
+func (cs *CatalogServer) ListBooks(req *krudpb.ListBooksRequest, stream krudpb.Catalog_ListBooksServer) error {
+	ctx := stream.Context()
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	err = db.EachBook(ctx, req.GetAuthorId(), func(b Book) error {
+		return stream.Send(bookToProto(b))
+	})
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	return nil
+}
+
+// UpdateBook only changes the fields that are set, like a PATCH.
+func (cs *CatalogServer) UpdateBook(ctx context.Context, req *krudpb.UpdateBookRequest) (*krudpb.Book, error) {
+	changes := BookChanges{Title: req.Title}
+	if req.Published != nil {
+		published, err := parseDate("published", req.GetPublished())
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		changes.Published = &published
+	}
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	book, err := db.PatchBook(ctx, req.GetAuthorId(), req.GetId(), changes)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return bookToProto(*book), nil
+}
+
+func (cs *CatalogServer) DeleteBook(ctx context.Context, req *krudpb.DeleteBookRequest) (*emptypb.Empty, error) {
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	err = db.DeleteBook(ctx, req.GetAuthorId(), req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (cs *CatalogServer) ListEvents(req *krudpb.ListEventsRequest, stream krudpb.Catalog_ListEventsServer) error {
+	ctx := stream.Context()
+	db, err := databaserFrom(ctx)
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	var filters []Filter
+	if req.After != nil {
+		filters = append(filters, EventsAfter(req.GetAfter().AsTime()))
+	}
+	if req.Before != nil {
+		filters = append(filters, EventsBefore(req.GetBefore().AsTime()))
+	}
+	err = db.EachEvent(ctx, func(e Event) error {
+		return stream.Send(eventToProto(e))
+	}, filters...)
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	return nil
+}
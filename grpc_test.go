@@ -0,0 +1,185 @@
+package krud_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/vikblom/krud"
+	"github.com/vikblom/krud/krudpb"
+)
+
+// catalogClient serves dial in memory, returning a client to it.
+func catalogClient(t *testing.T, dial krud.Dialer) krudpb.CatalogClient {
+	t.Helper()
+	return limitedCatalogClient(t, dial, nil)
+}
+
+// limitedCatalogClient is like catalogClient, with calls limited by limiter.
+func limitedCatalogClient(t *testing.T, dial krud.Dialer, limiter *krud.RateLimiter) krudpb.CatalogClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	log, _ := test.NewNullLogger()
+	srv := krud.NewGRPCServer(log, dial, krud.AuthAny, limiter)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return krudpb.NewCatalogClient(conn)
+}
+
+func asUser(user string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "user", user)
+}
+
+func TestGRPCListAuthors(t *testing.T) {
+	client := catalogClient(t, MockWithAuthors(t))
+
+	stream, err := client.ListAuthors(asUser("bill"), &krudpb.ListAuthorsRequest{})
+	if err != nil {
+		t.Fatalf("list authors: %v", err)
+	}
+	var names []string
+	for {
+		a, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("receive author: %v", err)
+		}
+		names = append(names, a.GetName()+" "+a.GetDateOfBirth())
+	}
+	if len(names) != 2 || names[0] != "Virginia Woolf 1882-01-25" {
+		t.Errorf("expected 2 authors but got: %v", names)
+	}
+}
+
+func TestGRPCCreateAndGetAuthor(t *testing.T) {
+	mock := EmptyMock()
+	client := catalogClient(t, mock)
+
+	created, err := client.CreateAuthor(asUser("bill"), &krudpb.CreateAuthorRequest{
+		Author: &krudpb.Author{Name: "Leo Tolstoj", DateOfBirth: "1828-09-09"},
+	})
+	if err != nil {
+		t.Fatalf("create author: %v", err)
+	}
+	got, err := client.GetAuthor(asUser("bill"), &krudpb.GetAuthorRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatalf("get author: %v", err)
+	}
+	if got.GetName() != "Leo Tolstoj" || got.GetDateOfBirth() != "1828-09-09" {
+		t.Errorf("expected the created author but got: %v", got)
+	}
+}
+
+func TestGRPCUpdateBook(t *testing.T) {
+	mock := MockWithAuthors(t)
+	id, _ := mock.AddBook(context.Background(), 2, krud.Book{Title: "Orlando", Published: MakeDate(t, "1928-10-11")})
+	client := catalogClient(t, mock)
+
+	title := "Orlando: A Biography"
+	got, err := client.UpdateBook(asUser("bill"), &krudpb.UpdateBookRequest{AuthorId: 2, Id: id, Title: &title})
+	if err != nil {
+		t.Fatalf("update book: %v", err)
+	}
+	if got.GetTitle() != title || got.GetPublished() != "1928-10-11" {
+		t.Errorf("expected only the title changed but got: %v", got)
+	}
+	_, err = client.UpdateBook(asUser("bill"), &krudpb.UpdateBookRequest{AuthorId: 3, Id: id, Title: &title})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected the book missing for another author but got: %v", err)
+	}
+}
+
+func TestGRPCErrorCodes(t *testing.T) {
+	client := catalogClient(t, EmptyMock())
+
+	_, err := client.CreateAuthor(asUser("bill"), &krudpb.CreateAuthorRequest{
+		Author: &krudpb.Author{Name: "F00", DateOfBirth: "1970-01-01"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument but got: %v", err)
+	}
+	_, err = client.CreateAuthor(asUser("bill"), &krudpb.CreateAuthorRequest{
+		Author: &krudpb.Author{Name: "Foo", DateOfBirth: "01/01/1970"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected invalid argument but got: %v", err)
+	}
+	_, err = client.GetAuthor(asUser("bill"), &krudpb.GetAuthorRequest{Id: 99})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found but got: %v", err)
+	}
+}
+
+func TestGRPCUnauthenticated(t *testing.T) {
+	dial := krud.DialFunc(func(ctx context.Context, user string) (krud.Databaser, error) {
+		if user != "bill" {
+			return nil, krud.ErrUnauthorized
+		}
+		return EmptyMock(), nil
+	})
+	client := catalogClient(t, dial)
+
+	_, err := client.GetAuthor(context.Background(), &krudpb.GetAuthorRequest{Id: 1})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated without a user but got: %v", err)
+	}
+	stream, err := client.ListAuthors(asUser("mallory"), &krudpb.ListAuthorsRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected unauthenticated as another user but got: %v", err)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	limiter := krud.NewRateLimiter(log, krud.NewMemoryRateLimitStore(krud.DefaultMaxRateLimitBuckets),
+		krud.Quota{Requests: 1, Per: time.Hour}, krud.WithUnauthorizedQuota(krud.Quota{Requests: 1, Per: time.Hour}))
+	mock := EmptyMock()
+	id, _ := mock.AddAuthor(context.Background(), krud.Author{Name: "Leo Tolstoj", DateOfBirth: MakeDate(t, "1828-09-09")})
+	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+		if user != "bill" {
+			return nil, krud.ErrUnauthorized
+		}
+		return mock, nil
+	}
+	client := limitedCatalogClient(t, krud.DialFunc(dial), limiter)
+
+	req := &krudpb.GetAuthorRequest{Id: id}
+	if _, err := client.GetAuthor(asUser("bill"), req); err != nil {
+		t.Fatalf("get author: %v", err)
+	}
+	if _, err := client.GetAuthor(asUser("bill"), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the quota of bill used up but got: %v", err)
+	}
+
+	// Unknown users share a bucket, whatever name they give.
+	if _, err := client.GetAuthor(asUser("mallory"), req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected mallory unauthenticated but got: %v", err)
+	}
+	if _, err := client.GetAuthor(asUser("eve"), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected out of unauthorized calls but got: %v", err)
+	}
+}
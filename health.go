@@ -0,0 +1,78 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// SchemaVersion is the version of the schema this code is written against,
+// the last of the migrations and the one initdb/init.sql makes.
+const SchemaVersion = 7
+
+// CheckSchema makes sure db has been migrated far enough for this code.
+// A newer schema is fine, that is what a rolling upgrade looks like.
+func CheckSchema(ctx context.Context, db *sql.DB) error {
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("select schema version: %w", err)
+	}
+	if version < SchemaVersion {
+		return fmt.Errorf("schema version %d, need at least %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// Health answers liveness and readiness probes.
+type Health struct {
+	db *sql.DB
+	// timeout caps how long a readiness check may take.
+	timeout time.Duration
+	// draining is set, atomically, once shutdown has begun.
+	draining int32
+}
+
+func NewHealth(db *sql.DB) *Health {
+	return &Health{db: db, timeout: 2 * time.Second}
+}
+
+// Drain makes readiness fail from now on, so no new traffic is routed here.
+func (h *Health) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Live is the liveness probe. The process is up if it can answer at all.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Ready is the readiness probe, checking that the database is reachable and migrated.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if atomic.LoadInt32(&h.draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "draining")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	if err := h.db.PingContext(ctx); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "database: %v\n", err)
+		return
+	}
+	if err := CheckSchema(ctx, h.db); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "schema: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,39 @@
+package krud_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vikblom/krud"
+)
+
+func TestHealthLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	krud.NewHealth(nil).Live(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	checkStatusCode(t, w.Result(), http.StatusOK)
+}
+
+func TestHealthNotReadyWhenDraining(t *testing.T) {
+	// A draining server must not touch the (here missing) database.
+	health := krud.NewHealth(nil)
+	health.Drain()
+
+	w := httptest.NewRecorder()
+	health.Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	checkStatusCode(t, w.Result(), http.StatusServiceUnavailable)
+}
+
+func TestHealthReady(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	if err := krud.CheckSchema(context.Background(), pdb); err != nil {
+		t.Fatalf("check schema: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	krud.NewHealth(pdb).Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	checkStatusCode(t, w.Result(), http.StatusOK)
+}
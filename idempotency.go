@@ -0,0 +1,188 @@
+package krud
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKey lets a create be retried without creating the object twice.
+// The response to the first request is stored under Key, retries get the same response back.
+type IdempotencyKey struct {
+	Key string
+	// RequestHash identifies the request the key was first used with.
+	RequestHash string
+	// TTL is how long a key is remembered.
+	TTL time.Duration
+}
+
+// IdempotentResponse is what was stored for an IdempotencyKey.
+type IdempotentResponse struct {
+	RequestHash string
+	Response    json.RawMessage
+	Created     time.Time
+}
+
+type contextIdempotencyKey struct{}
+
+// WithIdempotencyKey makes creates done with ctx store their result under key.
+func WithIdempotencyKey(ctx context.Context, key IdempotencyKey) context.Context {
+	return context.WithValue(ctx, contextIdempotencyKey{}, key)
+}
+
+// IdempotencyKeyFrom gets the key put in ctx by WithIdempotencyKey.
+func IdempotencyKeyFrom(ctx context.Context) (IdempotencyKey, bool) {
+	key, ok := ctx.Value(contextIdempotencyKey{}).(IdempotencyKey)
+	return key, ok
+}
+
+// IdempotentResponse looks up what was stored for key in the last ttl.
+func (adb *AuditDB) IdempotentResponse(ctx context.Context, key string, ttl time.Duration) (resp *IdempotentResponse, err error) {
+	defer observe(ctx, "IdempotentResponse", time.Now(), &err)
+
+	resp = new(IdempotentResponse)
+	var response string
+	err = adb.wrapInTransaction(ctx, "IdempotentResponse", func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`SELECT request_hash, response, created
+             FROM idempotency_keys
+             WHERE username=$1 AND key=$2 AND created > $3`,
+			adb.user,
+			key,
+			time.Now().Add(-ttl).UTC()).Scan(&resp.RequestHash, &response, &resp.Created)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("select idempotency key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Response = json.RawMessage(response)
+	return resp, nil
+}
+
+// storeIdempotent remembers created as the response for the key in ctx, if there is one.
+// Must be in the same transaction as the create, so either both or none happen.
+func (adb *AuditDB) storeIdempotent(ctx context.Context, tx *sql.Tx, created interface{}) error {
+	key, ok := IdempotencyKeyFrom(ctx)
+	if !ok {
+		return nil
+	}
+
+	response, err := json.Marshal(created)
+	if err != nil {
+		return fmt.Errorf("marshal response: %w", err)
+	}
+
+	// An expired key may be used again before it is swept, a key in use means
+	// that a concurrent request with the same key got there first.
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (username, key, request_hash, response, created)
+         VALUES ($1, $2, $3, $4, $5)
+         ON CONFLICT (username, key) DO UPDATE
+         SET request_hash = EXCLUDED.request_hash, response = EXCLUDED.response, created = EXCLUDED.created
+         WHERE idempotency_keys.created < $6`,
+		adb.user,
+		key.Key,
+		key.RequestHash,
+		string(response),
+		time.Now().UTC(),
+		time.Now().Add(-key.TTL).UTC())
+	if err != nil {
+		return fmt.Errorf("insert idempotency key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("insert idempotency key: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: idempotency key '%s' is in use", ErrConflict, key.Key)
+	}
+	return nil
+}
+
+// SweepIdempotencyKeys deletes the keys of every user older than ttl, outside of any request.
+// Returns how many were deleted.
+func SweepIdempotencyKeys(ctx context.Context, db *sql.DB, ttl time.Duration) (n int64, err error) {
+	defer observe(ctx, "SweepIdempotencyKeys", time.Now(), &err)
+
+	res, err := db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created < $1", time.Now().Add(-ttl).UTC())
+	if err != nil {
+		return 0, fmt.Errorf("delete expired idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// DefaultIdempotencyTTL is how long idempotency keys are remembered unless configured.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// DefaultIdempotencySweep is how often expired idempotency keys are deleted.
+const DefaultIdempotencySweep = 10 * time.Minute
+
+// maxIdempotentBody caps how much of a request body is read to hash it.
+const maxIdempotentBody = 1 << 20
+
+// Idempotent handles the Idempotency-Key header for creates.
+// A retry with the same key and body gets the stored response back,
+// the same key with some other body is rejected.
+func (api *Controller) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			api.writeError(w, r, invalid("Idempotency-Key", "idempotency key longer than 255 characters"))
+			return
+		}
+
+		db, err := databaser(r)
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			api.writeError(w, r, invalid("", "read body: %v", err))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+		h.Write(body)
+		hash := hex.EncodeToString(h.Sum(nil))
+
+		prev, err := db.IdempotentResponse(r.Context(), key, api.idempotencyTTL)
+		if err == nil {
+			if prev.RequestHash != hash {
+				api.writeError(w, r, fmt.Errorf("%w: key '%s' was first used with another request", ErrIdempotencyMismatch, key))
+				return
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			WriteJson(w, prev.Response, http.StatusCreated)
+			return
+		}
+		if !errors.Is(err, ErrDoesNotExist) {
+			api.writeError(w, r, err)
+			return
+		}
+
+		ctx := WithIdempotencyKey(r.Context(), IdempotencyKey{Key: key, RequestHash: hash, TTL: api.idempotencyTTL})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -1,38 +1,219 @@
 -- TODO: Move to .go ?
 -- TODO: When is NOT NULL required?
 
+-- Version of the schema, must match krud.SchemaVersion and the migrations.
+CREATE TABLE schema_migrations (
+       version INT PRIMARY KEY NOT NULL,
+       applied TIMESTAMP NOT NULL DEFAULT NOW()
+);
+INSERT INTO schema_migrations (version) VALUES (1), (2), (3), (4), (5), (6), (7);
+
+-- Transactions of krud.AuditDB run as krud_tenant with krud.tenant set to the tenant of the user,
+-- the policies at the end keep them to the rows of that tenant, see krud.DefaultTenant.
+-- Whoever runs the server must be able to SET ROLE krud_tenant, and should own the tables.
+DO $$
+BEGIN
+       IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'krud_tenant') THEN
+               CREATE ROLE krud_tenant NOLOGIN;
+       END IF;
+END $$;
+GRANT krud_tenant TO CURRENT_USER;
 
 CREATE TABLE users (
        --id SERIAL PRIMARY KEY,
-       name TEXT PRIMARY KEY NOT NULL
+       name TEXT PRIMARY KEY NOT NULL,
+       tenant_id TEXT NOT NULL CHECK (tenant_id <> '') -- whose rows they see
 );
 
 -- hard-code users
-INSERT INTO users (name) VALUES('miles');
-INSERT INTO users (name) VALUES('bill');
-INSERT INTO users (name) VALUES('john');
+INSERT INTO users (name, tenant_id) VALUES('miles', 'default');
+INSERT INTO users (name, tenant_id) VALUES('bill', 'default');
+INSERT INTO users (name, tenant_id) VALUES('john', 'default');
 
 CREATE TABLE authors (
        id SERIAL PRIMARY KEY,
+       tenant_id TEXT NOT NULL DEFAULT current_setting('krud.tenant'),
        name TEXT NOT NULL,
-       date_of_birth date NOT NULL
+       date_of_birth date NOT NULL,
+       CONSTRAINT authors_id_tenant UNIQUE (id, tenant_id)
 );
 
 CREATE TABLE books (
        id SERIAL PRIMARY KEY,
+       tenant_id TEXT NOT NULL DEFAULT current_setting('krud.tenant'),
        author_id INT NOT NULL,
        title TEXT NOT NULL,
        published timestamp NOT NULL,
-       CONSTRAINT fk_author FOREIGN KEY (author_id) REFERENCES authors (id)
+       -- Foreign keys are checked without row level security, the tenant has to be part of it.
+       CONSTRAINT fk_author FOREIGN KEY (author_id, tenant_id) REFERENCES authors (id, tenant_id)
 );
 
 
+-- Partitioned by month of ts, partitions are made ahead by the server and
+-- archived once expired, see krud.EnsureEventPartitions and krud.ArchiveEvents.
 CREATE TABLE events (
-       ts TIMESTAMP NOT NULL,   -- when
+       seq BIGINT NOT NULL,     -- position in the chain, from 1 without gaps
+       ts TIMESTAMP NOT NULL,   -- when, never before the event before it
+       tenant_id TEXT,          -- of the user, none if unknown
        username TEXT NOT NULL,  -- who
        operation TEXT NOT NULL, -- CREATE, READ, UPDATE or DELETE
        obj_type TEXT NOT NULL,  --
        obj_id INT,              -- if applicable
-       data TEXT                -- TODO: Data (json?) if op is CREATE or UPDATE
+       data TEXT,               -- TODO: Data (json?) if op is CREATE or UPDATE
+       prev_hash BYTEA,         -- hash of the event before, empty for the first
+       hash BYTEA,              -- sha256 over the fields above and prev_hash
+       -- The partition key has to be part of it.
+       PRIMARY KEY (seq, ts)
        -- CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES users (id)
+) PARTITION BY RANGE (ts);
+-- Catches events of months without a partition, should stay empty.
+CREATE TABLE events_default PARTITION OF events DEFAULT;
+-- For filtering on time, see krud.EventsAfter and krud.EventsBefore.
+CREATE INDEX events_ts ON events (ts);
+-- For the events of objects, see krud.EventsOn and krud.EventsLastOn.
+CREATE INDEX events_object ON events (obj_type, obj_id, seq);
+
+-- Tail of the chain of events, locked when appending to it.
+-- Events up to archived_seq have been archived, the chain continues from archived_hash.
+-- Events from tenant_hashed_from on hash their tenant, see krud.chainHash.
+CREATE TABLE event_chain (
+       id INT PRIMARY KEY CHECK (id = 1),
+       seq BIGINT NOT NULL,
+       hash BYTEA NOT NULL,
+       ts TIMESTAMP,
+       archived_seq BIGINT NOT NULL DEFAULT 0,
+       archived_hash BYTEA NOT NULL DEFAULT '',
+       tenant_hashed_from BIGINT NOT NULL DEFAULT 1
+);
+INSERT INTO event_chain (id, seq, hash) VALUES (1, 0, '');
+
+-- Tenants do not touch event_chain, which has no tenant, but lock and advance it through these,
+-- which run as the owner. See krud.linkEvents.
+CREATE FUNCTION lock_event_chain(OUT seq BIGINT, OUT hash BYTEA, OUT ts TIMESTAMP, OUT tenant_hashed_from BIGINT)
+       LANGUAGE sql SECURITY DEFINER
+       AS $$ SELECT seq, hash, ts, tenant_hashed_from FROM event_chain WHERE id = 1 FOR UPDATE $$;
+-- Only ever onto an event that has been inserted, so the tail cannot be made up.
+CREATE FUNCTION advance_event_chain(to_seq BIGINT) RETURNS void
+       LANGUAGE plpgsql SECURITY DEFINER
+       AS $$
+BEGIN
+       UPDATE event_chain c SET seq = e.seq, hash = e.hash, ts = e.ts
+              FROM events e
+              WHERE c.id = 1 AND e.seq = to_seq AND e.seq > c.seq;
+       IF NOT FOUND THEN
+              RAISE EXCEPTION 'no event % after the tail of the chain', to_seq;
+       END IF;
+END $$;
+-- Functions run as their owner should not find tables made by whoever calls them.
+DO $$
+BEGIN
+       EXECUTE format('ALTER FUNCTION lock_event_chain() SET search_path = %I, pg_temp', current_schema());
+       EXECUTE format('ALTER FUNCTION advance_event_chain(BIGINT) SET search_path = %I, pg_temp', current_schema());
+END $$;
+
+-- Responses to POST requests carrying an Idempotency-Key,
+-- stored in the same transaction as the object they created.
+CREATE TABLE idempotency_keys (
+       tenant_id TEXT NOT NULL DEFAULT current_setting('krud.tenant'),
+       username TEXT NOT NULL,
+       key TEXT NOT NULL,
+       request_hash TEXT NOT NULL, -- sha256 of method, path and body
+       response TEXT NOT NULL,     -- json of the created object
+       created TIMESTAMP NOT NULL,
+       PRIMARY KEY (username, key)
+);
+CREATE INDEX idempotency_keys_created ON idempotency_keys (created);
+
+-- Webhooks notify partners of changes to authors and books, see krud.Webhook.
+CREATE TABLE webhooks (
+       id SERIAL PRIMARY KEY,
+       tenant_id TEXT NOT NULL DEFAULT current_setting('krud.tenant'),
+       username TEXT NOT NULL,             -- owner, only they see it
+       url TEXT NOT NULL,
+       secret TEXT NOT NULL,               -- signs deliveries with HMAC-SHA256
+       types TEXT[] NOT NULL DEFAULT '{}', -- object types to notify about, all if empty
+       active BOOLEAN NOT NULL DEFAULT TRUE,
+       created TIMESTAMP NOT NULL
 );
+
+-- Outbox of messages to webhooks, written in the same transaction as the change.
+CREATE TABLE webhook_messages (
+       id BIGSERIAL PRIMARY KEY,
+       webhook_id INT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+       tenant_id TEXT NOT NULL,    -- of the webhook
+       event_seq BIGINT NOT NULL,  -- the event the message is about
+       type TEXT NOT NULL,         -- like authors.update
+       payload TEXT NOT NULL,      -- json body to POST
+       state TEXT NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'delivered', 'dead')),
+       attempts INT NOT NULL DEFAULT 0,
+       next_attempt TIMESTAMP NOT NULL,
+       created TIMESTAMP NOT NULL
+);
+CREATE INDEX webhook_messages_due ON webhook_messages (next_attempt) WHERE state = 'pending';
+CREATE INDEX webhook_messages_webhook ON webhook_messages (webhook_id, id);
+
+-- Every attempt at delivering a message.
+CREATE TABLE webhook_deliveries (
+       id BIGSERIAL PRIMARY KEY,
+       message_id BIGINT NOT NULL REFERENCES webhook_messages (id) ON DELETE CASCADE,
+       webhook_id INT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+       tenant_id TEXT NOT NULL,
+       attempt INT NOT NULL,
+       ts TIMESTAMP NOT NULL,
+       status INT,          -- of the response, if there was one
+       error TEXT,          -- why it failed, if it did
+       duration_ms INT NOT NULL
+);
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+
+-- Token buckets of krud.PostgresRateLimitStore, shared by every server.
+-- Only the owner of the tables uses them, so there is no tenant.
+CREATE TABLE rate_limits (
+       key TEXT PRIMARY KEY,               -- user and route template
+       tokens DOUBLE PRECISION NOT NULL,
+       updated TIMESTAMPTZ NOT NULL,
+       full_at TIMESTAMPTZ NOT NULL        -- when the bucket has refilled, to sweep it
+);
+CREATE INDEX rate_limits_full_at ON rate_limits (full_at);
+
+-- Tenants see only their own rows, the owner of the tables sees all of them.
+CREATE POLICY tenant_isolation ON authors TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON books TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON events TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON idempotency_keys TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhooks TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhook_messages TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhook_deliveries TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+
+ALTER TABLE authors ENABLE ROW LEVEL SECURITY;
+ALTER TABLE books ENABLE ROW LEVEL SECURITY;
+ALTER TABLE events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE idempotency_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhooks ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_messages ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_deliveries ENABLE ROW LEVEL SECURITY;
+
+-- Not users, nor the partitions of events, which would skip the policy of events.
+-- Events are only ever appended, event_chain only through the functions above.
+GRANT SELECT, INSERT, UPDATE, DELETE
+      ON authors, books, idempotency_keys, webhooks, webhook_messages, webhook_deliveries
+      TO krud_tenant;
+GRANT SELECT, INSERT ON events TO krud_tenant;
+REVOKE EXECUTE ON FUNCTION lock_event_chain(), advance_event_chain(BIGINT) FROM PUBLIC;
+GRANT EXECUTE ON FUNCTION lock_event_chain(), advance_event_chain(BIGINT) TO krud_tenant;
+GRANT USAGE ON SEQUENCE authors_id_seq, books_id_seq, webhooks_id_seq, webhook_messages_id_seq, webhook_deliveries_id_seq
+      TO krud_tenant;
@@ -0,0 +1,45 @@
+package krudapi
+
+// BulkMode decides what happens to a bulk import when some of the items fail.
+type BulkMode int
+
+const (
+	// BulkAtomic imports all items or none of them.
+	BulkAtomic BulkMode = iota
+	// BulkBestEffort imports whatever items it can.
+	BulkBestEffort
+)
+
+func (m BulkMode) String() string {
+	if m == BulkBestEffort {
+		return "best-effort"
+	}
+	return "atomic"
+}
+
+// ParseBulkMode is the inverse of BulkMode.String, empty means atomic.
+func ParseBulkMode(s string) (BulkMode, error) {
+	switch s {
+	case "", "atomic":
+		return BulkAtomic, nil
+	case "best-effort":
+		return BulkBestEffort, nil
+	}
+	return BulkAtomic, invalid("mode", "unknown bulk mode: '%s'", s)
+}
+
+// BulkItem is the outcome of one item in a bulk request.
+type BulkItem struct {
+	Index   int      `json:"index"`
+	Status  int      `json:"status"`
+	ID      int64    `json:"id,omitempty"`
+	Problem *Problem `json:"problem,omitempty"`
+}
+
+// BulkResponse is the body of a response to a bulk request.
+type BulkResponse struct {
+	Mode    string     `json:"mode"`
+	Created int        `json:"created"`
+	Failed  int        `json:"failed"`
+	Items   []BulkItem `json:"items"`
+}
@@ -0,0 +1,19 @@
+package krudapi
+
+// ChainBreak is where the chain of events does not hold.
+type ChainBreak struct {
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// ChainVerification is the outcome of checking the chain of events.
+// The API only tells OK, the chain runs through every tenant. The rest is told by `main audit verify`.
+type ChainVerification struct {
+	OK bool `json:"ok"`
+	// Checked is the number of events found to be linked correctly.
+	Checked int64 `json:"checked,omitempty"`
+	// Unchained is the number of events from before there was a chain, which cannot be checked.
+	Unchained int64 `json:"unchained,omitempty"`
+	// Broken is the first link that does not hold, if any.
+	Broken *ChainBreak `json:"broken,omitempty"`
+}
@@ -0,0 +1,48 @@
+package krudapi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Domain errors. Anything returned from a krud.Databaser or a Validate method
+// should wrap one of these so the krud.Controller can tell what went wrong
+// without looking at strings or SQL codes. Clients get them back from problems, see Problem.Err.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrDoesNotExist = errors.New("object not found")
+	ErrConflict     = errors.New("conflict")
+	ErrInvalid      = errors.New("invalid")
+	// ErrNotAcceptable is for requests asking for a representation we cannot produce.
+	ErrNotAcceptable = errors.New("not acceptable")
+	// ErrIdempotencyMismatch is for an idempotency key reused with a different request.
+	ErrIdempotencyMismatch = errors.New("idempotency key reused")
+	// ErrRateLimited is for users making more requests than their quota, see krud.RateLimiter.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// ValidationError describes why some input was rejected.
+// It matches ErrInvalid with errors.Is.
+type ValidationError struct {
+	Field  string
+	Reason string
+	// Err is the underlying cause, if any.
+	Err error
+}
+
+func (ve *ValidationError) Error() string {
+	return ve.Reason
+}
+
+func (ve *ValidationError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+func (ve *ValidationError) Unwrap() error {
+	return ve.Err
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
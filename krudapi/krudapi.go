@@ -0,0 +1,19 @@
+// Package krudapi has the bodies, problems and errors of the krud HTTP API, as served by
+// krud.NewController. It only needs the standard library, so that clients of the API,
+// like package client, need not import the server. Package krud has them all under the same names.
+package krudapi
+
+// Media types a collection can be written as.
+const (
+	MediaJSON   = "application/json"
+	MediaCSV    = "text/csv"
+	MediaNDJSON = "application/x-ndjson"
+)
+
+// MediaProblem is the media type of a Problem.
+const MediaProblem = "application/problem+json"
+
+// Record is something that can be written as a CSV row.
+type Record interface {
+	CSVRecord() []string
+}
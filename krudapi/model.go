@@ -0,0 +1,149 @@
+package krudapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Date is borrowed from:
+// https://stackoverflow.com/questions/45303326/how-to-parse-non-standard-time-format-from-json
+// Overrides time.Time with only year, month, day in JSON representation.
+type Date time.Time
+
+// Implement Marshaler and Unmarshaler interface
+func (d *Date) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return err
+	}
+	*d = Date(t)
+	return nil
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(d).Format("2006-01-02"))
+}
+
+// Maybe a Format function for printing your date
+func (d Date) Format(s string) string {
+	t := time.Time(d)
+	return t.Format(s)
+}
+
+// ImplementsGraphQLType makes Date the Date scalar of the GraphQL API.
+func (Date) ImplementsGraphQLType(name string) bool {
+	return name == "Date"
+}
+
+func (d *Date) UnmarshalGraphQL(input interface{}) error {
+	s, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("expected a date like 2006-01-02 but got: %T", input)
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return err
+	}
+	*d = Date(t)
+	return nil
+}
+
+type Author struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DateOfBirth Date   `json:"dateofbirth"`
+}
+
+// AuthorCSVHeader names the columns of Author.CSVRecord.
+var AuthorCSVHeader = []string{"id", "name", "dateofbirth"}
+
+func (a Author) CSVRecord() []string {
+	return []string{strconv.FormatInt(a.ID, 10), a.Name, a.DateOfBirth.Format("2006-01-02")}
+}
+
+// Validate does basic sanity checking of this Author.
+// But there is always:
+// https://www.kalzumeus.com/2010/06/17/falsehoods-programmers-believe-about-names/
+func (a *Author) Validate() error {
+
+	if len(a.Name) == 0 {
+		return invalid("name", "name empty")
+	}
+	for _, r := range a.Name {
+		if unicode.IsLetter(r) {
+			continue
+		}
+		if r == ' ' || r == '.' {
+			continue
+		}
+		return invalid("name", "name contains unexpected rune: %c", r)
+
+	}
+
+	if time.Time(a.DateOfBirth).IsZero() {
+		return invalid("dateofbirth", "birthdate before the start of civilization")
+	}
+
+	return nil
+}
+
+type Book struct {
+	ID        int64  `json:"id"`
+	Title     string `json:"title"`
+	Published Date   `json:"published"`
+}
+
+// BookCSVHeader names the columns of Book.CSVRecord.
+var BookCSVHeader = []string{"id", "title", "published"}
+
+func (b Book) CSVRecord() []string {
+	return []string{strconv.FormatInt(b.ID, 10), b.Title, b.Published.Format("2006-01-02")}
+}
+
+func (b *Book) Validate() error {
+
+	if len(b.Title) == 0 {
+		return invalid("title", "title empty")
+	}
+
+	if time.Time(b.Published).IsZero() {
+		return invalid("published", "published before the start of civilization")
+	}
+
+	return nil
+}
+
+// AuthorBook is a Book together with the id of its author.
+type AuthorBook struct {
+	AuthorID int64 `json:"author_id"`
+	Book
+}
+
+// Event is an audit event, a user doing an operation on an object.
+type Event struct {
+	// Seq is the position of the event in the chain of events, see krud.VerifyChain.
+	Seq  int64
+	When time.Time
+	// Tenant of User, empty if the user is unknown. Not shown, only the tenant sees the event.
+	Tenant    string `json:"-"`
+	User      string
+	Operation string
+	Type      string
+	ID        *int64 // Can be NULL.
+}
+
+// EventCSVHeader names the columns of Event.CSVRecord.
+var EventCSVHeader = []string{"when", "user", "operation", "type", "id"}
+
+func (e Event) CSVRecord() []string {
+	id := ""
+	if e.ID != nil {
+		id = strconv.FormatInt(*e.ID, 10)
+	}
+	return []string{e.When.Format(time.RFC3339Nano), e.User, e.Operation, e.Type, id}
+}
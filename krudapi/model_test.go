@@ -1,11 +1,11 @@
-package krud_test
+package krudapi_test
 
 import (
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/vikblom/krud"
+	"github.com/vikblom/krud/krudapi"
 )
 
 func TestAuthorValid(t *testing.T) {
@@ -21,7 +21,7 @@ func TestAuthorValid(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		a := krud.Author{Name: tt, DateOfBirth: krud.Date(time.Now())}
+		a := krudapi.Author{Name: tt, DateOfBirth: krudapi.Date(time.Now())}
 		err := a.Validate()
 		if err != nil {
 			t.Errorf("expected valid author '%+v' but got err: '%v'", a, err)
@@ -41,7 +41,7 @@ func TestAuthorInvalid(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		a := krud.Author{Name: tt.Name, DateOfBirth: krud.Date(time.Now())}
+		a := krudapi.Author{Name: tt.Name, DateOfBirth: krudapi.Date(time.Now())}
 		err := a.Validate()
 
 		if err == nil || !strings.Contains(err.Error(), tt.Expect) {
@@ -0,0 +1,82 @@
+package krudapi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Problem is a RFC 7807 problem details body.
+// Code is a stable identifier for the kind of problem that clients can switch on,
+// Detail is for humans and may change.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	Field     string `json:"field,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Stable problem codes.
+const (
+	CodeValidation    = "validation_failed"
+	CodeNotFound      = "not_found"
+	CodeConflict      = "conflict"
+	CodeUnauthorized  = "unauthorized"
+	CodeForbidden     = "forbidden"
+	CodeNotAcceptable = "not_acceptable"
+	CodeIdempotency   = "idempotency_key_reused"
+	CodeRateLimited   = "rate_limited"
+	CodeInternal      = "internal_error"
+)
+
+// problemTypes lists, in order of precedence, how domain errors map onto HTTP.
+var problemTypes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrInvalid, http.StatusBadRequest, CodeValidation},
+	{ErrDoesNotExist, http.StatusNotFound, CodeNotFound},
+	{ErrConflict, http.StatusConflict, CodeConflict},
+	{ErrUnauthorized, http.StatusUnauthorized, CodeUnauthorized},
+	{ErrForbidden, http.StatusForbidden, CodeForbidden},
+	{ErrNotAcceptable, http.StatusNotAcceptable, CodeNotAcceptable},
+	{ErrIdempotencyMismatch, http.StatusUnprocessableEntity, CodeIdempotency},
+	{ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited},
+}
+
+// ProblemOf classifies err into a Problem, without a Detail or Field, which are up to the server.
+// Errors which are not domain errors are internal.
+func ProblemOf(err error) Problem {
+	for _, pt := range problemTypes {
+		if errors.Is(err, pt.err) {
+			return Problem{
+				Type:   "urn:krud:problem:" + pt.code,
+				Title:  http.StatusText(pt.status),
+				Status: pt.status,
+				Code:   pt.code,
+			}
+		}
+	}
+	return Problem{
+		Type:   "urn:krud:problem:" + CodeInternal,
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+		Detail: "internal error",
+		Code:   CodeInternal,
+	}
+}
+
+// Err is the domain error p was classified from, nil for internal and unknown problems.
+// It lets clients of the API check errors like the server does, with errors.Is.
+func (p Problem) Err() error {
+	for _, pt := range problemTypes {
+		if pt.code == p.Code {
+			return pt.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package krudapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of a webhook message.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// WebhookTypes are the object types webhooks can be notified about.
+var WebhookTypes = map[string]bool{"authors": true, "books": true}
+
+// Webhook is where, and about what, a user wants to be notified.
+type Webhook struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+	// Secret signs deliveries, it is only shown when set.
+	Secret string `json:"secret,omitempty"`
+	// Types are the object types to notify about, authors and books. Empty is all of them.
+	Types   []string  `json:"types"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookCSVHeader names the columns of Webhook.CSVRecord.
+var WebhookCSVHeader = []string{"id", "url", "types", "active", "created"}
+
+func (h Webhook) CSVRecord() []string {
+	return []string{strconv.FormatInt(h.ID, 10), h.URL, strings.Join(h.Types, " "),
+		strconv.FormatBool(h.Active), h.Created.Format(time.RFC3339Nano)}
+}
+
+func (h *Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalid("url", "expected an absolute http or https url but got: '%s'", h.URL)
+	}
+	for _, t := range h.Types {
+		if !WebhookTypes[t] {
+			return invalid("types", "unknown type: '%s'", t)
+		}
+	}
+	return nil
+}
+
+// WebhookMessage is a change, waiting to be or already delivered to a webhook.
+type WebhookMessage struct {
+	ID int64 `json:"id"`
+	// Event is the seq of the event the message is about.
+	Event       int64     `json:"event"`
+	Type        string    `json:"type"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	Created     time.Time `json:"created"`
+}
+
+// WebhookMessageCSVHeader names the columns of WebhookMessage.CSVRecord.
+var WebhookMessageCSVHeader = []string{"id", "event", "type", "state", "attempts", "next_attempt", "created"}
+
+func (m WebhookMessage) CSVRecord() []string {
+	return []string{strconv.FormatInt(m.ID, 10), strconv.FormatInt(m.Event, 10), m.Type, m.State,
+		strconv.Itoa(m.Attempts), m.NextAttempt.Format(time.RFC3339Nano), m.Created.Format(time.RFC3339Nano)}
+}
+
+// WebhookDelivery is an attempt at delivering a message.
+type WebhookDelivery struct {
+	ID        int64     `json:"id"`
+	MessageID int64     `json:"message_id"`
+	Attempt   int       `json:"attempt"`
+	When      time.Time `json:"ts"`
+	// Status of the response, if there was one.
+	Status *int `json:"status,omitempty"`
+	// Error is why the attempt failed, if it did.
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// WebhookDeliveryCSVHeader names the columns of WebhookDelivery.CSVRecord.
+var WebhookDeliveryCSVHeader = []string{"id", "message_id", "attempt", "ts", "status", "error", "duration_ms"}
+
+func (d WebhookDelivery) CSVRecord() []string {
+	status := ""
+	if d.Status != nil {
+		status = strconv.Itoa(*d.Status)
+	}
+	return []string{strconv.FormatInt(d.ID, 10), strconv.FormatInt(d.MessageID, 10), strconv.Itoa(d.Attempt),
+		d.When.Format(time.RFC3339Nano), status, d.Error, strconv.FormatInt(d.Duration, 10)}
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks.
+type WebhookPayload struct {
+	// Type is like authors.create, the object type and what was done.
+	Type string `json:"type"`
+	// Event is the seq of the audit event of the change.
+	Event    int64     `json:"event"`
+	When     time.Time `json:"ts"`
+	User     string    `json:"user"`
+	Object   string    `json:"object"`
+	ObjectID *int64    `json:"object_id,omitempty"`
+}
+
+// Headers of webhook deliveries.
+const (
+	// WebhookSignatureHeader is like "t=1655000000,v1=<hex>", see SignWebhook.
+	WebhookSignatureHeader = "X-Krud-Signature"
+	WebhookEventHeader     = "X-Krud-Event"
+	// WebhookDeliveryHeader is the id of the message, the same on every attempt,
+	// so that receivers can tell duplicates apart.
+	WebhookDeliveryHeader = "X-Krud-Delivery"
+)
+
+// SignWebhook is the HMAC-SHA256, in hex, of "<ts>.<body>" with secret.
+// ts is in unix seconds and part of the signature so that old deliveries cannot be replayed.
+func SignWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks the WebhookSignatureHeader of a delivery, made no longer than tolerance before now.
+func VerifyWebhook(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts int64
+	var sig string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			sig = kv[1]
+		}
+	}
+	if ts == 0 || sig == "" {
+		return errors.New("malformed signature")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return errors.New("signature too old")
+	}
+	if !hmac.Equal([]byte(sig), []byte(SignWebhook(secret, ts, body))) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
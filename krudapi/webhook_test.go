@@ -0,0 +1,41 @@
+package krudapi_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	now := time.Unix(1655000000, 0)
+	body := []byte(`{"type":"authors.create","event":1}`)
+	signed := func(ts int64) string {
+		return fmt.Sprintf("t=%d,v1=%s", ts, krudapi.SignWebhook("s3cret", ts, body))
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		body      []byte
+		ok        bool
+	}{
+		{"signed", "s3cret", signed(now.Unix()), body, true},
+		{"a little late", "s3cret", signed(now.Unix() - 60), body, true},
+		{"other secret", "other", signed(now.Unix()), body, false},
+		{"tampered body", "s3cret", signed(now.Unix()), []byte(`{"type":"authors.delete","event":1}`), false},
+		{"too old", "s3cret", signed(now.Unix() - 3600), body, false},
+		{"malformed", "s3cret", "v1=abc", body, false},
+	}
+	for _, tt := range tests {
+		err := krudapi.VerifyWebhook(tt.secret, tt.signature, tt.body, now, 5*time.Minute)
+		if tt.ok && err != nil {
+			t.Errorf("%s: expected a valid signature but got: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expected an invalid signature", tt.name)
+		}
+	}
+}
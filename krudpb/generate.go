@@ -0,0 +1,4 @@
+// Package krudpb is the protobuf and gRPC code of krud.proto.
+package krudpb
+
+//go:generate protoc --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. krud.proto
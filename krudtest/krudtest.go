@@ -0,0 +1,244 @@
+// Package krudtest runs the krud Controller over an in-memory database, for tests of its clients.
+package krudtest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+// MemDB keeps authors, books and idempotent responses in memory, for the Controller to run against.
+// Other methods of the Databaser are not implemented, and panic. It is safe for concurrent use.
+type MemDB struct {
+	krud.Databaser
+
+	mu sync.Mutex
+	// latest is the id of the latest author or book, they share ids.
+	latest     int64
+	authors    map[int64]krud.Author
+	books      map[int64]krud.AuthorBook
+	idempotent map[string]krud.IdempotentResponse
+}
+
+func NewMemDB() *MemDB {
+	return &MemDB{
+		authors:    map[int64]krud.Author{},
+		books:      map[int64]krud.AuthorBook{},
+		idempotent: map[string]krud.IdempotentResponse{},
+	}
+}
+
+// storeIdempotent keeps created as the response to the idempotency key of ctx, if any.
+func (db *MemDB) storeIdempotent(ctx context.Context, created interface{}) {
+	key, ok := krud.IdempotencyKeyFrom(ctx)
+	if !ok {
+		return
+	}
+	data, _ := json.Marshal(created)
+	db.idempotent[key.Key] = krud.IdempotentResponse{RequestHash: key.RequestHash, Response: data}
+}
+
+func (db *MemDB) AddAuthor(ctx context.Context, author krud.Author) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.latest++
+	author.ID = db.latest
+	db.authors[author.ID] = author
+	db.storeIdempotent(ctx, author)
+	return author.ID, nil
+}
+
+func (db *MemDB) GetAuthor(ctx context.Context, id int64) (*krud.Author, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a, ok := db.authors[id]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	return &a, nil
+}
+
+func (db *MemDB) UpdateAuthor(ctx context.Context, author krud.Author) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.authors[author.ID] = author
+	return nil
+}
+
+func (db *MemDB) PatchAuthor(ctx context.Context, id int64, changes krud.AuthorChanges) (*krud.Author, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a, ok := db.authors[id]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	if changes.Name != nil {
+		a.Name = *changes.Name
+	}
+	if changes.DateOfBirth != nil {
+		a.DateOfBirth = *changes.DateOfBirth
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	db.authors[id] = a
+	return &a, nil
+}
+
+func (db *MemDB) DeleteAuthor(ctx context.Context, id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.authors[id]; !ok {
+		return krud.ErrDoesNotExist
+	}
+	delete(db.authors, id)
+	return nil
+}
+
+// Authors are the authors in db, by id.
+func (db *MemDB) Authors() []krud.Author {
+	var authors []krud.Author
+	db.EachAuthor(context.Background(), func(a krud.Author) error {
+		authors = append(authors, a)
+		return nil
+	})
+	return authors
+}
+
+func (db *MemDB) EachAuthor(ctx context.Context, fn func(krud.Author) error) error {
+	db.mu.Lock()
+	var authors []krud.Author
+	for id := int64(1); id <= db.latest; id++ {
+		if a, ok := db.authors[id]; ok {
+			authors = append(authors, a)
+		}
+	}
+	db.mu.Unlock()
+	for _, a := range authors {
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemDB) AddAuthors(ctx context.Context, authors []krud.Author, mode krud.BulkMode) ([]krud.BulkResult, error) {
+	results := make([]krud.BulkResult, len(authors))
+	for i, a := range authors {
+		results[i].ID, _ = db.AddAuthor(ctx, a)
+	}
+	return results, nil
+}
+
+func (db *MemDB) AddBook(ctx context.Context, authorID int64, book krud.Book) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.authors[authorID]; !ok {
+		return 0, krud.ErrDoesNotExist
+	}
+	db.latest++
+	book.ID = db.latest
+	db.books[book.ID] = krud.AuthorBook{AuthorID: authorID, Book: book}
+	db.storeIdempotent(ctx, book)
+	return book.ID, nil
+}
+
+func (db *MemDB) GetBook(ctx context.Context, authorID, bookID int64) (*krud.Book, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, ok := db.books[bookID]
+	if !ok || b.AuthorID != authorID {
+		return nil, krud.ErrDoesNotExist
+	}
+	return &b.Book, nil
+}
+
+func (db *MemDB) PatchBook(ctx context.Context, authorID, bookID int64, changes krud.BookChanges) (*krud.Book, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, ok := db.books[bookID]
+	if !ok || b.AuthorID != authorID {
+		return nil, krud.ErrDoesNotExist
+	}
+	if changes.Title != nil {
+		b.Title = *changes.Title
+	}
+	if changes.Published != nil {
+		b.Published = *changes.Published
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	db.books[bookID] = b
+	return &b.Book, nil
+}
+
+func (db *MemDB) EachBook(ctx context.Context, authorID int64, fn func(krud.Book) error) error {
+	db.mu.Lock()
+	var books []krud.Book
+	for id := int64(1); id <= db.latest; id++ {
+		if b, ok := db.books[id]; ok && b.AuthorID == authorID {
+			books = append(books, b.Book)
+		}
+	}
+	db.mu.Unlock()
+	for _, b := range books {
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemDB) DeleteBook(ctx context.Context, authorID, bookID int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b, ok := db.books[bookID]
+	if !ok || b.AuthorID != authorID {
+		return krud.ErrDoesNotExist
+	}
+	delete(db.books, bookID)
+	return nil
+}
+
+func (db *MemDB) IdempotentResponse(ctx context.Context, key string, ttl time.Duration) (*krud.IdempotentResponse, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored, ok := db.idempotent[key]
+	if !ok {
+		return nil, krud.ErrDoesNotExist
+	}
+	return &stored, nil
+}
+
+// NewServer runs the Controller over db under /api, with wrap in front of it unless nil.
+// Requests without a user are unauthorized, any other user gets db. It is closed with t.
+func NewServer(t testing.TB, db krud.Databaser, wrap func(http.Handler) http.Handler, opts ...krud.ControllerOption) *httptest.Server {
+	t.Helper()
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+		if user == "" {
+			return nil, krud.ErrUnauthorized
+		}
+		return db, nil
+	}
+	krud.NewController(log, r.PathPrefix("/api").Subrouter(), krud.DialFunc(dial), opts...)
+
+	var h http.Handler = r
+	if wrap != nil {
+		h = wrap(r)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
@@ -0,0 +1,123 @@
+package krud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxRequestIDLen caps the X-Request-ID a client may supply.
+const maxRequestIDLen = 128
+
+type contextLogger struct{}
+
+// requestLogger is kept by pointer in the context so that fields learnt
+// further down a request, like the user, also end up in the access log.
+type requestLogger struct {
+	entry *log.Entry
+}
+
+type contextRequestID struct{}
+
+// WithLogger returns a copy of ctx carrying entry, see LoggerFrom.
+func WithLogger(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, contextLogger{}, &requestLogger{entry: entry})
+}
+
+// LoggerFrom is the logger carried by ctx, with fields for the request being served.
+// Falls back on the standard logger outside of a request.
+func LoggerFrom(ctx context.Context) *log.Entry {
+	if rl, ok := ctx.Value(contextLogger{}).(*requestLogger); ok {
+		return rl.entry
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// addLogFields adds fields to the logger carried by ctx, for the rest of the request.
+func addLogFields(ctx context.Context, fields log.Fields) {
+	if rl, ok := ctx.Value(contextLogger{}).(*requestLogger); ok {
+		rl.entry = rl.entry.WithFields(fields)
+	}
+}
+
+// RequestIDFrom is the id of the request being served with ctx, or empty outside of a request.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(contextRequestID{}).(string)
+	return id
+}
+
+// validRequestID accepts ids that are safe to echo back and put in logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID makes up a random id.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// LoggingMiddleware gives each request an id, keeping a well formed X-Request-ID from the client,
+// and returns it in the X-Request-ID response header.
+// Handlers find the id, and a logger with fields for the request, in the request context.
+func (api *Controller) LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		fields := log.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"route":      route,
+		}
+		// Tie logs to the trace, when there is one.
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		entry := api.log.WithFields(fields)
+
+		ctx := context.WithValue(r.Context(), contextRequestID{}, id)
+		ctx = WithLogger(ctx, entry)
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		LoggerFrom(ctx).WithFields(log.Fields{
+			"status":   sr.status,
+			"duration": time.Since(start).String(),
+		}).Infof("%s %s", r.Method, r.URL.Path)
+	})
+}
@@ -0,0 +1,78 @@
+package krud_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+func TestLoggingFieldsPerRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors/7", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	req.Header.Set("user", TEST_USER)
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.DebugLevel)
+	krud.NewController(log, r, EmptyMock())
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	checkStatusCode(t, resp, http.StatusNotFound)
+	if id := resp.Header.Get("X-Request-ID"); id != "abc-123" {
+		t.Errorf("expected request id in response header but got: '%s'", id)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) == 0 {
+		t.Fatal("expected the request to be logged")
+	}
+	access := hook.LastEntry()
+	expected := map[string]interface{}{
+		"request_id": "abc-123",
+		"user":       TEST_USER,
+		"route":      "/authors/{authorID:[0-9]+}",
+		"method":     http.MethodGet,
+		"status":     http.StatusNotFound,
+	}
+	for k, v := range expected {
+		if access.Data[k] != v {
+			t.Errorf("expected field %s '%v' but got: '%v'", k, v, access.Data[k])
+		}
+	}
+	for _, e := range entries {
+		if e.Data["request_id"] != "abc-123" {
+			t.Errorf("expected every line to have the request id but got: %v", e.Data)
+		}
+	}
+}
+
+func TestLoggingReplacesMalformedRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/authors/7", nil)
+	req.Header.Set("X-Request-ID", "evil\nid")
+	w := httptest.NewRecorder()
+
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+	r.ServeHTTP(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+	id := resp.Header.Get("X-Request-ID")
+	if id == "" || id == "evil\nid" {
+		t.Errorf("expected a new request id but got: '%s'", id)
+	}
+	p := ParseProblem(t, resp)
+	if p.RequestID != id {
+		t.Errorf("expected problem to carry request id '%s' but got: '%s'", id, p.RequestID)
+	}
+}
@@ -0,0 +1,157 @@
+package krud
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Metrics are registered with the default prometheus registry,
+// serve them with promhttp.Handler().
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "krud",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	httpRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "http_rate_limited_total",
+		Help:      "HTTP requests turned away for being over the quota of their user, by route template.",
+	}, []string{"route"})
+
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "krud",
+		Name:      "db_operation_duration_seconds",
+		Help:      "Latency of AuditDB operations by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "db_operation_errors_total",
+		Help:      "Failed AuditDB operations by method and problem code.",
+	}, []string{"method", "code"})
+
+	txRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "db_transaction_retries_total",
+		Help:      "Transactions run again after a transient failure, by operation and SQLSTATE.",
+	}, []string{"operation", "code"})
+
+	auditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "audit_events_total",
+		Help:      "Audit events inserted by operation and object type.",
+	}, []string{"operation", "type"})
+
+	auditDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "audit_events_dropped_total",
+		Help:      "Audit events the AuditWriter gave up on writing.",
+	})
+
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "krud",
+		Name:      "webhook_deliveries_total",
+		Help:      "Attempts at delivering webhook messages, by outcome: delivered, failed or dead.",
+	}, []string{"result"})
+)
+
+// observe records the latency and outcome of an AuditDB method, and logs any failure.
+// Meant to be deferred at the very top, with a pointer to the named error return.
+func observe(ctx context.Context, method string, start time.Time, err *error) {
+	dbDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err == nil {
+		return
+	}
+	code := NewProblem(*err).Code
+	dbErrors.WithLabelValues(method, code).Inc()
+
+	entry := LoggerFrom(ctx).WithFields(log.Fields{"db_method": method, "code": code})
+	if code == CodeInternal {
+		entry.Errorf("audit db: %v", *err)
+	} else {
+		// Not found and friends are part of normal operation.
+		entry.Debugf("audit db: %v", *err)
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses streaming.
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSockets take over the connection.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T cannot be hijacked", sr.ResponseWriter)
+	}
+	if sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// MetricsMiddleware counts and times requests by their mux route template,
+// so that /authors/1 and /authors/2 end up in the same series.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sr.status)).Inc()
+	})
+}
@@ -0,0 +1,62 @@
+package krud_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+// counterValue finds the value of a counter with exactly labels in the default registry.
+func counterValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("gather metrics: %v", err)
+	}
+	for _, fam := range families {
+		if fam.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range fam.GetMetric() {
+			if len(m.GetLabel()) != len(labels) {
+				continue
+			}
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestMetricsByRouteTemplate(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(krud.MetricsMiddleware)
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+
+	labels := map[string]string{"route": "/authors/{authorID:[0-9]+}", "method": "GET", "status": "404"}
+	before := counterValue(t, "krud_http_requests_total", labels)
+
+	for _, path := range []string{"/authors/1", "/authors/2"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		checkStatusCode(t, w.Result(), http.StatusNotFound)
+	}
+
+	after := counterValue(t, "krud_http_requests_total", labels)
+	if after-before != 2 {
+		t.Errorf("expected 2 requests counted on the route template but got: %v", after-before)
+	}
+}
@@ -0,0 +1,346 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are numbered SQL files, NNN_name.up.sql and NNN_name.down.sql.
+// Each one runs in a transaction together with recording it in schema_migrations,
+// so a failed migration leaves nothing behind.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrateLock is the advisory lock key held while migrating,
+// so that init jobs started together take turns.
+const migrateLock = archiveLock + 1
+
+// Migration takes the schema from the version before it to Version, and back.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells if a migration has been applied.
+type MigrationStatus struct {
+	Version int        `json:"version"`
+	Name    string     `json:"name"`
+	Applied *time.Time `json:"applied"`
+}
+
+// Migrations are the embedded migrations, in order from version 1 to SchemaVersion.
+func Migrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		base := path.Base(file)
+		var up bool
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			up = true
+			base = strings.TrimSuffix(base, ".up.sql")
+		case strings.HasSuffix(base, ".down.sql"):
+			base = strings.TrimSuffix(base, ".down.sql")
+		default:
+			return nil, fmt.Errorf("migration %s: neither up nor down", file)
+		}
+		i := strings.Index(base, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migration %s: no version", file)
+		}
+		version, err := strconv.Atoi(base[:i])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: bad version", file)
+		}
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		}
+		if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migration %s: version %d is also %s", file, version, m.Name)
+		}
+		if up {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %03d_%s needs both up and down", m.Version, m.Name)
+		}
+	}
+	if len(migrations) != SchemaVersion {
+		return nil, fmt.Errorf("migrations go to version %d, but the schema version is %d", len(migrations), SchemaVersion)
+	}
+	return migrations, nil
+}
+
+// MigrationsStatus is every migration, with when it was applied if it was.
+func MigrationsStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = MigrationStatus{Version: m.Version, Name: m.Name}
+		if ts, ok := applied[m.Version]; ok {
+			ts := ts
+			status[i].Applied = &ts
+		}
+	}
+	return status, nil
+}
+
+// MigrateUp applies the migrations not yet applied, up to and including version target,
+// or all of them if target is 0. Returns the ones applied, in order.
+func MigrateUp(ctx context.Context, db *sql.DB, target int) (done []Migration, err error) {
+	defer observe(ctx, "MigrateUp", time.Now(), &err)
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = len(migrations)
+	}
+	if target < 0 || target > len(migrations) {
+		return nil, invalid("target", fmt.Sprintf("no version %d to migrate up to", target))
+	}
+
+	err = withMigrateLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations[:target] {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := migrate(ctx, conn, m.Up, "INSERT INTO schema_migrations (version) VALUES ($1)", m.Version)
+			if err != nil {
+				return fmt.Errorf("migrate up %03d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the applied migrations after version target, so 0 reverts all of them.
+// Returns the ones reverted, newest first. Reverting loses what the migrations added.
+func MigrateDown(ctx context.Context, db *sql.DB, target int) (done []Migration, err error) {
+	defer observe(ctx, "MigrateDown", time.Now(), &err)
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 || target > len(migrations) {
+		return nil, invalid("target", fmt.Sprintf("no version %d to migrate down to", target))
+	}
+
+	err = withMigrateLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= target; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			err := migrate(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("migrate down %03d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// withMigrateLock runs fn on a connection holding the migrate lock.
+func withMigrateLock(ctx context.Context, db *sql.DB, fn func(*sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("get connection: %w", err)
+	}
+	defer conn.Close()
+
+	// Session level, since every migration is a transaction of its own.
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrateLock); err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrateLock)
+
+	return fn(conn)
+}
+
+// MigrateBaseline records the migrations up to and including version target as applied, without
+// running them, for a database which already has their schema but not in schema_migrations.
+// Returns the ones recorded.
+func MigrateBaseline(ctx context.Context, db *sql.DB, target int) (done []Migration, err error) {
+	defer observe(ctx, "MigrateBaseline", time.Now(), &err)
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if target < 1 || target > len(migrations) {
+		return nil, invalid("baseline", fmt.Sprintf("no version %d to baseline at", target))
+	}
+
+	err = withMigrateLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations[:target] {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			_, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", m.Version)
+			if err != nil {
+				return fmt.Errorf("baseline %03d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// appliedMigrations are the versions in schema_migrations with when they were applied,
+// making the table if this is a new database. A database made before there were migrations,
+// by the initdb/init.sql of then, has the tables of the first one, which is then adopted
+// as applied rather than failing to make them again.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	if err := adoptSchema(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("query schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var ts time.Time
+		if err := rows.Scan(&version, &ts); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		applied[version] = ts
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+	return applied, nil
+}
+
+// adoptSchema makes schema_migrations, recording the first migration as applied if its users table is already there.
+func adoptSchema(ctx context.Context, conn *sql.Conn) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var untracked, existing bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT to_regclass('schema_migrations') IS NULL, to_regclass('users') IS NOT NULL").Scan(&untracked, &existing)
+	if err != nil {
+		return fmt.Errorf("look for tables: %w", err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+             version INT PRIMARY KEY NOT NULL,
+             applied TIMESTAMP NOT NULL DEFAULT NOW()
+         )`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+	if untracked && existing {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (1) ON CONFLICT DO NOTHING")
+		if err != nil {
+			return fmt.Errorf("adopt schema: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// migrate runs the SQL of a migration and record, to note it in schema_migrations, in one transaction.
+func migrate(ctx context.Context, conn *sql.Conn, script, record string, version int) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, version); err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package krud_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vikblom/krud"
+)
+
+func TestMigrationsEmbedded(t *testing.T) {
+	migrations, err := krud.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != krud.SchemaVersion {
+		t.Fatalf("expected %d migrations but got %d", krud.SchemaVersion, len(migrations))
+	}
+	for _, m := range migrations {
+		// The migrator owns transactions and schema_migrations.
+		for _, s := range []string{"BEGIN;", "COMMIT;", "schema_migrations"} {
+			if strings.Contains(m.Up, s) || strings.Contains(m.Down, s) {
+				t.Errorf("migration %d_%s should not have %s", m.Version, m.Name, s)
+			}
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	// Starts from the schema of initdb, so the way down is tested against it.
+	db, cleanup := CleanDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	down, err := krud.MigrateDown(ctx, db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(down) != krud.SchemaVersion || down[0].Version != krud.SchemaVersion {
+		t.Fatalf("expected every migration reverted, newest first, but got: %v", down)
+	}
+	status, err := krud.MigrationsStatus(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.Applied != nil {
+			t.Errorf("expected %d to be reverted", s.Version)
+		}
+	}
+	if err := krud.CheckSchema(ctx, db); err == nil {
+		t.Errorf("expected an empty database to be too old")
+	}
+
+	up, err := krud.MigrateUp(ctx, db, 2)
+	if err != nil || len(up) != 2 {
+		t.Fatalf("expected 2 migrations applied but got: %v, %v", up, err)
+	}
+	up, err = krud.MigrateUp(ctx, db, 0)
+	if err != nil || len(up) != krud.SchemaVersion-2 {
+		t.Fatalf("expected the rest applied but got: %v, %v", up, err)
+	}
+	if err := krud.CheckSchema(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if up, err := krud.MigrateUp(ctx, db, 0); err != nil || len(up) != 0 {
+		t.Errorf("expected nothing left to apply but got: %v, %v", up, err)
+	}
+
+	// The migrated schema works like the one of initdb.
+	if err := krud.AddUser(ctx, db, "admin", krud.DefaultTenant, TEST_USER); err != nil {
+		t.Fatal(err)
+	}
+	adb, err := krud.NewAuditDB(ctx, db, TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adb.AddAuthor(ctx, krud.Author{Name: "Ada", DateOfBirth: MakeDate(t, "1815-12-10")}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := krud.VerifyChain(ctx, db)
+	if err != nil || !v.OK {
+		t.Errorf("expected a whole chain but got: %+v, %v", v, err)
+	}
+
+	// Down and up again with data in it.
+	if _, err := krud.MigrateDown(ctx, db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := krud.MigrateUp(ctx, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := krud.MigrateUp(ctx, db, krud.SchemaVersion+1); err == nil {
+		t.Errorf("expected an unknown version to fail")
+	}
+}
+
+func TestMigrateAdoptsSchema(t *testing.T) {
+	db, cleanup := CleanDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Like a database made before there were migrations, with the tables of the first one.
+	if _, err := krud.MigrateDown(ctx, db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	up, err := krud.MigrateUp(ctx, db, 0)
+	if err != nil || len(up) != krud.SchemaVersion-1 || up[0].Version != 2 {
+		t.Fatalf("expected the first migration adopted and the rest applied but got: %v, %v", up, err)
+	}
+
+	// A schema made by hand, at a later version.
+	if _, err := krud.MigrateDown(ctx, db, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := krud.MigrateUp(ctx, db, 0); err == nil {
+		t.Fatal("expected migrating a schema made by hand to fail without a baseline")
+	}
+	done, err := krud.MigrateBaseline(ctx, db, 3)
+	if err != nil || len(done) != 3 {
+		t.Fatalf("expected 3 migrations baselined but got: %v, %v", done, err)
+	}
+	if _, err := krud.MigrateUp(ctx, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := krud.CheckSchema(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,2 @@
+-- Drops everything, the data is gone.
+DROP TABLE idempotency_keys, events, books, authors, users;
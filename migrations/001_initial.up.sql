@@ -0,0 +1,40 @@
+-- The first schema, like initdb/init.sql was at version 1 but without users.
+-- Add them with krudctl users add or krud seed.
+CREATE TABLE users (
+       name TEXT PRIMARY KEY NOT NULL
+);
+
+CREATE TABLE authors (
+       id SERIAL PRIMARY KEY,
+       name TEXT NOT NULL,
+       date_of_birth date NOT NULL
+);
+
+CREATE TABLE books (
+       id SERIAL PRIMARY KEY,
+       author_id INT NOT NULL,
+       title TEXT NOT NULL,
+       published timestamp NOT NULL,
+       CONSTRAINT fk_author FOREIGN KEY (author_id) REFERENCES authors (id)
+);
+
+CREATE TABLE events (
+       ts TIMESTAMP NOT NULL,   -- when
+       username TEXT NOT NULL,  -- who
+       operation TEXT NOT NULL, -- CREATE, READ, UPDATE or DELETE
+       obj_type TEXT NOT NULL,
+       obj_id INT,              -- if applicable
+       data TEXT
+);
+
+-- Responses to POST requests carrying an Idempotency-Key,
+-- stored in the same transaction as the object they created.
+CREATE TABLE idempotency_keys (
+       username TEXT NOT NULL,
+       key TEXT NOT NULL,
+       request_hash TEXT NOT NULL, -- sha256 of method, path and body
+       response TEXT NOT NULL,     -- json of the created object
+       created TIMESTAMP NOT NULL,
+       PRIMARY KEY (username, key)
+);
+CREATE INDEX idempotency_keys_created ON idempotency_keys (created);
@@ -0,0 +1,8 @@
+-- Unchains events, the hashes are gone.
+DROP TABLE event_chain;
+
+ALTER TABLE events DROP CONSTRAINT events_pkey;
+ALTER TABLE events
+      DROP COLUMN seq,
+      DROP COLUMN prev_hash,
+      DROP COLUMN hash;
@@ -0,0 +1,20 @@
+-- Chains events with hashes, see krud.VerifyEvents.
+-- Databases created from initdb/init.sql already have this.
+-- Existing events are numbered by time but left unchained, there is nothing to vouch for them.
+ALTER TABLE events
+      ADD COLUMN seq BIGINT,
+      ADD COLUMN prev_hash BYTEA,
+      ADD COLUMN hash BYTEA;
+
+UPDATE events SET seq = numbered.seq
+FROM (SELECT ctid, row_number() OVER (ORDER BY ts) AS seq FROM events) AS numbered
+WHERE events.ctid = numbered.ctid;
+
+ALTER TABLE events ADD PRIMARY KEY (seq);
+
+CREATE TABLE event_chain (
+       id INT PRIMARY KEY CHECK (id = 1),
+       seq BIGINT NOT NULL,
+       hash BYTEA NOT NULL
+);
+INSERT INTO event_chain (id, seq, hash) SELECT 1, COALESCE(MAX(seq), 0), '' FROM events;
@@ -0,0 +1,27 @@
+-- Copies events back into one table. Events already archived stay archived,
+-- the chain can no longer be verified across them.
+ALTER TABLE events RENAME TO events_partitioned;
+ALTER INDEX events_pkey RENAME TO events_partitioned_pkey;
+ALTER INDEX events_ts RENAME TO events_partitioned_ts;
+
+CREATE TABLE events (
+       seq BIGINT PRIMARY KEY,
+       ts TIMESTAMP NOT NULL,
+       username TEXT NOT NULL,
+       operation TEXT NOT NULL,
+       obj_type TEXT NOT NULL,
+       obj_id INT,
+       data TEXT,
+       prev_hash BYTEA,
+       hash BYTEA
+);
+
+INSERT INTO events (seq, ts, username, operation, obj_type, obj_id, data, prev_hash, hash)
+SELECT seq, ts, username, operation, obj_type, obj_id, data, prev_hash, hash FROM events_partitioned;
+-- Takes the partitions with it.
+DROP TABLE events_partitioned;
+
+ALTER TABLE event_chain
+      DROP COLUMN ts,
+      DROP COLUMN archived_seq,
+      DROP COLUMN archived_hash;
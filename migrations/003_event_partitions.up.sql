@@ -0,0 +1,43 @@
+-- Partitions events by month of ts and makes room for archiving them, see krud.ArchiveEvents.
+-- Databases created from initdb/init.sql already have this.
+-- Events are copied over, which locks the table for as long as that takes.
+ALTER TABLE events RENAME TO events_unpartitioned;
+ALTER INDEX events_pkey RENAME TO events_unpartitioned_pkey;
+
+CREATE TABLE events (
+       seq BIGINT NOT NULL,
+       ts TIMESTAMP NOT NULL,
+       username TEXT NOT NULL,
+       operation TEXT NOT NULL,
+       obj_type TEXT NOT NULL,
+       obj_id INT,
+       data TEXT,
+       prev_hash BYTEA,
+       hash BYTEA,
+       PRIMARY KEY (seq, ts)
+) PARTITION BY RANGE (ts);
+CREATE TABLE events_default PARTITION OF events DEFAULT;
+CREATE INDEX events_ts ON events (ts);
+
+-- A partition for every month with events, and this one.
+DO $$
+DECLARE
+       m TIMESTAMP;
+BEGIN
+       FOR m IN SELECT date_trunc('month', ts) FROM events_unpartitioned
+                UNION SELECT date_trunc('month', NOW() AT TIME ZONE 'UTC')
+       LOOP
+               EXECUTE format('CREATE TABLE %I PARTITION OF events FOR VALUES FROM (%L) TO (%L)',
+                              'events_' || to_char(m, 'YYYY_MM'), m, m + INTERVAL '1 month');
+       END LOOP;
+END $$;
+
+INSERT INTO events (seq, ts, username, operation, obj_type, obj_id, data, prev_hash, hash)
+SELECT seq, ts, username, operation, obj_type, obj_id, data, prev_hash, hash FROM events_unpartitioned;
+DROP TABLE events_unpartitioned;
+
+ALTER TABLE event_chain
+      ADD COLUMN ts TIMESTAMP,
+      ADD COLUMN archived_seq BIGINT NOT NULL DEFAULT 0,
+      ADD COLUMN archived_hash BYTEA NOT NULL DEFAULT '';
+UPDATE event_chain SET ts = (SELECT MAX(ts) FROM events);
@@ -0,0 +1,2 @@
+-- Drops webhooks with their messages and deliveries.
+DROP TABLE webhook_deliveries, webhook_messages, webhooks;
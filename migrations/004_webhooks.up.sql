@@ -0,0 +1,39 @@
+-- Webhooks with an outbox of messages and a log of deliveries, see krud.Webhook.
+-- Databases created from initdb/init.sql already have this.
+CREATE TABLE webhooks (
+       id SERIAL PRIMARY KEY,
+       username TEXT NOT NULL,             -- owner, only they see it
+       url TEXT NOT NULL,
+       secret TEXT NOT NULL,               -- signs deliveries with HMAC-SHA256
+       types TEXT[] NOT NULL DEFAULT '{}', -- object types to notify about, all if empty
+       active BOOLEAN NOT NULL DEFAULT TRUE,
+       created TIMESTAMP NOT NULL
+);
+
+-- Outbox of messages to webhooks, written in the same transaction as the change.
+CREATE TABLE webhook_messages (
+       id BIGSERIAL PRIMARY KEY,
+       webhook_id INT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+       event_seq BIGINT NOT NULL,  -- the event the message is about
+       type TEXT NOT NULL,         -- like authors.update
+       payload TEXT NOT NULL,      -- json body to POST
+       state TEXT NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'delivered', 'dead')),
+       attempts INT NOT NULL DEFAULT 0,
+       next_attempt TIMESTAMP NOT NULL,
+       created TIMESTAMP NOT NULL
+);
+CREATE INDEX webhook_messages_due ON webhook_messages (next_attempt) WHERE state = 'pending';
+CREATE INDEX webhook_messages_webhook ON webhook_messages (webhook_id, id);
+
+-- Every attempt at delivering a message.
+CREATE TABLE webhook_deliveries (
+       id BIGSERIAL PRIMARY KEY,
+       message_id BIGINT NOT NULL REFERENCES webhook_messages (id) ON DELETE CASCADE,
+       webhook_id INT NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+       attempt INT NOT NULL,
+       ts TIMESTAMP NOT NULL,
+       status INT,          -- of the response, if there was one
+       error TEXT,          -- why it failed, if it did
+       duration_ms INT NOT NULL
+);
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
@@ -0,0 +1,3 @@
+-- For the events of objects, see krud.EventsOn and krud.EventsLastOn.
+-- Databases created from initdb/init.sql already have this.
+CREATE INDEX events_object ON events (obj_type, obj_id, seq);
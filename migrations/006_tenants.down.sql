@@ -0,0 +1,40 @@
+-- Puts every tenant back together, the krud_tenant role is left for other databases.
+REVOKE ALL
+       ON authors, books, events, idempotency_keys, webhooks, webhook_messages, webhook_deliveries
+       FROM krud_tenant;
+REVOKE ALL ON SEQUENCE authors_id_seq, books_id_seq, webhooks_id_seq, webhook_messages_id_seq, webhook_deliveries_id_seq
+       FROM krud_tenant;
+
+ALTER TABLE authors DISABLE ROW LEVEL SECURITY;
+ALTER TABLE books DISABLE ROW LEVEL SECURITY;
+ALTER TABLE events DISABLE ROW LEVEL SECURITY;
+ALTER TABLE idempotency_keys DISABLE ROW LEVEL SECURITY;
+ALTER TABLE webhooks DISABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_messages DISABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_deliveries DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY tenant_isolation ON authors;
+DROP POLICY tenant_isolation ON books;
+DROP POLICY tenant_isolation ON events;
+DROP POLICY tenant_isolation ON idempotency_keys;
+DROP POLICY tenant_isolation ON webhooks;
+DROP POLICY tenant_isolation ON webhook_messages;
+DROP POLICY tenant_isolation ON webhook_deliveries;
+
+ALTER TABLE books DROP CONSTRAINT fk_author;
+ALTER TABLE books ADD CONSTRAINT fk_author FOREIGN KEY (author_id) REFERENCES authors (id);
+ALTER TABLE authors DROP CONSTRAINT authors_id_tenant;
+
+ALTER TABLE users DROP COLUMN tenant_id;
+ALTER TABLE authors DROP COLUMN tenant_id;
+ALTER TABLE books DROP COLUMN tenant_id;
+ALTER TABLE events DROP COLUMN tenant_id;
+ALTER TABLE idempotency_keys DROP COLUMN tenant_id;
+ALTER TABLE webhooks DROP COLUMN tenant_id;
+ALTER TABLE webhook_messages DROP COLUMN tenant_id;
+ALTER TABLE webhook_deliveries DROP COLUMN tenant_id;
+
+DROP FUNCTION lock_event_chain();
+DROP FUNCTION advance_event_chain(BIGINT);
+-- Events linked since hash their tenant, servers from before find the chain broken at the first of them.
+ALTER TABLE event_chain DROP COLUMN tenant_hashed_from;
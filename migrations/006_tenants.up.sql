@@ -0,0 +1,111 @@
+-- Tenants share the database, see krud.DefaultTenant. What is there goes to the default tenant.
+-- Transactions of krud.AuditDB run as krud_tenant with krud.tenant set to the tenant of the user,
+-- row level security keeps them to the rows of that tenant. Whoever runs the server must be able
+-- to SET ROLE krud_tenant, and should own the tables, the owner is not held to a tenant.
+DO $$
+BEGIN
+       IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'krud_tenant') THEN
+               CREATE ROLE krud_tenant NOLOGIN;
+       END IF;
+END $$;
+GRANT krud_tenant TO CURRENT_USER;
+
+-- Who a user is decides their tenant, so users are not held to one.
+ALTER TABLE users ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default' CHECK (tenant_id <> '');
+ALTER TABLE users ALTER COLUMN tenant_id DROP DEFAULT;
+
+-- Rows made by a tenant are of that tenant.
+ALTER TABLE authors ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE authors ALTER COLUMN tenant_id SET DEFAULT current_setting('krud.tenant');
+ALTER TABLE authors ADD CONSTRAINT authors_id_tenant UNIQUE (id, tenant_id);
+
+-- Foreign keys are checked without row level security, the tenant has to be part of it.
+ALTER TABLE books ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE books ALTER COLUMN tenant_id SET DEFAULT current_setting('krud.tenant');
+ALTER TABLE books DROP CONSTRAINT fk_author;
+ALTER TABLE books ADD CONSTRAINT fk_author FOREIGN KEY (author_id, tenant_id) REFERENCES authors (id, tenant_id);
+
+-- Events of unknown users are of no tenant.
+ALTER TABLE events ADD COLUMN tenant_id TEXT DEFAULT 'default';
+ALTER TABLE events ALTER COLUMN tenant_id DROP DEFAULT;
+
+ALTER TABLE idempotency_keys ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE idempotency_keys ALTER COLUMN tenant_id SET DEFAULT current_setting('krud.tenant');
+
+ALTER TABLE webhooks ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE webhooks ALTER COLUMN tenant_id SET DEFAULT current_setting('krud.tenant');
+ALTER TABLE webhook_messages ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE webhook_messages ALTER COLUMN tenant_id DROP DEFAULT;
+ALTER TABLE webhook_deliveries ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE webhook_deliveries ALTER COLUMN tenant_id DROP DEFAULT;
+
+-- Events from tenant_hashed_from on hash their tenant, marking events without one, see krud.chainHash.
+-- Events already on the chain keep their hashes. No server from before this migration may append
+-- events after it, their hashes would break the chain.
+ALTER TABLE event_chain ADD COLUMN tenant_hashed_from BIGINT NOT NULL DEFAULT 1;
+UPDATE event_chain SET tenant_hashed_from = seq + 1;
+
+-- Tenants do not touch event_chain, which has no tenant, but lock and advance it through these,
+-- which run as the owner. See krud.linkEvents.
+CREATE FUNCTION lock_event_chain(OUT seq BIGINT, OUT hash BYTEA, OUT ts TIMESTAMP, OUT tenant_hashed_from BIGINT)
+       LANGUAGE sql SECURITY DEFINER
+       AS $$ SELECT seq, hash, ts, tenant_hashed_from FROM event_chain WHERE id = 1 FOR UPDATE $$;
+-- Only ever onto an event that has been inserted, so the tail cannot be made up.
+CREATE FUNCTION advance_event_chain(to_seq BIGINT) RETURNS void
+       LANGUAGE plpgsql SECURITY DEFINER
+       AS $$
+BEGIN
+       UPDATE event_chain c SET seq = e.seq, hash = e.hash, ts = e.ts
+              FROM events e
+              WHERE c.id = 1 AND e.seq = to_seq AND e.seq > c.seq;
+       IF NOT FOUND THEN
+              RAISE EXCEPTION 'no event % after the tail of the chain', to_seq;
+       END IF;
+END $$;
+-- Functions run as their owner should not find tables made by whoever calls them.
+DO $$
+BEGIN
+       EXECUTE format('ALTER FUNCTION lock_event_chain() SET search_path = %I, pg_temp', current_schema());
+       EXECUTE format('ALTER FUNCTION advance_event_chain(BIGINT) SET search_path = %I, pg_temp', current_schema());
+END $$;
+REVOKE EXECUTE ON FUNCTION lock_event_chain(), advance_event_chain(BIGINT) FROM PUBLIC;
+GRANT EXECUTE ON FUNCTION lock_event_chain(), advance_event_chain(BIGINT) TO krud_tenant;
+
+CREATE POLICY tenant_isolation ON authors TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON books TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON events TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON idempotency_keys TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhooks TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhook_messages TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+CREATE POLICY tenant_isolation ON webhook_deliveries TO krud_tenant
+       USING (tenant_id = current_setting('krud.tenant', true))
+       WITH CHECK (tenant_id = current_setting('krud.tenant', true));
+
+ALTER TABLE authors ENABLE ROW LEVEL SECURITY;
+ALTER TABLE books ENABLE ROW LEVEL SECURITY;
+ALTER TABLE events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE idempotency_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhooks ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_messages ENABLE ROW LEVEL SECURITY;
+ALTER TABLE webhook_deliveries ENABLE ROW LEVEL SECURITY;
+
+-- Not users, nor the partitions of events, which would skip the policy of events.
+-- Events are only ever appended.
+GRANT SELECT, INSERT, UPDATE, DELETE
+      ON authors, books, idempotency_keys, webhooks, webhook_messages, webhook_deliveries
+      TO krud_tenant;
+GRANT SELECT, INSERT ON events TO krud_tenant;
+GRANT USAGE ON SEQUENCE authors_id_seq, books_id_seq, webhooks_id_seq, webhook_messages_id_seq, webhook_deliveries_id_seq
+      TO krud_tenant;
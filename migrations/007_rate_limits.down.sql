@@ -0,0 +1,2 @@
+-- Drops rate limits, every bucket starts out full again.
+DROP TABLE rate_limits;
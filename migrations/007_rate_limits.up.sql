@@ -0,0 +1,9 @@
+-- Token buckets of krud.PostgresRateLimitStore, shared by every server.
+-- Databases created from initdb/init.sql already have this.
+CREATE TABLE rate_limits (
+       key TEXT PRIMARY KEY,               -- user and route template
+       tokens DOUBLE PRECISION NOT NULL,
+       updated TIMESTAMPTZ NOT NULL,
+       full_at TIMESTAMPTZ NOT NULL        -- when the bucket has refilled, to sweep it
+);
+CREATE INDEX rate_limits_full_at ON rate_limits (full_at);
@@ -0,0 +1,237 @@
+package krud
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// negotiate picks the media type to respond with based on the Accept header of r.
+// JSON is the default when the client does not care.
+func negotiate(r *http.Request) (string, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return MediaJSON, nil
+	}
+
+	type candidate struct {
+		media string
+		q     float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch media {
+		case MediaJSON, "application/*", "*/*":
+			media = MediaJSON
+		case MediaCSV, "text/*":
+			media = MediaCSV
+		case MediaNDJSON:
+		default:
+			continue
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{media, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w: cannot produce any of '%s'", ErrNotAcceptable, accept)
+	}
+	// Stable to let the order in the header break ties.
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].media, nil
+}
+
+// collectionWriter writes a collection of Records to a response one at a time.
+// Nothing is written until the first item, or Close, so that an error
+// before that can still be reported as a problem.
+type collectionWriter interface {
+	Write(item Record) error
+	Close() error
+	// Started is true once the response headers are out.
+	Started() bool
+}
+
+func newCollectionWriter(w http.ResponseWriter, media string, header []string) collectionWriter {
+	switch media {
+	case MediaCSV:
+		return &csvWriter{w: w, header: header}
+	case MediaNDJSON:
+		return &ndjsonWriter{w: w}
+	default:
+		return &jsonWriter{w: w, items: []Record{}}
+	}
+}
+
+// jsonWriter buffers the whole collection to write it as a single, indented, array.
+type jsonWriter struct {
+	w       http.ResponseWriter
+	items   []Record
+	started bool
+}
+
+func (jw *jsonWriter) Write(item Record) error {
+	jw.items = append(jw.items, item)
+	return nil
+}
+
+func (jw *jsonWriter) Close() error {
+	jw.started = true
+	WriteJson(jw.w, jw.items, http.StatusOK)
+	return nil
+}
+
+func (jw *jsonWriter) Started() bool {
+	return jw.started
+}
+
+// ndjsonWriter writes one JSON document per line and flushes it right away.
+type ndjsonWriter struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) start() {
+	if nw.enc != nil {
+		return
+	}
+	nw.w.Header().Set("Content-Type", MediaNDJSON)
+	nw.w.WriteHeader(http.StatusOK)
+	nw.enc = json.NewEncoder(nw.w)
+}
+
+func (nw *ndjsonWriter) Write(item Record) error {
+	nw.start()
+	if err := nw.enc.Encode(item); err != nil {
+		return err
+	}
+	if f, ok := nw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (nw *ndjsonWriter) Close() error {
+	nw.start()
+	return nil
+}
+
+func (nw *ndjsonWriter) Started() bool {
+	return nw.enc != nil
+}
+
+// csvWriter writes a header row followed by one row per item.
+type csvWriter struct {
+	w      http.ResponseWriter
+	header []string
+	cw     *csv.Writer
+}
+
+func (cw *csvWriter) start() error {
+	if cw.cw != nil {
+		return nil
+	}
+	cw.w.Header().Set("Content-Type", MediaCSV+"; charset=utf-8")
+	cw.w.WriteHeader(http.StatusOK)
+	cw.cw = csv.NewWriter(cw.w)
+	return cw.cw.Write(cw.header)
+}
+
+func (cw *csvWriter) Write(item Record) error {
+	if err := cw.start(); err != nil {
+		return err
+	}
+	if err := cw.cw.Write(item.CSVRecord()); err != nil {
+		return err
+	}
+	cw.cw.Flush()
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return cw.cw.Error()
+}
+
+func (cw *csvWriter) Close() error {
+	if err := cw.start(); err != nil {
+		return err
+	}
+	cw.cw.Flush()
+	return cw.cw.Error()
+}
+
+func (cw *csvWriter) Started() bool {
+	return cw.cw != nil
+}
+
+// writeCollection responds with the items produced by each, in the format negotiated from r.
+// each is given a function to call for every item, in order.
+func (api *Controller) writeCollection(w http.ResponseWriter, r *http.Request, header []string, each func(emit func(Record) error) error) {
+	media, err := negotiate(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	cw := newCollectionWriter(w, media, header)
+	err = each(func(item Record) error {
+		keepWriting(r)
+		return cw.Write(item)
+	})
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		if !cw.Started() {
+			api.writeError(w, r, err)
+			return
+		}
+		// Too late to change the status code, cut the response short instead.
+		LoggerFrom(r.Context()).Errorf("writing %s %s as %s: %v", r.Method, r.URL.Path, media, err)
+		return
+	}
+}
+
+// contextConn is the key of the connection a request came in on, see ConnContext.
+type contextConn struct{}
+
+// ConnContext keeps c in the context of the requests read from it, to be set as the ConnContext
+// of the http.Server. Streamed responses then push the WriteTimeout of the server out as they go,
+// see keepWriting, rather than being cut off however slowly they trickle.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, contextConn{}, c)
+}
+
+// keepWriting gives the response to r another WriteTimeout of its server from now, for streams
+// which call it before every part. Connections of HTTP/2 carry many streams and are left alone.
+func keepWriting(r *http.Request) {
+	if r.ProtoMajor != 1 {
+		return
+	}
+	c, ok := r.Context().Value(contextConn{}).(net.Conn)
+	if !ok {
+		return
+	}
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok || srv.WriteTimeout <= 0 {
+		return
+	}
+	c.SetWriteDeadline(time.Now().Add(srv.WriteTimeout))
+}
@@ -0,0 +1,498 @@
+package krud
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenAPI is an OpenAPI 3 document, only the parts of it that describe this API.
+type OpenAPI struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       OpenAPIInfo           `json:"info"`
+	Servers    []OpenAPIServer       `json:"servers"`
+	Security   []map[string][]string `json:"security"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components OpenAPIComponents     `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	Responses       map[string]Response       `json:"responses"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	In          string `json:"in"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations on a path, by lower case method.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Summary     string              `json:"summary"`
+	Tags        []string            `json:"tags"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string               `json:"$ref,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Example              interface{}        `json:"example,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// apiRoute describes a route of NewController, see openAPIRoutes.
+type apiRoute struct {
+	method, path string
+	id, summary  string
+	tag          string
+	// params are query parameters and headers, path parameters are taken from path.
+	params []Parameter
+	// body is the request body, nil if there is none. A Go value has its schema generated.
+	body interface{}
+	// bodyTypes are the media types of the body, JSON if empty.
+	bodyTypes []string
+	status    int
+	// resp is the response body on status, like body. collection makes it a list of them,
+	// which is negotiated as in writeCollection.
+	resp       interface{}
+	respTypes  []string
+	collection bool
+}
+
+var (
+	idempotencyKey = Parameter{Name: "Idempotency-Key", In: "header",
+		Description: "Replays the response of an earlier request with the same key, see the README."}
+	lastEventID = Parameter{Name: "Last-Event-ID", In: "header",
+		Description: "Seq of the last event seen, to pick up after it.", Schema: &Schema{Type: "integer", Format: "int64"}}
+	eventsFollow = []Parameter{
+		lastEventID,
+		{Name: "last_event_id", In: "query", Description: "Like Last-Event-ID, for clients that cannot set headers.",
+			Schema: &Schema{Type: "integer", Format: "int64"}},
+		{Name: "after", In: "query", Description: "Only events after this time.", Schema: &Schema{Type: "string", Format: "date-time"}},
+		{Name: "before", In: "query", Description: "Only events before this time.", Schema: &Schema{Type: "string", Format: "date-time"}},
+	}
+	bulkMode = Parameter{Name: "mode", In: "query",
+		Description: "Whether to import all items or none of them, or whatever items can be.",
+		Schema:      &Schema{Type: "string", Enum: []string{BulkAtomic.String(), BulkBestEffort.String()}}}
+)
+
+// openAPIRoutes describes every route registered by NewController, the OpenAPI document is
+// generated from them. Keep the two in sync, TestOpenAPIMatchesRouter checks that they are.
+var openAPIRoutes = []apiRoute{
+	{method: http.MethodPost, path: "/authors", id: "createAuthor", summary: "Create an author", tag: "authors",
+		params: []Parameter{idempotencyKey}, body: Author{}, status: http.StatusCreated, resp: Author{}},
+	{method: http.MethodGet, path: "/authors", id: "listAuthors", summary: "List all authors", tag: "authors",
+		status: http.StatusOK, resp: Author{}, collection: true},
+	{method: http.MethodGet, path: "/authors/{authorID}", id: "getAuthor", summary: "Get an author", tag: "authors",
+		status: http.StatusOK, resp: Author{}},
+	{method: http.MethodPatch, path: "/authors/{authorID}", id: "updateAuthor", summary: "Change some fields of an author", tag: "authors",
+		body: struct {
+			Name        string `json:"name,omitempty"`
+			DateOfBirth Date   `json:"dateofbirth,omitempty"`
+		}{}, status: http.StatusOK, resp: Author{}},
+	{method: http.MethodDelete, path: "/authors/{authorID}", id: "deleteAuthor", summary: "Delete an author and their books", tag: "authors",
+		status: http.StatusNoContent},
+
+	{method: http.MethodPost, path: "/authors/{authorID}/books", id: "createBook", summary: "Create a book by an author", tag: "books",
+		params: []Parameter{idempotencyKey}, body: Book{}, status: http.StatusCreated, resp: Book{}},
+	{method: http.MethodGet, path: "/authors/{authorID}/books", id: "listBooks", summary: "List the books by an author", tag: "books",
+		status: http.StatusOK, resp: Book{}, collection: true},
+	{method: http.MethodGet, path: "/authors/{authorID}/books/{bookID}", id: "getBook", summary: "Get a book", tag: "books",
+		status: http.StatusOK, resp: Book{}},
+	{method: http.MethodPatch, path: "/authors/{authorID}/books/{bookID}", id: "updateBook", summary: "Change some fields of a book", tag: "books",
+		body: struct {
+			Title     string `json:"title,omitempty"`
+			Published Date   `json:"published,omitempty"`
+		}{}, status: http.StatusOK, resp: Book{}},
+	{method: http.MethodDelete, path: "/authors/{authorID}/books/{bookID}", id: "deleteBook", summary: "Delete a book", tag: "books",
+		status: http.StatusNoContent},
+
+	{method: http.MethodPost, path: "/authors:bulk", id: "createAuthors", summary: "Import many authors", tag: "bulk",
+		params: []Parameter{bulkMode}, body: []Author{}, bodyTypes: []string{MediaJSON, MediaNDJSON},
+		status: http.StatusCreated, resp: BulkResponse{}},
+	{method: http.MethodPost, path: "/books:bulk", id: "createBooks", summary: "Import many books", tag: "bulk",
+		params: []Parameter{bulkMode}, body: []AuthorBook{}, bodyTypes: []string{MediaJSON, MediaNDJSON},
+		status: http.StatusCreated, resp: BulkResponse{}},
+
+	{method: http.MethodPost, path: "/events", id: "queryEvents", summary: "List the audit events, optionally between two times", tag: "events",
+		body: struct {
+			Before time.Time `json:"before,omitempty"`
+			After  time.Time `json:"after,omitempty"`
+		}{}, status: http.StatusOK, resp: Event{}, collection: true},
+	{method: http.MethodGet, path: "/events/verify", id: "verifyEvents", summary: "Check the hash chain of the audit events", tag: "events",
+		status: http.StatusOK, resp: ChainVerification{}},
+	{method: http.MethodGet, path: "/events/stream", id: "streamEvents", summary: "Follow audit events as Server-Sent Events", tag: "events",
+		params: eventsFollow, status: http.StatusOK, resp: &Schema{Type: "string", Description: "Each event has its seq as id and the Event as JSON data."},
+		respTypes: []string{"text/event-stream"}},
+	{method: http.MethodGet, path: "/events/ws", id: "eventsWebSocket", summary: "Follow audit events over a WebSocket", tag: "events",
+		params: eventsFollow, status: http.StatusSwitchingProtocols},
+
+	{method: http.MethodGet, path: "/export", id: "export", summary: "Export a consistent snapshot of all authors and books", tag: "bulk",
+		params: []Parameter{{Name: "format", In: "query", Description: "NDJSON by default, or a tarball when accepting application/gzip.",
+			Schema: &Schema{Type: "string", Enum: []string{"ndjson", "tar.gz"}}}},
+		status: http.StatusOK, resp: ExportRecord{}, respTypes: []string{MediaNDJSON, MediaGzip}},
+
+	{method: http.MethodPost, path: "/graphql", id: "graphql", summary: "Run a GraphQL query, see the schema in graphql.go", tag: "graphql",
+		body: &Schema{Type: "object", Required: []string{"query"}, Properties: map[string]*Schema{
+			"query":         {Type: "string"},
+			"operationName": {Type: "string"},
+			"variables":     {Type: "object"},
+			"extensions":    {Type: "object"},
+		}}, status: http.StatusOK, resp: &Schema{Type: "object", Properties: map[string]*Schema{
+			"data":       {Type: "object", Description: "Shaped like the query."},
+			"errors":     {Type: "array", Items: &Schema{Type: "object"}},
+			"extensions": {Type: "object"},
+		}}},
+
+	{method: http.MethodPost, path: "/webhooks", id: "createWebhook", summary: "Subscribe to changes", tag: "webhooks",
+		body: Webhook{}, status: http.StatusCreated, resp: Webhook{}},
+	{method: http.MethodGet, path: "/webhooks", id: "listWebhooks", summary: "List your webhooks", tag: "webhooks",
+		status: http.StatusOK, resp: Webhook{}, collection: true},
+	{method: http.MethodGet, path: "/webhooks/{webhookID}", id: "getWebhook", summary: "Get a webhook", tag: "webhooks",
+		status: http.StatusOK, resp: Webhook{}},
+	{method: http.MethodPatch, path: "/webhooks/{webhookID}", id: "updateWebhook", summary: "Change some fields of a webhook", tag: "webhooks",
+		body: struct {
+			URL    *string   `json:"url"`
+			Secret *string   `json:"secret"`
+			Types  *[]string `json:"types"`
+			Active *bool     `json:"active"`
+		}{}, status: http.StatusOK, resp: Webhook{}},
+	{method: http.MethodDelete, path: "/webhooks/{webhookID}", id: "deleteWebhook", summary: "Unsubscribe", tag: "webhooks",
+		status: http.StatusNoContent},
+	{method: http.MethodGet, path: "/webhooks/{webhookID}/messages", id: "listWebhookMessages", summary: "List the messages of a webhook", tag: "webhooks",
+		params: []Parameter{{Name: "state", In: "query", Description: "Only messages in this state.",
+			Schema: &Schema{Type: "string", Enum: []string{WebhookPending, WebhookDelivered, WebhookDead}}}},
+		status: http.StatusOK, resp: WebhookMessage{}, collection: true},
+	{method: http.MethodPost, path: "/webhooks/{webhookID}/messages/{messageID}:retry", id: "retryWebhookMessage", summary: "Try to deliver a dead message again", tag: "webhooks",
+		status: http.StatusAccepted},
+	{method: http.MethodGet, path: "/webhooks/{webhookID}/deliveries", id: "listWebhookDeliveries", summary: "List the delivery attempts of a webhook", tag: "webhooks",
+		status: http.StatusOK, resp: WebhookDelivery{}, collection: true},
+}
+
+// pathParam matches the parameters of a path template, like {authorID}.
+var pathParam = regexp.MustCompile(`{([^}:]+)}`)
+
+// NewOpenAPI generates the OpenAPI document of the routes registered by NewController.
+// Paths are relative to where the router is mounted, /api in cmd.
+func NewOpenAPI() *OpenAPI {
+	g := schemaGen{schemas: map[string]*Schema{}, types: map[reflect.Type]string{}}
+	problem := g.schemaOf(reflect.TypeOf(Problem{}))
+
+	doc := &OpenAPI{
+		OpenAPI: "3.0.3",
+		Info: OpenAPIInfo{
+			Title:   "krud",
+			Version: "1",
+			Description: "CRUD for authors and their books, every change is audited. " +
+				"Errors are RFC 7807 problem details.",
+		},
+		Servers:  []OpenAPIServer{{URL: "/api"}},
+		Security: []map[string][]string{{"user": {}}},
+		Paths:    map[string]PathItem{},
+		Components: OpenAPIComponents{
+			Schemas: g.schemas,
+			Responses: map[string]Response{
+				"Problem": {
+					Description: "The request failed, see code for why.",
+					Content:     map[string]MediaType{MediaProblem: {Schema: problem}},
+				},
+			},
+			SecuritySchemes: map[string]SecurityScheme{
+				"user": {
+					Type: "apiKey",
+					In:   "header",
+					Name: "user",
+					Description: "The user making the request. Depending on the auth mode of the server, " +
+						"the common name of a client certificate is used instead.",
+				},
+			},
+		},
+	}
+
+	for _, route := range openAPIRoutes {
+		op := &Operation{
+			OperationID: route.id,
+			Summary:     route.summary,
+			Tags:        []string{route.tag},
+			Responses: map[string]Response{
+				"default": {Ref: "#/components/responses/Problem"},
+			},
+		}
+		for _, m := range pathParam.FindAllStringSubmatch(route.path, -1) {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: m[1], In: "path", Required: true, Schema: &Schema{Type: "integer", Format: "int64"},
+			})
+		}
+		for _, p := range route.params {
+			if p.Schema == nil {
+				p.Schema = &Schema{Type: "string"}
+			}
+			op.Parameters = append(op.Parameters, p)
+		}
+
+		if route.body != nil {
+			types := route.bodyTypes
+			if len(types) == 0 {
+				types = []string{MediaJSON}
+			}
+			op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{}}
+			for _, media := range types {
+				s := g.schemaFor(route.body)
+				if media == MediaNDJSON && s.Items != nil {
+					// One item per line.
+					s = s.Items
+				}
+				op.RequestBody.Content[media] = MediaType{Schema: s}
+			}
+		}
+
+		resp := Response{Description: http.StatusText(route.status)}
+		switch {
+		case route.collection:
+			item := g.schemaFor(route.resp)
+			resp.Content = map[string]MediaType{
+				MediaJSON:   {Schema: &Schema{Type: "array", Items: item}},
+				MediaNDJSON: {Schema: item},
+				MediaCSV:    {Schema: &Schema{Type: "string", Description: "With a header row."}},
+			}
+			op.Parameters = append(op.Parameters, Parameter{Name: "Accept", In: "header",
+				Description: "Picks the format of the list, JSON by default.", Schema: &Schema{Type: "string"}})
+		case route.resp != nil:
+			types := route.respTypes
+			if len(types) == 0 {
+				types = []string{MediaJSON}
+			}
+			resp.Content = map[string]MediaType{}
+			for _, media := range types {
+				s := g.schemaFor(route.resp)
+				if media == MediaGzip {
+					s = &Schema{Type: "string", Format: "binary"}
+				}
+				resp.Content[media] = MediaType{Schema: s}
+			}
+		}
+		op.Responses[fmt.Sprint(route.status)] = resp
+
+		path := pathParam.ReplaceAllString(route.path, "{$1}")
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(route.method)] = op
+	}
+	return doc
+}
+
+// ServeOpenAPI responds with the OpenAPI document of NewOpenAPI.
+func ServeOpenAPI(w http.ResponseWriter, r *http.Request) {
+	WriteJson(w, NewOpenAPI(), http.StatusOK)
+}
+
+// swaggerUI are the files of Swagger UI that openAPIDocs needs, see swagger-ui/README.md.
+//
+//go:embed swagger-ui/swagger-ui.css swagger-ui/swagger-ui-bundle.js
+var swaggerUI embed.FS
+
+// openAPIDocs renders the document at /openapi.json with Swagger UI, served by ServeDocsAssets.
+const openAPIDocs = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>krud API</title>
+<link rel="stylesheet" href="/docs/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="/docs/swagger-ui-bundle.js"></script>
+<script>
+window.onload = () => { window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"}); };
+</script>
+</body>
+</html>
+`
+
+// ServeDocs responds with interactive docs of the API, which expects the document at /openapi.json
+// and the files of ServeDocsAssets under /docs/.
+func ServeDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, openAPIDocs)
+}
+
+// ServeDocsAssets responds with the files of Swagger UI that ServeDocs needs, under /docs/.
+func ServeDocsAssets(w http.ResponseWriter, r *http.Request) {
+	http.StripPrefix("/docs/", http.FileServer(http.FS(swaggerUIFiles))).ServeHTTP(w, r)
+}
+
+var swaggerUIFiles = func() fs.FS {
+	sub, err := fs.Sub(swaggerUI, "swagger-ui")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}()
+
+var (
+	dateType       = reflect.TypeOf(Date{})
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGen generates schemas from Go types, as they are encoded by encoding/json.
+// Named structs become components, referred to by name.
+type schemaGen struct {
+	schemas map[string]*Schema
+	types   map[reflect.Type]string
+}
+
+// schemaFor is the schema of v, or v itself if it already is one.
+func (g *schemaGen) schemaFor(v interface{}) *Schema {
+	if s, ok := v.(*Schema); ok {
+		return s
+	}
+	return g.schemaOf(reflect.TypeOf(v))
+}
+
+func (g *schemaGen) schemaOf(t reflect.Type) *Schema {
+	switch t {
+	case dateType:
+		return &Schema{Type: "string", Format: "date", Pattern: `^\d{4}-\d{2}-\d{2}$`, Example: "1970-01-01"}
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schemaOf(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name, ok := g.types[t]
+		if !ok {
+			name = strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+			g.types[t] = name
+			// Registered before generating, in case t refers to itself.
+			g.schemas[name] = &Schema{}
+			*g.schemas[name] = *g.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	// Like interface{}, anything goes.
+	return &Schema{}
+}
+
+// object is the schema of struct t, with the fields of embedded structs promoted.
+func (g *schemaGen) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			name, opts := tag, ""
+			if i := strings.Index(tag, ","); i >= 0 {
+				name, opts = tag[:i], tag[i:]
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fs := g.schemaOf(f.Type)
+			if name == "id" {
+				// Assigned by the server, ignored in requests.
+				fs = &Schema{Type: fs.Type, Format: fs.Format, ReadOnly: true}
+			}
+			if f.Type.Kind() == reflect.Ptr && !strings.Contains(opts, "omitempty") && fs.Ref == "" {
+				fs.Nullable = true
+			}
+			s.Properties[name] = fs
+			if f.Type.Kind() != reflect.Ptr && !strings.Contains(opts, "omitempty") {
+				s.Required = append(s.Required, name)
+			}
+		}
+	}
+	add(t)
+	sort.Strings(s.Required)
+	return s
+}
@@ -0,0 +1,127 @@
+package krud_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/vikblom/krud"
+)
+
+// TestOpenAPIMatchesRouter fails when a route is added to NewController without
+// describing it in the OpenAPI document, or the other way around.
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	r := mux.NewRouter()
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, EmptyMock())
+
+	// Path parameters as in OpenAPI, without their patterns.
+	param := regexp.MustCompile(`{([^}:]+):[^}]*}`)
+	routed := map[string]bool{}
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, m := range methods {
+			routed[strings.ToLower(m)+" "+param.ReplaceAllString(tpl, "{$1}")] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk router: %v", err)
+	}
+
+	documented := map[string]bool{}
+	for path, item := range krud.NewOpenAPI().Paths {
+		for method := range item {
+			documented[method+" "+path] = true
+		}
+	}
+
+	var missing, extra []string
+	for k := range routed {
+		if !documented[k] {
+			missing = append(missing, k)
+		}
+	}
+	for k := range documented {
+		if !routed[k] {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	if len(missing) > 0 {
+		t.Errorf("routes not in the OpenAPI document: %v", missing)
+	}
+	if len(extra) > 0 {
+		t.Errorf("OpenAPI document has routes that are not routed: %v", extra)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	w := httptest.NewRecorder()
+	krud.ServeOpenAPI(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	checkStatusCode(t, w.Result(), http.StatusOK)
+
+	var doc krud.OpenAPI
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode document: %v", err)
+	}
+
+	author := doc.Components.Schemas["Author"]
+	if author == nil {
+		t.Fatalf("no Author schema in: %v", doc.Components.Schemas)
+	}
+	dob := author.Properties["dateofbirth"]
+	if dob == nil || dob.Type != "string" || dob.Format != "date" {
+		t.Errorf("expected dateofbirth to be a date but got: %+v", dob)
+	}
+	if id := author.Properties["id"]; id == nil || !id.ReadOnly {
+		t.Errorf("expected a read only id but got: %+v", id)
+	}
+
+	// Promoted from the embedded Book.
+	if _, ok := doc.Components.Schemas["AuthorBook"].Properties["title"]; !ok {
+		t.Errorf("expected AuthorBook to have a title")
+	}
+
+	if doc.Components.SecuritySchemes["user"].Name != "user" {
+		t.Errorf("expected the user header as security scheme but got: %+v", doc.Components.SecuritySchemes)
+	}
+	op := doc.Paths["/authors/{authorID}"]["get"]
+	if op == nil {
+		t.Fatalf("no operation to get an author")
+	}
+	if op.Responses["default"].Ref != "#/components/responses/Problem" {
+		t.Errorf("expected errors to be problems but got: %+v", op.Responses)
+	}
+}
+
+func TestDocsAreSelfContained(t *testing.T) {
+	w := httptest.NewRecorder()
+	krud.ServeDocs(w, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	page := w.Body.String()
+	if strings.Contains(page, "https://") {
+		t.Errorf("expected docs that load nothing from elsewhere but got:\n%s", page)
+	}
+
+	for _, path := range regexp.MustCompile(`(?:href|src)="(/docs/[^"]+)"`).FindAllStringSubmatch(page, -1) {
+		w := httptest.NewRecorder()
+		krud.ServeDocsAssets(w, httptest.NewRequest(http.MethodGet, path[1], nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s: expected the file but got: %d", path[1], w.Code)
+		}
+	}
+}
@@ -23,6 +23,15 @@ import (
 type AuditDB struct {
 	db   *sql.DB
 	user string
+	// tenant of user, every transaction is kept to its rows, see setTenant.
+	tenant string
+	// isolation overrides the isolation level of transactions in txOps.
+	isolation map[string]sql.IsolationLevel
+	// attempts is how many times a transaction is tried, backing off from backoff.
+	attempts int
+	backoff  time.Duration
+	// audit, if set, takes read events instead of the transaction they happen in.
+	audit *AuditWriter
 }
 
 const (
@@ -32,101 +41,102 @@ const (
 	AUDIT_OP_DELETE = "DELETE"
 )
 
-var ErrUnauthorized = errors.New("unauthorized")
-var ErrDoesNotExist = errors.New("object not found")
+func NewAuditDB(ctx context.Context, db *sql.DB, user string, opts ...AuditDBOption) (*AuditDB, error) {
 
-func NewAuditDB(ctx context.Context, db *sql.DB, user string) (*AuditDB, error) {
+	adb := &AuditDB{
+		db:       db,
+		user:     user,
+		attempts: DefaultRetryAttempts,
+		backoff:  DefaultRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(adb)
+	}
 
-	ok, err := authorize(ctx, db, user)
+	ok, err := adb.authorize(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("authorization: %w", err)
 	}
-	if ok {
-		return &AuditDB{db: db, user: user}, nil
-	} else {
+	if !ok {
 		return nil, ErrUnauthorized
 	}
+	return adb, nil
 }
 
-// authorize checks if user is allowed to use db.
-func authorize(ctx context.Context, db *sql.DB, user string) (ok bool, err error) {
-
-	// Not yet an AuditDB so cannot use wrapInTransaction.
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return false, fmt.Errorf("create transaction: %w", err)
-	}
-	defer func() {
-		err2 := tx.Rollback()
-		// Don't shadow earlier error. Ignore "already rolled back/comitted".
-		if err == nil && err2 != nil && !errors.Is(err2, sql.ErrTxDone) {
-			err = err2
-		}
-	}()
-
-	_, err = db.ExecContext(ctx,
-		`INSERT INTO events (username, obj_type, operation, ts)
-         VALUES ($1, $2, $3, NOW())`,
-		user,
-		"auth",
-		AUDIT_OP_READ)
-	if err != nil {
-		return false, fmt.Errorf("insert event: %w", err)
+// WithAuditWriter hands read events to aw, rather than inserting them in the transaction of the read.
+// Events of writes are always part of the transaction making the change.
+func WithAuditWriter(aw *AuditWriter) AuditDBOption {
+	return func(adb *AuditDB) {
+		adb.audit = aw
 	}
+}
 
-	rows, err := db.QueryContext(ctx, "SELECT name FROM users")
-	if err != nil {
+// authorize checks if the user of adb is allowed to use the database, and finds their tenant.
+// The attempt is recorded either way, in no tenant if the user is unknown.
+func (adb *AuditDB) authorize(ctx context.Context) (ok bool, err error) {
+	// Before the transaction, which is kept to the tenant once it is known.
+	err = adb.db.QueryRowContext(ctx, "SELECT tenant_id FROM users WHERE name=$1", adb.user).Scan(&adb.tenant)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return false, fmt.Errorf("query users: %w", err)
 	}
-	defer rows.Close()
+	ok = err == nil
 
-	// ok is zero-valued to false
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			return false, fmt.Errorf("scanning row: %w", err)
-		}
-		if user == name {
-			ok = true
-			break
-		}
-	}
-	if err := rows.Err(); err != nil {
-		return false, fmt.Errorf("going over rows: %w", err)
-	}
-	if err := tx.Commit(); err != nil {
-		return false, fmt.Errorf("commit transaction: %w", err)
-	}
-
-	return ok, nil
+	err = adb.wrapInTransaction(ctx, "authorize", func(ctx context.Context, tx *sql.Tx) error {
+		return adb.readEvent(ctx, tx, "auth", nil)
+	})
+	return ok, err
 }
 
-// wrapInTransaction create a transaction for action.
-// DB operations in action either happens all together, or not all all.
-// action can be a closure to escape side-effects.
-// NOTE: Possibly too "magical".
-func (adb *AuditDB) wrapInTransaction(ctx context.Context, action func(tx *sql.Tx) error) error {
+// readEvent records that the user of adb read the object of objType with id,
+// either in tx or through the AuditWriter once tx has committed, so that
+// attempts at tx which are rolled back are not recorded.
+func (adb *AuditDB) readEvent(ctx context.Context, tx *sql.Tx, objType string, id *int64) error {
+	if adb.audit == nil {
+		return insertEvent(ctx, tx, adb.tenant, adb.user, objType, AUDIT_OP_READ, id)
+	}
+	e := Event{
+		When:      time.Now().UTC(),
+		Tenant:    adb.tenant,
+		User:      adb.user,
+		Operation: AUDIT_OP_READ,
+		Type:      objType,
+		ID:        id,
+	}
+	return afterCommit(ctx, func() error {
+		return adb.audit.Write(ctx, e)
+	})
+}
 
-	// A transaction must end with a call to Commit or Rollback.
-	tx, err := adb.db.BeginTx(ctx, nil)
+// readEventAlone records that the user of adb read objects of objType, in a transaction of its own named op.
+// Reads that hand rows to a callback record them first, so that the tail of the chain of events,
+// which every write locks, is not held while the callback takes its time with a slow client.
+func (adb *AuditDB) readEventAlone(ctx context.Context, op, objType string) error {
+	err := adb.wrapInTransaction(ctx, op, func(ctx context.Context, tx *sql.Tx) error {
+		return adb.readEvent(ctx, tx, objType, nil)
+	})
 	if err != nil {
-		return fmt.Errorf("create transaction: %w", err)
+		return fmt.Errorf("transaction: %w", err)
 	}
+	return nil
+}
 
-	err = action(tx)
-	if err != nil {
-		rbErr := tx.Rollback()
-		if rbErr != nil {
-			return fmt.Errorf("rollback failed because '%v' after err: %w", rbErr, err)
-		}
-		return err
-	}
-	return tx.Commit()
+// insertEvent records that user, of tenant, did op on the object of objType with id.
+// A nil id means the operation was on all objects of that type.
+func insertEvent(ctx context.Context, tx *sql.Tx, tenant, user, objType, op string, id *int64) error {
+	return appendEvents(ctx, tx, []Event{{
+		When:      time.Now(),
+		Tenant:    tenant,
+		User:      user,
+		Operation: op,
+		Type:      objType,
+		ID:        id,
+	}})
 }
 
 func (adb *AuditDB) AddAuthor(ctx context.Context, author Author) (id int64, err error) {
+	defer observe(ctx, "AddAuthor", time.Now(), &err)
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
+	err = adb.wrapInTransaction(ctx, "AddAuthor", func(ctx context.Context, tx *sql.Tx) error {
 		row := tx.QueryRowContext(ctx,
 			`INSERT INTO authors (name, date_of_birth)
              VALUES($1,$2)
@@ -134,7 +144,7 @@ func (adb *AuditDB) AddAuthor(ctx context.Context, author Author) (id int64, err
 			author.Name,
 			author.DateOfBirth)
 		if row.Err() != nil {
-			return fmt.Errorf("insert author: %w", err)
+			return fmt.Errorf("insert author: %w", row.Err())
 		}
 		// Put value in output.
 		err = row.Scan(&id)
@@ -142,17 +152,13 @@ func (adb *AuditDB) AddAuthor(ctx context.Context, author Author) (id int64, err
 			return fmt.Errorf("scanning id: %w", err)
 		}
 
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"authors",
-			id,
-			AUDIT_OP_CREATE)
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "authors", AUDIT_OP_CREATE, &id)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
-		return nil
+
+		author.ID = id
+		return adb.storeIdempotent(ctx, tx, author)
 	})
 	if err != nil {
 		return -1, fmt.Errorf("transaction: %w", err)
@@ -162,17 +168,12 @@ func (adb *AuditDB) AddAuthor(ctx context.Context, author Author) (id int64, err
 }
 
 func (adb *AuditDB) GetAuthor(ctx context.Context, id int64) (author *Author, err error) {
+	defer observe(ctx, "GetAuthor", time.Now(), &err)
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"authors",
-			id,
-			AUDIT_OP_READ)
+	err = adb.wrapInTransaction(ctx, "GetAuthor", func(ctx context.Context, tx *sql.Tx) error {
+		err = adb.readEvent(ctx, tx, "authors", &id)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		row := tx.QueryRowContext(ctx,
@@ -201,19 +202,15 @@ func (adb *AuditDB) GetAuthor(ctx context.Context, id int64) (author *Author, er
 }
 
 func (adb *AuditDB) UpdateAuthor(ctx context.Context, author Author) (err error) {
+	defer observe(ctx, "UpdateAuthor", time.Now(), &err)
+
 	// TOOD: Only update given values. Maybe map[id]interface{}.
 
 	var n int64
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"authors",
-			author.ID,
-			AUDIT_OP_UPDATE)
+	err = adb.wrapInTransaction(ctx, "UpdateAuthor", func(ctx context.Context, tx *sql.Tx) error {
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "authors", AUDIT_OP_UPDATE, &author.ID)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		res, err := tx.ExecContext(ctx,
@@ -244,20 +241,86 @@ func (adb *AuditDB) UpdateAuthor(ctx context.Context, author Author) (err error)
 	return nil
 }
 
-func (adb *AuditDB) AllAuthors(ctx context.Context) (authors []Author, err error) {
+// AuthorChanges are the fields of an author to change, those left nil are kept.
+type AuthorChanges struct {
+	Name        *string
+	DateOfBirth *Date
+}
+
+// PatchAuthor changes the fields of the author with id which are set in changes, and returns the author as changed.
+// The author is read and written in one transaction, so that concurrent changes to other fields are not lost.
+func (adb *AuditDB) PatchAuthor(ctx context.Context, id int64, changes AuthorChanges) (author *Author, err error) {
+	defer observe(ctx, "PatchAuthor", time.Now(), &err)
+
+	err = adb.wrapInTransaction(ctx, "PatchAuthor", func(ctx context.Context, tx *sql.Tx) error {
+		author = new(Author)
+		err := tx.QueryRowContext(ctx,
+			`SELECT id, name, date_of_birth
+             FROM authors
+             WHERE id=$1
+             FOR UPDATE`,
+			id).Scan(&author.ID, &author.Name, &author.DateOfBirth)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("scanning row: %w", err)
+		}
+
+		if changes.Name != nil {
+			author.Name = *changes.Name
+		}
+		if changes.DateOfBirth != nil {
+			author.DateOfBirth = *changes.DateOfBirth
+		}
+		if err := author.Validate(); err != nil {
+			return err
+		}
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
 		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, operation, ts)
-             VALUES ($1,$2,$3,NOW())`,
-			adb.user,
-			"authors",
-			AUDIT_OP_READ)
+			`UPDATE authors
+             SET name=$2, date_of_birth=$3
+             WHERE id=$1`,
+			author.ID,
+			author.Name,
+			author.DateOfBirth,
+		)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return fmt.Errorf("update author: %w", err)
 		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "authors", AUDIT_OP_UPDATE, &author.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	return author, nil
+}
+
+func (adb *AuditDB) AllAuthors(ctx context.Context) (authors []Author, err error) {
+	defer observe(ctx, "AllAuthors", time.Now(), &err)
+
+	err = adb.EachAuthor(ctx, func(a Author) error {
+		authors = append(authors, a)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return authors, nil
+}
+
+// EachAuthor calls fn for every author, as they are read from the database.
+// Iteration stops at the first error from fn.
+func (adb *AuditDB) EachAuthor(ctx context.Context, fn func(Author) error) (err error) {
+	defer observe(ctx, "EachAuthor", time.Now(), &err)
 
-		rows, err := tx.QueryContext(ctx, "SELECT id, name, date_of_birth FROM authors")
+	if err := adb.readEventAlone(ctx, "EachAuthorEvent", "authors"); err != nil {
+		return err
+	}
+
+	err = adb.wrapInTransaction(ctx, "EachAuthor", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT id, name, date_of_birth FROM authors ORDER BY id")
 		if err != nil {
 			return fmt.Errorf("select authors: %w", err)
 		}
@@ -270,7 +333,9 @@ func (adb *AuditDB) AllAuthors(ctx context.Context) (authors []Author, err error
 			if err := rows.Scan(&id, &name, &bday); err != nil {
 				return fmt.Errorf("scanning row: %w", err)
 			}
-			authors = append(authors, Author{ID: id, Name: name, DateOfBirth: bday})
+			if err := fn(Author{ID: id, Name: name, DateOfBirth: bday}); err != nil {
+				return err
+			}
 		}
 		if err := rows.Err(); err != nil {
 			return fmt.Errorf("going over rows: %w", err)
@@ -278,25 +343,20 @@ func (adb *AuditDB) AllAuthors(ctx context.Context) (authors []Author, err error
 		return nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("transaction: %w", err)
+		return fmt.Errorf("transaction: %w", err)
 	}
 
-	return authors, nil
+	return nil
 }
 
 func (adb *AuditDB) DeleteAuthor(ctx context.Context, id int64) (err error) {
+	defer observe(ctx, "DeleteAuthor", time.Now(), &err)
 
 	var n int64
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"authors",
-			id,
-			AUDIT_OP_DELETE)
+	err = adb.wrapInTransaction(ctx, "DeleteAuthor", func(ctx context.Context, tx *sql.Tx) error {
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "authors", AUDIT_OP_DELETE, &id)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		res, err := tx.ExecContext(ctx, `DELETE FROM authors WHERE id=$1`, id)
@@ -321,8 +381,9 @@ func (adb *AuditDB) DeleteAuthor(ctx context.Context, id int64) (err error) {
 }
 
 func (adb *AuditDB) AddBook(ctx context.Context, author int64, book Book) (id int64, err error) {
+	defer observe(ctx, "AddBook", time.Now(), &err)
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
+	err = adb.wrapInTransaction(ctx, "AddBook", func(ctx context.Context, tx *sql.Tx) error {
 		row := tx.QueryRowContext(ctx,
 			`INSERT INTO books (author_id, title, published)
              VALUES($1, $2, $3)
@@ -331,25 +392,24 @@ func (adb *AuditDB) AddBook(ctx context.Context, author int64, book Book) (id in
 			book.Title,
 			book.Published)
 		if row.Err() != nil {
-			return fmt.Errorf("insert book: %w", err)
+			return fmt.Errorf("insert book: %w", row.Err())
 		}
 		// Put value in output.
 		err = row.Scan(&id)
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("author %d: %w", author, ErrDoesNotExist)
+		}
 		if err != nil {
 			return fmt.Errorf("scanning id: %w", err)
 		}
 
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"books",
-			id,
-			AUDIT_OP_CREATE)
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "books", AUDIT_OP_CREATE, &id)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
-		return nil
+
+		book.ID = id
+		return adb.storeIdempotent(ctx, tx, book)
 	})
 	if err != nil {
 		return -1, fmt.Errorf("transaction: %w", err)
@@ -359,17 +419,12 @@ func (adb *AuditDB) AddBook(ctx context.Context, author int64, book Book) (id in
 }
 
 func (adb *AuditDB) GetBook(ctx context.Context, authorID, bookID int64) (book *Book, err error) {
+	defer observe(ctx, "GetBook", time.Now(), &err)
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"books",
-			bookID,
-			AUDIT_OP_READ)
+	err = adb.wrapInTransaction(ctx, "GetBook", func(ctx context.Context, tx *sql.Tx) error {
+		err = adb.readEvent(ctx, tx, "books", &bookID)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		row := tx.QueryRowContext(ctx,
@@ -398,19 +453,15 @@ func (adb *AuditDB) GetBook(ctx context.Context, authorID, bookID int64) (book *
 }
 
 func (adb *AuditDB) UpdateBook(ctx context.Context, authorID int64, book Book) (err error) {
+	defer observe(ctx, "UpdateBook", time.Now(), &err)
+
 	// TOOD: Only update given values. Maybe map[id]interface{}.
 
 	var n int64
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"books",
-			book.ID,
-			AUDIT_OP_UPDATE)
+	err = adb.wrapInTransaction(ctx, "UpdateBook", func(ctx context.Context, tx *sql.Tx) error {
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "books", AUDIT_OP_UPDATE, &book.ID)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		res, err := tx.ExecContext(ctx,
@@ -441,17 +492,70 @@ func (adb *AuditDB) UpdateBook(ctx context.Context, authorID int64, book Book) (
 	return nil
 }
 
-func (adb *AuditDB) AllBooks(ctx context.Context) (books []Book, err error) {
+// BookChanges are the fields of a book to change, those left nil are kept.
+type BookChanges struct {
+	Title     *string
+	Published *Date
+}
+
+// PatchBook changes the fields of the book with bookID by the author with authorID which are set in changes,
+// and returns the book as changed. Like PatchAuthor, it is read and written in one transaction.
+func (adb *AuditDB) PatchBook(ctx context.Context, authorID, bookID int64, changes BookChanges) (book *Book, err error) {
+	defer observe(ctx, "PatchBook", time.Now(), &err)
+
+	err = adb.wrapInTransaction(ctx, "PatchBook", func(ctx context.Context, tx *sql.Tx) error {
+		book = new(Book)
+		err := tx.QueryRowContext(ctx,
+			`SELECT id, title, published
+             FROM books
+             WHERE id=$1 AND author_id=$2
+             FOR UPDATE`,
+			bookID, authorID).Scan(&book.ID, &book.Title, &book.Published)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("scanning row: %w", err)
+		}
+
+		if changes.Title != nil {
+			book.Title = *changes.Title
+		}
+		if changes.Published != nil {
+			book.Published = *changes.Published
+		}
+		if err := book.Validate(); err != nil {
+			return err
+		}
 
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
 		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, operation, ts)
-             VALUES ($1,$2,$3,NOW())`,
-			adb.user,
-			"books",
-			AUDIT_OP_READ)
+			`UPDATE books
+             SET title=$2, published=$3
+             WHERE id=$1`,
+			book.ID,
+			book.Title,
+			book.Published,
+		)
+		if err != nil {
+			return fmt.Errorf("update book: %w", err)
+		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "books", AUDIT_OP_UPDATE, &book.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	return book, nil
+}
+
+func (adb *AuditDB) AllBooks(ctx context.Context) (books []Book, err error) {
+	defer observe(ctx, "AllBooks", time.Now(), &err)
+
+	err = adb.wrapInTransaction(ctx, "AllBooks", func(ctx context.Context, tx *sql.Tx) error {
+		// Start over if this is a retry.
+		books = nil
+		err = adb.readEvent(ctx, tx, "books", nil)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		rows, err := tx.QueryContext(ctx, "SELECT id, title, published FROM books")
@@ -479,19 +583,99 @@ func (adb *AuditDB) AllBooks(ctx context.Context) (books []Book, err error) {
 	return books, nil
 }
 
+// EachBook calls fn for every book by authorID, as they are read from the database.
+// Iteration stops at the first error from fn.
+func (adb *AuditDB) EachBook(ctx context.Context, authorID int64, fn func(Book) error) (err error) {
+	defer observe(ctx, "EachBook", time.Now(), &err)
+
+	if err := adb.readEventAlone(ctx, "EachBookEvent", "books"); err != nil {
+		return err
+	}
+
+	err = adb.wrapInTransaction(ctx, "EachBook", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, title, published
+             FROM books
+             WHERE author_id=$1
+             ORDER BY id`,
+			authorID)
+		if err != nil {
+			return fmt.Errorf("select books: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var b Book
+			if err := rows.Scan(&b.ID, &b.Title, &b.Published); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(b); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+
+	return nil
+}
+
+// BooksOf are the books of every author among authorIDs, ordered by author and then book.
+// It is EachBook for many authors at once.
+func (adb *AuditDB) BooksOf(ctx context.Context, authorIDs []int64) (books []AuthorBook, err error) {
+	defer observe(ctx, "BooksOf", time.Now(), &err)
+
+	err = adb.wrapInTransaction(ctx, "BooksOf", func(ctx context.Context, tx *sql.Tx) error {
+		// Start over if this is a retry.
+		books = nil
+		err = adb.readEvent(ctx, tx, "books", nil)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx,
+			`SELECT author_id, id, title, published
+             FROM books
+             WHERE author_id = ANY($1)
+             ORDER BY author_id, id`,
+			authorIDs)
+		if err != nil {
+			return fmt.Errorf("select books: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var b AuthorBook
+			if err := rows.Scan(&b.AuthorID, &b.ID, &b.Title, &b.Published); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			books = append(books, b)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+
+	return books, nil
+}
+
 func (adb *AuditDB) DeleteBook(ctx context.Context, authorID, bookID int64) (err error) {
+	defer observe(ctx, "DeleteBook", time.Now(), &err)
 
 	var n int64
-	err = adb.wrapInTransaction(ctx, func(tx *sql.Tx) error {
-		_, err = tx.ExecContext(ctx,
-			`INSERT INTO events (username, obj_type, obj_id, operation, ts)
-             VALUES ($1, $2, $3, $4, NOW())`,
-			adb.user,
-			"books",
-			bookID,
-			AUDIT_OP_DELETE)
+	err = adb.wrapInTransaction(ctx, "DeleteBook", func(ctx context.Context, tx *sql.Tx) error {
+		err = insertEvent(ctx, tx, adb.tenant, adb.user, "books", AUDIT_OP_DELETE, &bookID)
 		if err != nil {
-			return fmt.Errorf("insert event: %w", err)
+			return err
 		}
 
 		res, err := tx.ExecContext(ctx,
@@ -518,14 +702,6 @@ func (adb *AuditDB) DeleteBook(ctx context.Context, authorID, bookID int64) (err
 	return nil
 }
 
-type Event struct {
-	When      time.Time
-	User      string
-	Operation string
-	Type      string
-	ID        *int64 // Can be NULL.
-}
-
 // Filter is an option-like type that lets outside callers specify
 // which events they are interested in, but the implementation of filtering
 // out such events is hidden.
@@ -539,18 +715,48 @@ type whereFilter struct {
 
 func EventsAfter(t time.Time) Filter {
 	return func(f *whereFilter) {
-		(*f).lhs = append((*f).lhs, fmt.Sprintf("ts > $%d::timestamp", len(f.lhs)+1))
+		(*f).lhs = append((*f).lhs, fmt.Sprintf("ts > $%d::timestamp", len(f.rhs)+1))
 		(*f).rhs = append((*f).rhs, t.UTC())
 	}
 }
 
 func EventsBefore(t time.Time) Filter {
 	return func(f *whereFilter) {
-		(*f).lhs = append((*f).lhs, fmt.Sprintf("ts < $%d", len(f.lhs)+1))
+		(*f).lhs = append((*f).lhs, fmt.Sprintf("ts < $%d", len(f.rhs)+1))
 		(*f).rhs = append((*f).rhs, t.UTC())
 	}
 }
 
+// EventsAfterSeq keeps events after the one with seq, in the chain.
+func EventsAfterSeq(seq int64) Filter {
+	return func(f *whereFilter) {
+		(*f).lhs = append((*f).lhs, fmt.Sprintf("seq > $%d", len(f.rhs)+1))
+		(*f).rhs = append((*f).rhs, seq)
+	}
+}
+
+// EventsOn keeps events about objects of objType with one of ids.
+func EventsOn(objType string, ids ...int64) Filter {
+	return func(f *whereFilter) {
+		(*f).lhs = append((*f).lhs, fmt.Sprintf("obj_type = $%d", len(f.rhs)+1))
+		(*f).rhs = append((*f).rhs, objType)
+		(*f).lhs = append((*f).lhs, fmt.Sprintf("obj_id = ANY($%d)", len(f.rhs)+1))
+		(*f).rhs = append((*f).rhs, ids)
+	}
+}
+
+// EventsLastOn keeps the last n events about each of the objects of objType with ids.
+func EventsLastOn(objType string, n int, ids ...int64) Filter {
+	return func(f *whereFilter) {
+		i := len(f.rhs)
+		(*f).lhs = append((*f).lhs, fmt.Sprintf(
+			`seq IN (SELECT last.seq FROM unnest($%d::bigint[]) AS o(id), LATERAL (
+                 SELECT seq FROM events WHERE obj_type = $%d AND obj_id = o.id ORDER BY seq DESC LIMIT $%d
+             ) AS last)`, i+1, i+2, i+3))
+		(*f).rhs = append((*f).rhs, ids, objType, n)
+	}
+}
+
 // TODO: Unit test whereFilter.
 // TODO: More filters.
 
@@ -571,6 +777,24 @@ func (wf *whereFilter) where() (string, []interface{}) {
 }
 
 func (adb *AuditDB) QueryEvents(ctx context.Context, filters ...Filter) (events []Event, err error) {
+	defer observe(ctx, "QueryEvents", time.Now(), &err)
+
+	err = adb.EachEvent(ctx, func(e Event) error {
+		events = append(events, e)
+		return nil
+	}, filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// EachEvent calls fn for every event matching filters, in the order of the chain.
+// Iteration stops at the first error from fn.
+func (adb *AuditDB) EachEvent(ctx context.Context, fn func(Event) error, filters ...Filter) (err error) {
+	defer observe(ctx, "EachEvent", time.Now(), &err)
+
 	// Note that querying events does not create a new event.
 
 	wfs := whereFilter{}
@@ -579,26 +803,30 @@ func (adb *AuditDB) QueryEvents(ctx context.Context, filters ...Filter) (events
 	}
 
 	where, args := wfs.where()
-	//fmt.Printf("%#v    %v\n", where, args)
-	rows, err := adb.db.QueryContext(ctx,
-		`SELECT ts, username, operation, obj_type, obj_id
-         FROM events `+where,
-		args...)
-	if err != nil {
-		return nil, fmt.Errorf("select events: %w", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var e Event
-		if err := rows.Scan(&e.When, &e.User, &e.Operation, &e.Type, &e.ID); err != nil {
-			return nil, fmt.Errorf("scanning row: %w", err)
+	err = adb.wrapInTransaction(ctx, "EachEvent", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT seq, ts, username, operation, obj_type, obj_id
+             FROM events `+where+`
+             ORDER BY seq`,
+			args...)
+		if err != nil {
+			return fmt.Errorf("select events: %w", err)
 		}
-		events = append(events, e)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("going over rows: %w", err)
-	}
+		defer rows.Close()
 
-	return events, nil
+		for rows.Next() {
+			e := Event{Tenant: adb.tenant}
+			if err := rows.Scan(&e.Seq, &e.When, &e.User, &e.Operation, &e.Type, &e.ID); err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	return err
 }
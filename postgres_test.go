@@ -1,18 +1,28 @@
 package krud_test
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/sirupsen/logrus/hooks/test"
+
 	"github.com/vikblom/krud"
 )
 
@@ -32,7 +42,7 @@ func CleanDatabase(t *testing.T) (*sql.DB, func()) {
 	}
 
 	// Nuke previous state
-	_, err = db.Exec("DROP TABLE IF EXISTS users, objects, authors, books, events")
+	_, err = db.Exec("DROP TABLE IF EXISTS users, objects, authors, books, events, event_chain, idempotency_keys, webhook_deliveries, webhook_messages, webhooks, rate_limits, schema_migrations")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -221,6 +231,64 @@ func TestAuthorUpdateAndGet(t *testing.T) {
 	}
 }
 
+func TestPatchAuthorAndBook(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+	ctx := context.Background()
+
+	db, err := krud.NewAuditDB(ctx, pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	id, err := db.AddAuthor(ctx, krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1882-01-25")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	// Concurrent changes to different fields are both kept.
+	name, dob := "V. Woolf", MakeDate(t, "1882-01-26")
+	errs := make(chan error, 2)
+	go func() {
+		_, err := db.PatchAuthor(ctx, id, krud.AuthorChanges{Name: &name})
+		errs <- err
+	}()
+	go func() {
+		_, err := db.PatchAuthor(ctx, id, krud.AuthorChanges{DateOfBirth: &dob})
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("patch author: %v", err)
+		}
+	}
+	expected := &krud.Author{ID: id, Name: name, DateOfBirth: dob}
+	actual, err := db.GetAuthor(ctx, id)
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v but got: %v, %v", expected, actual, err)
+	}
+
+	empty := ""
+	if _, err := db.PatchAuthor(ctx, id, krud.AuthorChanges{Name: &empty}); !errors.Is(err, krud.ErrInvalid) {
+		t.Errorf("expected an invalid change to fail but got: %v", err)
+	}
+	if _, err := db.PatchAuthor(ctx, 1234, krud.AuthorChanges{Name: &name}); !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected a missing author but got: %v", err)
+	}
+
+	bookID, err := db.AddBook(ctx, id, krud.Book{Title: "Orlando", Published: MakeDate(t, "1928-10-11")})
+	if err != nil {
+		t.Fatalf("add book: %v", err)
+	}
+	title := "Orlando: A Biography"
+	book, err := db.PatchBook(ctx, id, bookID, krud.BookChanges{Title: &title})
+	if err != nil || book.Title != title || !time.Time(book.Published).Equal(time.Time(MakeDate(t, "1928-10-11"))) {
+		t.Errorf("expected the title changed but got: %v, %v", book, err)
+	}
+	if _, err := db.PatchBook(ctx, id+1, bookID, krud.BookChanges{Title: &title}); !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected a book of another author to be missing but got: %v", err)
+	}
+}
+
 func TestAuthorAddThenDelete(t *testing.T) {
 	pdb, closer := CleanDatabase(t)
 	defer closer()
@@ -379,6 +447,48 @@ func TestAuthorConcurrentAddDelete(t *testing.T) {
 	}
 }
 
+func TestAuthorConcurrentUpdateSerializable(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	dob := MakeDate(t, "1900-01-01")
+	id, err := adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: dob})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	// Concurrent updates of the same row are serialization failures, which should be retried.
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER,
+				krud.WithIsolation("UpdateAuthor", sql.LevelSerializable),
+				krud.WithRetry(20, time.Millisecond))
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- adb.UpdateAuthor(context.Background(), krud.Author{ID: id, Name: fmt.Sprintf("author_%d", i), DateOfBirth: dob})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected update to be retried until it succeeds but got: %v", err)
+		}
+	}
+}
+
 func TestBookAdd(t *testing.T) {
 	pdb, closer := CleanDatabase(t)
 	defer closer()
@@ -662,3 +772,683 @@ func TestAuditEventsFilterOnTimeWindow(t *testing.T) {
 		t.Fatalf("expected 1 events but got: %d", len(eventsAfter))
 	}
 }
+
+func TestBookAddBulkMissingAuthor(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	db, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+
+	woolf := krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1982-01-25")}
+	woolf.ID, err = db.AddAuthor(context.Background(), woolf)
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	books := []krud.AuthorBook{
+		{AuthorID: woolf.ID, Book: krud.Book{Title: "To the Lighthouse", Published: MakeDate(t, "1927-05-05")}},
+		{AuthorID: 1234, Book: krud.Book{Title: "The Waves", Published: MakeDate(t, "1931-10-08")}},
+	}
+
+	results, err := db.AddBooks(context.Background(), books, krud.BulkAtomic)
+	if err != nil {
+		t.Fatalf("add books: %v", err)
+	}
+	if results[0].ID != 0 || !errors.Is(results[1].Err, krud.ErrDoesNotExist) {
+		t.Errorf("expected atomic import to fail on second book but got: %+v", results)
+	}
+
+	results, err = db.AddBooks(context.Background(), books, krud.BulkBestEffort)
+	if err != nil {
+		t.Fatalf("add books: %v", err)
+	}
+	if results[0].ID == 0 || !errors.Is(results[1].Err, krud.ErrDoesNotExist) {
+		t.Errorf("expected best-effort import to add first book but got: %+v", results)
+	}
+
+	_, err = db.GetBook(context.Background(), woolf.ID, results[0].ID)
+	if err != nil {
+		t.Errorf("get book: %v", err)
+	}
+}
+
+func TestExportAuthorsAndBooks(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	db, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+
+	woolf := krud.Author{Name: "Virginia Woolf", DateOfBirth: MakeDate(t, "1982-01-25")}
+	woolf.ID, err = db.AddAuthor(context.Background(), woolf)
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	book := krud.Book{Title: "To the Lighthouse", Published: MakeDate(t, "1927-05-05")}
+	book.ID, err = db.AddBook(context.Background(), woolf.ID, book)
+	if err != nil {
+		t.Fatalf("add book: %v", err)
+	}
+
+	var records []krud.ExportRecord
+	err = db.Export(context.Background(), func(rec krud.ExportRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	expected := []krud.ExportRecord{
+		{Type: krud.ExportTypeAuthor, Author: &woolf},
+		{Type: krud.ExportTypeBook, Book: &krud.AuthorBook{AuthorID: woolf.ID, Book: book}},
+	}
+	if !reflect.DeepEqual(expected, records) {
+		t.Errorf("wrong export, expected %v but got %v", expected, records)
+	}
+}
+
+func TestAuditWriterFlushesOnClose(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	log, _ := test.NewNullLogger()
+	// Too large to fill and too slow to tick, only Close flushes.
+	aw := krud.NewAuditWriter(log, pdb, krud.WithAuditBatch(1000, time.Hour))
+
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER, krud.WithAuditWriter(aw))
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	id, err := adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := adb.GetAuthor(context.Background(), id); err != nil {
+			t.Fatalf("get author: %v", err)
+		}
+	}
+
+	// The write is part of its transaction, reads are still buffered.
+	events, err := adb.QueryEvents(context.Background())
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	if len(events) != 1 || events[0].Operation != krud.AUDIT_OP_CREATE {
+		t.Fatalf("expected only the create event before flushing but got: %v", events)
+	}
+
+	if err := aw.Close(context.Background()); err != nil {
+		t.Fatalf("close audit writer: %v", err)
+	}
+	events, err = adb.QueryEvents(context.Background())
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	// Authorization, the create and 3 reads.
+	if len(events) != 5 {
+		t.Errorf("expected 5 events after flushing but got: %v", events)
+	}
+}
+
+func TestVerifyEventsFindsTampering(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	log, _ := test.NewNullLogger()
+	aw := krud.NewAuditWriter(log, pdb)
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER, krud.WithAuditWriter(aw))
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	// Events from transactions, bulk inserts and the audit writer all go on the chain.
+	id, err := adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+	_, err = adb.AddAuthors(context.Background(), []krud.Author{
+		{Name: "a", DateOfBirth: MakeDate(t, "1900-01-01")},
+		{Name: "b", DateOfBirth: MakeDate(t, "1900-01-01")},
+	}, krud.BulkAtomic)
+	if err != nil {
+		t.Fatalf("add authors: %v", err)
+	}
+	if _, err := adb.GetAuthor(context.Background(), id); err != nil {
+		t.Fatalf("get author: %v", err)
+	}
+	if err := aw.Close(context.Background()); err != nil {
+		t.Fatalf("close audit writer: %v", err)
+	}
+
+	v, err := krud.VerifyChain(context.Background(), pdb)
+	if err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	// Authorization, the create, 2 bulk creates and the read.
+	if !v.OK || v.Checked != 5 {
+		t.Fatalf("expected 5 linked events but got: %+v", v)
+	}
+
+	_, err = pdb.Exec("UPDATE events SET username = 'miles' WHERE seq = 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = krud.VerifyChain(context.Background(), pdb)
+	if err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	if v.OK || v.Broken == nil || v.Broken.Seq != 3 {
+		t.Errorf("expected chain to break at event 3 but got: %+v", v)
+	}
+
+	// Tenants are only told whether the chain holds.
+	v, err = adb.VerifyEvents(context.Background())
+	if err != nil {
+		t.Fatalf("verify events: %v", err)
+	}
+	if v.OK || v.Checked != 0 || v.Broken != nil {
+		t.Errorf("expected only a broken chain but got: %+v", v)
+	}
+}
+
+func TestVerifyChainHashesTenant(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	// Authorization, in the default tenant.
+	if _, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER); err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	_, err := pdb.Exec("UPDATE events SET tenant_id = NULL WHERE seq = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := krud.VerifyChain(context.Background(), pdb)
+	if err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	if v.OK || v.Broken == nil || v.Broken.Seq != 1 {
+		t.Errorf("expected no tenant to hash apart from the default one but got: %+v", v)
+	}
+}
+
+func TestStreamedListDoesNotBlockWrites(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	ctx := context.Background()
+	adb, err := krud.NewAuditDB(ctx, pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	if _, err := adb.AddAuthor(ctx, krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")}); err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	// A client taking its time with the list.
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- adb.EachAuthor(ctx, func(krud.Author) error {
+			close(reading)
+			<-release
+			return nil
+		})
+	}()
+	<-reading
+	defer func() {
+		close(release)
+		if err := <-done; err != nil {
+			t.Errorf("each author: %v", err)
+		}
+	}()
+
+	// Writes events, so it needs the tail of the chain.
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := adb.AddAuthor(wctx, krud.Author{Name: "another", DateOfBirth: MakeDate(t, "1900-01-01")}); err != nil {
+		t.Errorf("expected a write while the list is open but got: %v", err)
+	}
+}
+
+func TestArchiveEventsKeepsChain(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	now := time.Now().UTC()
+	if err := krud.EnsureEventPartitions(context.Background(), pdb, now); err != nil {
+		t.Fatalf("ensure partitions: %v", err)
+	}
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	_, err = adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	// Everything up to and including this month.
+	dir := t.TempDir()
+	cutoff := krud.RetentionCutoff(now, -1)
+	archived, err := krud.ArchiveEvents(context.Background(), pdb, dir, cutoff)
+	if err != nil {
+		t.Fatalf("archive events: %v", err)
+	}
+	// Authorization and the create.
+	if len(archived) != 1 || archived[0].Events != 2 {
+		t.Fatalf("expected 2 events archived from this month but got: %+v", archived)
+	}
+
+	f, err := os.Open(filepath.Join(dir, now.Format("events_2006_01")+".ndjson.gz"))
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gunzip archive: %v", err)
+	}
+	lines := 0
+	for sc := bufio.NewScanner(gz); sc.Scan(); {
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines in archive but got: %d", lines)
+	}
+
+	events, err := adb.QueryEvents(context.Background())
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected no events left but got: %v", events)
+	}
+
+	// The chain carries on from the archive.
+	_, err = adb.AddAuthor(context.Background(), krud.Author{Name: "another", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+	v, err := krud.VerifyChain(context.Background(), pdb)
+	if err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	if !v.OK || v.Checked != 1 {
+		t.Errorf("expected 1 linked event after the archive but got: %+v", v)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	type delivery struct {
+		body      []byte
+		signature string
+		event     string
+	}
+	received := make(chan delivery, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- delivery{body, r.Header.Get(krud.WebhookSignatureHeader), r.Header.Get(krud.WebhookEventHeader)}
+	}))
+	defer srv.Close()
+
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	hook, err := adb.AddWebhook(context.Background(), krud.Webhook{URL: srv.URL, Secret: "s3cret", Types: []string{"authors"}, Active: true})
+	if err != nil {
+		t.Fatalf("add webhook: %v", err)
+	}
+	id, err := adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	log, _ := test.NewNullLogger()
+	// The test server is on loopback, which the default client refuses.
+	n, err := krud.NewWebhookDispatcher(log, pdb, krud.WithWebhookClient(srv.Client())).Dispatch(context.Background())
+	if err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 message dispatched but got: %d", n)
+	}
+
+	d := <-received
+	if err := krud.VerifyWebhook("s3cret", d.signature, d.body, time.Now(), time.Minute); err != nil {
+		t.Errorf("verify delivery: %v", err)
+	}
+	var p krud.WebhookPayload
+	if err := json.Unmarshal(d.body, &p); err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	if d.event != "authors.create" || p.Type != "authors.create" || p.ObjectID == nil || *p.ObjectID != id {
+		t.Errorf("expected the create of author %d but got: %s %+v", id, d.event, p)
+	}
+
+	var states []string
+	err = adb.EachWebhookMessage(context.Background(), hook.ID, "", func(m krud.WebhookMessage) error {
+		states = append(states, m.State)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("webhook messages: %v", err)
+	}
+	if !reflect.DeepEqual(states, []string{krud.WebhookDelivered}) {
+		t.Errorf("expected a delivered message but got: %v", states)
+	}
+}
+
+func TestWebhookDeadThenRetry(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	hook, err := adb.AddWebhook(context.Background(), krud.Webhook{URL: srv.URL, Secret: "s3cret", Active: true})
+	if err != nil {
+		t.Fatalf("add webhook: %v", err)
+	}
+	_, err = adb.AddAuthor(context.Background(), krud.Author{Name: "author", DateOfBirth: MakeDate(t, "1900-01-01")})
+	if err != nil {
+		t.Fatalf("add author: %v", err)
+	}
+
+	log, _ := test.NewNullLogger()
+	wd := krud.NewWebhookDispatcher(log, pdb, krud.WithWebhookClient(srv.Client()), krud.WithWebhookRetry(1, 0))
+	if _, err := wd.Dispatch(context.Background()); err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+
+	var dead []krud.WebhookMessage
+	err = adb.EachWebhookMessage(context.Background(), hook.ID, krud.WebhookDead, func(m krud.WebhookMessage) error {
+		dead = append(dead, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("webhook messages: %v", err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 1 {
+		t.Fatalf("expected a dead message after 1 attempt but got: %+v", dead)
+	}
+
+	var deliveries []krud.WebhookDelivery
+	err = adb.EachWebhookDelivery(context.Background(), hook.ID, func(d krud.WebhookDelivery) error {
+		deliveries = append(deliveries, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("webhook deliveries: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status == nil || *deliveries[0].Status != http.StatusServiceUnavailable {
+		t.Errorf("expected a failed delivery but got: %+v", deliveries)
+	}
+
+	if err := adb.RetryWebhookMessage(context.Background(), hook.ID, dead[0].ID); err != nil {
+		t.Fatalf("retry message: %v", err)
+	}
+	// Only dead messages can be retried.
+	err = adb.RetryWebhookMessage(context.Background(), hook.ID, dead[0].ID)
+	if !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected a pending message not to be retried but got: %v", err)
+	}
+	n, err := wd.Dispatch(context.Background())
+	if err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected the retried message to be dispatched but got: %d", n)
+	}
+}
+
+func TestBooksOfAndEventsOn(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+
+	adb, err := krud.NewAuditDB(context.Background(), pdb, TEST_USER)
+	if err != nil {
+		t.Fatalf("helper opening db: %v", err)
+	}
+	var authors []int64
+	for _, name := range []string{"first", "second", "third"} {
+		id, err := adb.AddAuthor(context.Background(), krud.Author{Name: name, DateOfBirth: MakeDate(t, "1900-01-01")})
+		if err != nil {
+			t.Fatalf("add author: %v", err)
+		}
+		authors = append(authors, id)
+	}
+	for _, a := range []int64{authors[1], authors[0], authors[1]} {
+		_, err := adb.AddBook(context.Background(), a, krud.Book{Title: "book", Published: MakeDate(t, "1950-01-01")})
+		if err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	books, err := adb.BooksOf(context.Background(), authors[:2])
+	if err != nil {
+		t.Fatalf("books of authors: %v", err)
+	}
+	var of []int64
+	for _, b := range books {
+		of = append(of, b.AuthorID)
+	}
+	if !reflect.DeepEqual(of, []int64{authors[0], authors[1], authors[1]}) {
+		t.Errorf("expected books of the first two authors, in order, but got: %+v", books)
+	}
+
+	events, err := adb.QueryEvents(context.Background(), krud.EventsOn("authors", authors[0], authors[2]))
+	if err != nil {
+		t.Fatalf("query events: %v", err)
+	}
+	if len(events) != 2 || *events[0].ID != authors[0] || *events[1].ID != authors[2] {
+		t.Errorf("expected the creates of the first and third author but got: %+v", events)
+	}
+
+	err = adb.UpdateAuthor(context.Background(), krud.Author{ID: authors[0], Name: "first", DateOfBirth: MakeDate(t, "1900-01-02")})
+	if err != nil {
+		t.Fatalf("update author: %v", err)
+	}
+	events, err = adb.QueryEvents(context.Background(),
+		krud.EventsLastOn("authors", 1, authors[0], authors[2]), krud.EventsAfter(time.Now().Add(-time.Hour)))
+	if err != nil {
+		t.Fatalf("query last events: %v", err)
+	}
+	if len(events) != 2 || events[0].Operation != krud.AUDIT_OP_CREATE || *events[0].ID != authors[2] ||
+		events[1].Operation != krud.AUDIT_OP_UPDATE || *events[1].ID != authors[0] {
+		t.Errorf("expected the create of the third author and the update of the first but got: %+v", events)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+	ctx := context.Background()
+
+	err := krud.AddUser(ctx, pdb, "admin", "penguin", "ada")
+	if err != nil {
+		t.Fatalf("add user: %v", err)
+	}
+	err = krud.AddUser(ctx, pdb, "admin", krud.DefaultTenant, "ada")
+	if !errors.Is(err, krud.ErrConflict) {
+		t.Errorf("expected adding a user twice to conflict but got: %v", err)
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		t.Errorf("expected the driver error in the chain but got: %v", err)
+	}
+	if p := krud.NewProblem(err); p.Field != "name" || strings.Contains(p.Detail, "users_pkey") {
+		t.Errorf("expected a problem without the constraint but got: %+v", p)
+	}
+	// Now allowed in.
+	if _, err := krud.NewAuditDB(ctx, pdb, "ada"); err != nil {
+		t.Fatalf("expected a new user to be authorized but got: %v", err)
+	}
+
+	users, err := krud.ListUsers(ctx, pdb)
+	if err != nil {
+		t.Fatalf("list users: %v", err)
+	}
+	if fmt.Sprint(users) != "[{ada penguin} {bill default} {john default} {miles default}]" {
+		t.Errorf("unexpected users: %v", users)
+	}
+
+	if err := krud.RemoveUser(ctx, pdb, "admin", "ada"); err != nil {
+		t.Fatalf("remove user: %v", err)
+	}
+	err = krud.RemoveUser(ctx, pdb, "admin", "ada")
+	if !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected removing a missing user to fail but got: %v", err)
+	}
+	if _, err := krud.NewAuditDB(ctx, pdb, "ada"); !errors.Is(err, krud.ErrUnauthorized) {
+		t.Errorf("expected a removed user to be unauthorized but got: %v", err)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+	ctx := context.Background()
+
+	if err := krud.AddUser(ctx, pdb, "admin", "penguin", "ada"); err != nil {
+		t.Fatal(err)
+	}
+	bill, err := krud.NewAuditDB(ctx, pdb, TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ada, err := krud.NewAuditDB(ctx, pdb, "ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	billsAuthor, err := bill.AddAuthor(ctx, krud.Author{Name: "Bill", DateOfBirth: MakeDate(t, "1950-01-01")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adasAuthor, err := ada.AddAuthor(ctx, krud.Author{Name: "Ada", DateOfBirth: MakeDate(t, "1815-12-10")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ada.GetAuthor(ctx, billsAuthor); !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected the author of another tenant to be missing but got: %v", err)
+	}
+	authors, err := ada.AllAuthors(ctx)
+	if err != nil || len(authors) != 1 || authors[0].ID != adasAuthor {
+		t.Errorf("expected only the author of the tenant but got: %v, %v", authors, err)
+	}
+	_, err = ada.AddBook(ctx, billsAuthor, krud.Book{Title: "Notes", Published: MakeDate(t, "1843-09-01")})
+	if !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected a book of an author of another tenant to fail but got: %v", err)
+	}
+	events, err := ada.QueryEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		if e.User == TEST_USER {
+			t.Errorf("expected only events of the tenant but got: %+v", e)
+		}
+	}
+
+	// Mistakes in SQL are held to the tenant too.
+	tx, err := pdb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT set_config('krud.tenant', 'penguin', true)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("SET LOCAL ROLE krud_tenant"); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM authors").Scan(&n); err != nil || n != 1 {
+		t.Errorf("expected to see one author but got: %d, %v", n, err)
+	}
+	if _, err := tx.Exec("SAVEPOINT s"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE authors SET tenant_id = 'default'"); err == nil {
+		t.Errorf("expected moving rows to another tenant to fail")
+	}
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT s"); err != nil {
+		t.Fatal(err)
+	}
+	// Nor can a tenant rewrite the chain, which runs through every tenant.
+	for _, q := range []string{
+		"SELECT * FROM event_chain",
+		"UPDATE event_chain SET hash = ''",
+		"UPDATE events SET username = 'miles'",
+		"DELETE FROM events",
+		"SELECT advance_event_chain(1)",
+	} {
+		if _, err := tx.Exec(q); err == nil {
+			t.Errorf("expected %q to fail", q)
+		}
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT s"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Exec("SELECT * FROM events_default"); err == nil {
+		t.Errorf("expected partitions of events to be out of reach")
+	}
+
+	// The chain runs through both tenants.
+	v, err := krud.VerifyChain(ctx, pdb)
+	if err != nil || !v.OK {
+		t.Errorf("expected a whole chain but got: %+v, %v", v, err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	pdb, closer := CleanDatabase(t)
+	defer closer()
+	ctx := context.Background()
+	adb, err := krud.NewAuditDB(ctx, pdb, TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := krud.IdempotencyKey{Key: "abc", RequestHash: "1", TTL: time.Hour}
+	author := krud.Author{Name: "Ada", DateOfBirth: MakeDate(t, "1815-12-10")}
+	if _, err := adb.AddAuthor(krud.WithIdempotencyKey(ctx, key), author); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := adb.IdempotentResponse(ctx, key.Key, key.TTL); err != nil || resp.RequestHash != "1" {
+		t.Errorf("expected the stored response but got: %+v, %v", resp, err)
+	}
+	// Only the first create with a key stores it.
+	if _, err := adb.AddAuthor(krud.WithIdempotencyKey(ctx, key), author); !errors.Is(err, krud.ErrConflict) {
+		t.Errorf("expected a key in use to conflict but got: %v", err)
+	}
+
+	if n, err := krud.SweepIdempotencyKeys(ctx, pdb, time.Hour); err != nil || n != 0 {
+		t.Errorf("expected nothing expired but got: %d, %v", n, err)
+	}
+	if n, err := krud.SweepIdempotencyKeys(ctx, pdb, 0); err != nil || n != 1 {
+		t.Errorf("expected the key expired but got: %d, %v", n, err)
+	}
+	if _, err := adb.IdempotentResponse(ctx, key.Key, key.TTL); !errors.Is(err, krud.ErrDoesNotExist) {
+		t.Errorf("expected the key gone but got: %v", err)
+	}
+}
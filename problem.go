@@ -0,0 +1,52 @@
+package krud
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+// NewProblem classifies err into a Problem.
+// Errors which are not domain errors are internal, and their details are not exposed.
+func NewProblem(err error) Problem {
+	p := krudapi.ProblemOf(err)
+	if p.Code == CodeInternal {
+		return p
+	}
+	p.Detail = publicDetail(err)
+	var ve *ValidationError
+	var de *dbError
+	if errors.As(err, &ve) {
+		p.Field = ve.Field
+	} else if errors.As(err, &de) {
+		p.Field = de.field
+	}
+	return p
+}
+
+// WriteProblem writes p as application/problem+json.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", MediaProblem)
+	w.WriteHeader(p.Status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	err := enc.Encode(p)
+	if err != nil {
+		// Headers are already out, nothing left to tell the client.
+		return
+	}
+}
+
+// writeError is the single place where handlers turn an error into a response.
+func (api *Controller) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := NewProblem(err)
+	p.Instance = r.URL.Path
+	p.RequestID = RequestIDFrom(r.Context())
+	if p.Status == http.StatusInternalServerError {
+		LoggerFrom(r.Context()).Errorf("request %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	WriteProblem(w, p)
+}
@@ -0,0 +1,417 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rate limits keep one misbehaving script from hammering the database, every request writes
+// an event after all. Each user has a token bucket per route template, holding up to the
+// requests of a Quota and refilling evenly over its period. Buckets are kept in a
+// RateLimitStore, in memory for a single server or in PostgreSQL to share them between replicas.
+// Users are only known once the database has authorized them. Requests it turns away take from
+// one bucket shared by every unknown caller, and past it get 429 rather than 401 so that scripts
+// with a wrong name back off. They have asked the database all the same, and nobody the database
+// knows is ever held to that bucket, however many callers share an address.
+
+// DefaultRateLimitSweep is how often buckets that are full again are forgotten.
+const DefaultRateLimitSweep = time.Minute
+
+// DefaultUnauthorizedQuota is how many requests the database may turn away before they get 429.
+var DefaultUnauthorizedQuota = Quota{Requests: 30, Per: time.Minute}
+
+// DefaultMaxRateLimitBuckets caps the buckets of a MemoryRateLimitStore.
+const DefaultMaxRateLimitBuckets = 100000
+
+// Quota is Requests per Per. The zero Quota does not limit anything.
+type Quota struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseQuota reads a Quota written like "100/1m", or "none" for the zero Quota.
+func ParseQuota(s string) (Quota, error) {
+	if s == "none" {
+		return Quota{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Quota{}, fmt.Errorf("expected requests/period but got: '%s'", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 1 {
+		return Quota{}, fmt.Errorf("quota requests must be a positive number: '%s'", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return Quota{}, fmt.Errorf("quota period must be a positive duration: '%s'", s)
+	}
+	return Quota{Requests: n, Per: per}, nil
+}
+
+func (q Quota) String() string {
+	if q.Requests == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d/%s", q.Requests, q.Per)
+}
+
+// RateLimitResult is what taking a token from a bucket left behind.
+type RateLimitResult struct {
+	// Allowed if there was a token to take.
+	Allowed bool
+	// Remaining whole tokens in the bucket.
+	Remaining int
+	// RetryAfter is how long until there is a token, when not allowed.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// takeToken refills a bucket which had tokens at updated, up until now, and takes a token if there is one.
+// Returns the tokens left.
+func takeToken(q Quota, tokens float64, updated, now time.Time) (float64, RateLimitResult) {
+	// Tokens per second.
+	rate := float64(q.Requests) / q.Per.Seconds()
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens += elapsed * rate
+	}
+	tokens = math.Min(tokens, float64(q.Requests))
+
+	var res RateLimitResult
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - tokens) / rate)
+	}
+	res.Remaining = int(tokens)
+	res.Reset = seconds((float64(q.Requests) - tokens) / rate)
+	return tokens, res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RateLimitStore keeps token buckets by key.
+type RateLimitStore interface {
+	// Take takes a token from the bucket of key, which holds quota q.
+	// A key not seen before has a full bucket.
+	Take(ctx context.Context, key string, q Quota) (RateLimitResult, error)
+	// Sweep forgets buckets that are full again, they are no different from new ones.
+	Sweep(ctx context.Context) error
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket has refilled.
+	full time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in memory, for a single server.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	max     int
+}
+
+// NewMemoryRateLimitStore has no buckets to begin with, and keeps at most maxBuckets.
+// Beyond that, the bucket closest to full is forgotten to make room.
+func NewMemoryRateLimitStore(maxBuckets int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*bucket{}, max: maxBuckets}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, q Quota) (RateLimitResult, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= s.max {
+			s.evict(now)
+		}
+		b = &bucket{tokens: float64(q.Requests), updated: now}
+		s.buckets[key] = b
+	}
+	var res RateLimitResult
+	b.tokens, res = takeToken(q, b.tokens, b.updated, now)
+	b.updated = now
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+func (s *MemoryRateLimitStore) Sweep(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+	return nil
+}
+
+// sweep forgets buckets full before now. The lock must be held.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.full.Before(now) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// evict makes room for a bucket, forgetting those full again or else the one closest to full.
+// The lock must be held.
+func (s *MemoryRateLimitStore) evict(now time.Time) {
+	s.sweep(now)
+	if len(s.buckets) < s.max {
+		return
+	}
+	var closest string
+	var full time.Time
+	for key, b := range s.buckets {
+		if closest == "" || b.full.Before(full) {
+			closest, full = key, b.full
+		}
+	}
+	delete(s.buckets, closest)
+}
+
+// PostgresRateLimitStore keeps buckets in the rate_limits table, shared by every server using db.
+// Time is taken from the database, so that servers with clocks apart agree.
+type PostgresRateLimitStore struct {
+	db *sql.DB
+}
+
+// NewPostgresRateLimitStore keeps buckets in db.
+func NewPostgresRateLimitStore(db *sql.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db: db}
+}
+
+func (s *PostgresRateLimitStore) Take(ctx context.Context, key string, q Quota) (res RateLimitResult, err error) {
+	defer observe(ctx, "TakeRateLimit", time.Now(), &err)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// A full bucket to lock, for the first request of key.
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO rate_limits (key, tokens, updated, full_at)
+         VALUES ($1, $2, clock_timestamp(), clock_timestamp())
+         ON CONFLICT (key) DO NOTHING`,
+		key, q.Requests)
+	if err != nil {
+		return res, fmt.Errorf("insert bucket: %w", err)
+	}
+	var tokens float64
+	var updated, now time.Time
+	err = tx.QueryRowContext(ctx,
+		"SELECT tokens, updated, clock_timestamp() FROM rate_limits WHERE key = $1 FOR UPDATE",
+		key).Scan(&tokens, &updated, &now)
+	if err != nil {
+		return res, fmt.Errorf("select bucket: %w", err)
+	}
+
+	tokens, res = takeToken(q, tokens, updated, now)
+	_, err = tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = $2, updated = $3, full_at = $4 WHERE key = $1",
+		key, tokens, now, now.Add(res.Reset))
+	if err != nil {
+		return res, fmt.Errorf("update bucket: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return res, fmt.Errorf("commit: %w", err)
+	}
+	return res, nil
+}
+
+func (s *PostgresRateLimitStore) Sweep(ctx context.Context) (err error) {
+	defer observe(ctx, "SweepRateLimits", time.Now(), &err)
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM rate_limits WHERE full_at < clock_timestamp()"); err != nil {
+		return fmt.Errorf("delete full buckets: %w", err)
+	}
+	return nil
+}
+
+// RateLimiter gives every user a Quota per route template, and unauthorized requests one together.
+type RateLimiter struct {
+	log   *log.Logger
+	store RateLimitStore
+	quota Quota
+	// routes have a quota of their own, by route template.
+	routes map[string]Quota
+	// unauthorized is the quota of requests the database turned away, whoever made them.
+	unauthorized Quota
+	sweep        time.Duration
+}
+
+// RateLimitOption configures optional parts of a RateLimiter.
+type RateLimitOption func(*RateLimiter)
+
+// WithRouteQuota gives the route with template route, like "/api/authors", a quota of its own.
+// Templates are as mux has them, like the route label of the HTTP metrics.
+func WithRouteQuota(route string, q Quota) RateLimitOption {
+	return func(rl *RateLimiter) {
+		rl.routes[route] = q
+	}
+}
+
+// WithUnauthorizedQuota sets how many requests the database may turn away before they get 429,
+// DefaultUnauthorizedQuota if not set. The zero Quota answers every one of them 401.
+func WithUnauthorizedQuota(q Quota) RateLimitOption {
+	return func(rl *RateLimiter) {
+		rl.unauthorized = q
+	}
+}
+
+// WithRateLimitSweep sets how often buckets which are full again are forgotten.
+func WithRateLimitSweep(interval time.Duration) RateLimitOption {
+	return func(rl *RateLimiter) {
+		rl.sweep = interval
+	}
+}
+
+// NewRateLimiter limits every route to quota, unless given one of its own, with buckets in store.
+func NewRateLimiter(log *log.Logger, store RateLimitStore, quota Quota, opts ...RateLimitOption) *RateLimiter {
+	rl := &RateLimiter{
+		log:          log,
+		store:        store,
+		quota:        quota,
+		routes:       map[string]Quota{},
+		unauthorized: DefaultUnauthorizedQuota,
+		sweep:        DefaultRateLimitSweep,
+	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	return rl
+}
+
+// QuotaOf is the quota of the route with template route.
+func (rl *RateLimiter) QuotaOf(route string) Quota {
+	if q, ok := rl.routes[route]; ok {
+		return q
+	}
+	return rl.quota
+}
+
+// Take takes a token for user at route, and tells the quota it was taken from.
+func (rl *RateLimiter) Take(ctx context.Context, user, route string) (Quota, RateLimitResult, error) {
+	q := rl.QuotaOf(route)
+	if q.Requests == 0 {
+		return q, RateLimitResult{Allowed: true}, nil
+	}
+	// Neither user names nor route templates have spaces.
+	res, err := rl.store.Take(ctx, user+" "+route, q)
+	return q, res, err
+}
+
+// TakeUnauthorized takes a token for a request the database turned away.
+// It is only ever taken after the database is asked, so it never holds up a known user.
+func (rl *RateLimiter) TakeUnauthorized(ctx context.Context) (Quota, RateLimitResult, error) {
+	q := rl.unauthorized
+	if q.Requests == 0 {
+		return q, RateLimitResult{Allowed: true}, nil
+	}
+	res, err := rl.store.Take(ctx, unauthorizedKey, q)
+	return q, res, err
+}
+
+// unauthorizedKey is the bucket of unauthorized requests, apart from those of users which have a space.
+const unauthorizedKey = "unauthorized"
+
+// Run sweeps the store until ctx is done.
+func (rl *RateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(rl.sweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := rl.store.Sweep(ctx); err != nil && ctx.Err() == nil {
+			rl.log.Errorf("sweep rate limits: %v", err)
+		}
+	}
+}
+
+// WithRateLimiter limits how often each user may call each route, see RateLimitMiddleware,
+// and how often the database may turn requests away before they get 429, see AuthMiddleware.
+func WithRateLimiter(rl *RateLimiter) ControllerOption {
+	return func(c *Controller) {
+		c.limiter = rl
+	}
+}
+
+// RateLimitMiddleware takes a token for the user making the request, from the bucket of its route,
+// and responds 429 Too Many Requests when there is none. It goes after AuthMiddleware, so the user
+// is one the database knows, and another name in the header does not get another bucket.
+// Responses tell the quota in RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers,
+// the latter in seconds until the bucket is full, and when to try again in Retry-After.
+// Requests go through if the store fails, a limit is not worth an outage.
+func (api *Controller) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeOf(r)
+		q, res, err := api.limiter.Take(r.Context(), api.principal(r), route)
+		if !api.limited(w, r, route, q, res, err) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// limited tells if r is over quota q, after taking res from its bucket, and if so has responded
+// 429 Too Many Requests. Either way w has the RateLimit headers, unless q does not limit anything.
+func (api Controller) limited(w http.ResponseWriter, r *http.Request, route string, q Quota, res RateLimitResult, err error) bool {
+	if err != nil {
+		LoggerFrom(r.Context()).Errorf("rate limit: %v", err)
+		return false
+	}
+	if q.Requests == 0 {
+		return false
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(q.Requests))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if res.Allowed {
+		return false
+	}
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	httpRateLimited.WithLabelValues(route).Inc()
+	api.writeError(w, r, fmt.Errorf("more than %s requests to %s: %w", q, route, ErrRateLimited))
+	return true
+}
+
+// routeOf is the template of the route of r, like the route label of the HTTP metrics.
+func routeOf(r *http.Request) string {
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if tmpl, err := cr.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// ceilSeconds is d in whole seconds, rounded up so that clients do not come back too early.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
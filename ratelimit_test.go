@@ -0,0 +1,196 @@
+package krud_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/vikblom/krud"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		in    string
+		quota krud.Quota
+		ok    bool
+	}{
+		{"100/1m", krud.Quota{Requests: 100, Per: time.Minute}, true},
+		{"1/500ms", krud.Quota{Requests: 1, Per: 500 * time.Millisecond}, true},
+		{"none", krud.Quota{}, true},
+		{"100", krud.Quota{}, false},
+		{"0/1m", krud.Quota{}, false},
+		{"10/0s", krud.Quota{}, false},
+		{"10/minute", krud.Quota{}, false},
+	}
+	for _, tt := range tests {
+		q, err := krud.ParseQuota(tt.in)
+		if (err == nil) != tt.ok || q != tt.quota {
+			t.Errorf("%s: expected %v (ok: %v) but got: %v, %v", tt.in, tt.quota, tt.ok, q, err)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	limiter := krud.NewRateLimiter(log, krud.NewMemoryRateLimitStore(krud.DefaultMaxRateLimitBuckets), krud.Quota{Requests: 2, Per: time.Hour},
+		krud.WithRouteQuota("/authors/{authorID:[0-9]+}", krud.Quota{}))
+	r := mux.NewRouter()
+	krud.NewController(log, r, EmptyMock(), krud.WithRateLimiter(limiter))
+
+	get := func(user, path string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("user", user)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	for _, remaining := range []string{"1", "0"} {
+		resp := get("alice", "/authors")
+		checkStatusCode(t, resp, http.StatusOK)
+		if resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != remaining {
+			t.Errorf("expected limit 2 with %s remaining but got: %v", remaining, resp.Header)
+		}
+	}
+
+	resp := get("alice", "/authors")
+	checkStatusCode(t, resp, http.StatusTooManyRequests)
+	if resp.Header.Get("Retry-After") == "" || resp.Header.Get("RateLimit-Reset") == "" {
+		t.Errorf("expected when to come back but got: %v", resp.Header)
+	}
+	var p krud.Problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil || p.Code != krud.CodeRateLimited {
+		t.Errorf("expected a rate limited problem but got: %+v, %v", p, err)
+	}
+
+	// Other users and other routes have buckets of their own.
+	checkStatusCode(t, get("bob", "/authors"), http.StatusOK)
+	resp = get("alice", "/authors/1")
+	checkStatusCode(t, resp, http.StatusNotFound)
+	if resp.Header.Get("RateLimit-Limit") != "" {
+		t.Errorf("expected an unlimited route but got: %v", resp.Header)
+	}
+}
+
+func TestRateLimitUnauthorized(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	limiter := krud.NewRateLimiter(log, krud.NewMemoryRateLimitStore(krud.DefaultMaxRateLimitBuckets),
+		krud.Quota{Requests: 10, Per: time.Hour}, krud.WithUnauthorizedQuota(krud.Quota{Requests: 2, Per: time.Hour}))
+	dials := 0
+	dial := func(ctx context.Context, user string) (krud.Databaser, error) {
+		dials++
+		if user != "alice" {
+			return nil, krud.ErrUnauthorized
+		}
+		return EmptyMock(), nil
+	}
+	r := mux.NewRouter()
+	krud.NewController(log, r, krud.DialFunc(dial), krud.WithRateLimiter(limiter))
+
+	// Like every caller behind a load balancer, from the same address.
+	get := func(user string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/authors", nil)
+		req.Header.Set("user", user)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// Another name does not get another bucket, unknown callers share one.
+	checkStatusCode(t, get("mallory"), http.StatusUnauthorized)
+	checkStatusCode(t, get("eve"), http.StatusUnauthorized)
+	resp := get("trudy")
+	checkStatusCode(t, resp, http.StatusTooManyRequests)
+	if resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected when to come back but got: %v", resp.Header)
+	}
+
+	// Users the database knows are never held to it.
+	resp = get("alice")
+	checkStatusCode(t, resp, http.StatusOK)
+	if resp.Header.Get("RateLimit-Limit") != "10" || resp.Header.Get("RateLimit-Remaining") != "9" {
+		t.Errorf("expected the quota of alice but got: %v", resp.Header)
+	}
+	if dials != 4 {
+		t.Errorf("expected the database asked about every request but got: %d", dials)
+	}
+}
+
+func TestMemoryRateLimitStoreCapped(t *testing.T) {
+	ctx := context.Background()
+	store := krud.NewMemoryRateLimitStore(2)
+	q := krud.Quota{Requests: 1, Per: time.Hour}
+
+	for _, key := range []string{"alice", "bob", "carol"} {
+		if res, err := store.Take(ctx, key, q); err != nil || !res.Allowed {
+			t.Fatalf("expected a token for %s but got: %+v, %v", key, res, err)
+		}
+	}
+	// Forgotten to make room for carol, being the closest to full.
+	if res, err := store.Take(ctx, "bob", q); err != nil || res.Allowed {
+		t.Errorf("expected bob kept but got: %+v, %v", res, err)
+	}
+	if res, err := store.Take(ctx, "alice", q); err != nil || !res.Allowed {
+		t.Errorf("expected alice forgotten but got: %+v, %v", res, err)
+	}
+}
+
+func TestMemoryRateLimitStoreRefills(t *testing.T) {
+	ctx := context.Background()
+	store := krud.NewMemoryRateLimitStore(krud.DefaultMaxRateLimitBuckets)
+	q := krud.Quota{Requests: 2, Per: 100 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		if res, err := store.Take(ctx, "alice", q); err != nil || !res.Allowed {
+			t.Fatalf("expected request %d allowed but got: %+v, %v", i, res, err)
+		}
+	}
+	res, err := store.Take(ctx, "alice", q)
+	if err != nil || res.Allowed || res.RetryAfter <= 0 || res.RetryAfter > 50*time.Millisecond {
+		t.Fatalf("expected to wait for a token but got: %+v, %v", res, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if res, err := store.Take(ctx, "alice", q); err != nil || !res.Allowed {
+		t.Errorf("expected a token refilled but got: %+v, %v", res, err)
+	}
+	if err := store.Sweep(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresRateLimitStore(t *testing.T) {
+	db, cleanup := CleanDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	store := krud.NewPostgresRateLimitStore(db)
+	q := krud.Quota{Requests: 2, Per: time.Hour}
+
+	for i := 0; i < 2; i++ {
+		if res, err := store.Take(ctx, "alice /authors", q); err != nil || !res.Allowed {
+			t.Fatalf("expected request %d allowed but got: %+v, %v", i, res, err)
+		}
+	}
+	res, err := store.Take(ctx, "alice /authors", q)
+	if err != nil || res.Allowed || res.Remaining != 0 || res.RetryAfter <= 0 {
+		t.Errorf("expected to wait for a token but got: %+v, %v", res, err)
+	}
+	if res, err := store.Take(ctx, "bob /authors", q); err != nil || !res.Allowed || res.Remaining != 1 {
+		t.Errorf("expected a bucket of its own but got: %+v, %v", res, err)
+	}
+
+	// Neither bucket is full, so they are kept.
+	if err := store.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := store.Take(ctx, "alice /authors", q); err != nil || res.Allowed {
+		t.Errorf("expected the bucket to outlive a sweep but got: %+v, %v", res, err)
+	}
+}
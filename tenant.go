@@ -0,0 +1,33 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Tenants share a database, each user belongs to one of them and sees only its rows.
+// Transactions of AuditDB switch to tenantRole with the tenant of the user in the
+// krud.tenant setting, and row level security on every table with a tenant_id keeps
+// them to rows of that tenant, whatever the SQL. Rows inserted take the tenant from
+// the setting. Tenants only insert events, and lock and advance the tail of the chain
+// through functions running as the owner, see linkEvents. Whoever connects, usually the
+// owner of the tables, is not restricted: that is how the chain of events is verified
+// and archived and how webhooks are sent.
+
+// DefaultTenant is the tenant of everything from before there were tenants.
+const DefaultTenant = "default"
+
+// tenantRole is the role transactions of a tenant run as, the server has to be able to SET ROLE to it.
+const tenantRole = "krud_tenant"
+
+// setTenant restricts the rest of tx to the rows of tenant.
+func setTenant(ctx context.Context, tx *sql.Tx, tenant string) error {
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('krud.tenant', $1, true)", tenant); err != nil {
+		return fmt.Errorf("set tenant: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE "+tenantRole); err != nil {
+		return fmt.Errorf("set role: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package krud
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates spans through whatever TracerProvider is set globally with otel.
+// Until one is set, spans are no-ops.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/vikblom/krud")
+}
+
+// endSpan ends span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracingMiddleware starts a span per request, as a child of any W3C traceparent header.
+// Spans are named by mux route template, like the metrics.
+func TracingMiddleware(next http.Handler) http.Handler {
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.Path),
+			))
+		defer span.End()
+
+		// Let the caller find the trace.
+		propagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r.WithContext(ctx))
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		span.SetAttributes(attribute.Int("http.status_code", sr.status))
+		if sr.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sr.status))
+		}
+	})
+}
+
+// QueryTracer turns pgx query logs into spans, one per SQL statement.
+// pgx logs once a statement is done, so the span is back dated by how long it took.
+// Set it as the Logger of a pgx.ConnConfig, with LogLevelInfo.
+type QueryTracer struct{}
+
+func (QueryTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	sql, ok := data["sql"].(string)
+	if !ok {
+		return
+	}
+	took, _ := data["time"].(time.Duration)
+	end := time.Now()
+
+	// Args are left out on purpose, they hold user data.
+	_, span := tracer().Start(ctx, "SQL "+msg,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-took)),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.statement", sql),
+		))
+	if level <= pgx.LogLevelError {
+		if err, ok := data["err"].(error); ok {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetStatus(codes.Error, fmt.Sprint(data["err"]))
+		}
+	}
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,106 @@
+package krud_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/vikblom/krud"
+)
+
+// recordSpans sets a global TracerProvider that keeps every span, for the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func TestTracingHonorsTraceparent(t *testing.T) {
+	sr := recordSpans(t)
+
+	r := mux.NewRouter()
+	r.Use(krud.TracingMiddleware)
+	log, _ := test.NewNullLogger()
+	krud.NewController(log, r, MockWithAuthors(t))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/authors/2", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	checkStatusCode(t, w.Result(), http.StatusOK)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span but got: %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /authors/{authorID:[0-9]+}" {
+		t.Errorf("expected span named by route template but got: %s", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != traceID {
+		t.Errorf("expected trace id from traceparent but got: %s", span.SpanContext().TraceID())
+	}
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("expected a server span but got: %s", span.SpanKind())
+	}
+	if tp := w.Result().Header.Get("traceparent"); tp == "" {
+		t.Errorf("expected traceparent in the response")
+	}
+}
+
+func TestQueryTracerBackdatesSpans(t *testing.T) {
+	sr := recordSpans(t)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	krud.QueryTracer{}.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{
+		"sql":  "SELECT 1",
+		"args": []interface{}{"secret"},
+		"time": 2 * time.Second,
+	})
+	krud.QueryTracer{}.Log(ctx, pgx.LogLevelError, "Exec", map[string]interface{}{
+		"sql":  "SELECT broken",
+		"err":  errors.New("syntax error"),
+		"time": time.Millisecond,
+	})
+	// Not about a statement, no span.
+	krud.QueryTracer{}.Log(ctx, pgx.LogLevelInfo, "closed connection", nil)
+	parent.End()
+
+	spans := sr.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 2 statement spans and the parent but got: %d", len(spans))
+	}
+	ok, failed := spans[0], spans[1]
+	if ok.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("expected statement span to be a child of the parent")
+	}
+	if took := ok.EndTime().Sub(ok.StartTime()); took != 2*time.Second {
+		t.Errorf("expected span to last as long as the statement but got: %s", took)
+	}
+	for _, kv := range ok.Attributes() {
+		if kv.Value.Emit() == "secret" {
+			t.Errorf("expected args to be left out but got: %s", kv.Key)
+		}
+	}
+	if failed.Status().Code != codes.Error {
+		t.Errorf("expected failed statement to mark the span as failed but got: %v", failed.Status())
+	}
+}
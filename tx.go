@@ -0,0 +1,262 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PostgreSQL error codes of transient failures, worth retrying the transaction for.
+const (
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// txOp describes a transaction run by AuditDB.
+type txOp struct {
+	// opts are used unless overridden by WithIsolation.
+	opts sql.TxOptions
+	// stream is set for operations that hand rows to a callback as they go,
+	// those cannot be retried since the callback cannot be undone.
+	stream bool
+}
+
+// txOps are the transactions of AuditDB, by the method running them.
+// Unless noted, the default isolation level of the database applies, read committed.
+var txOps = map[string]txOp{
+	"authorize":                {},
+	"AddAuthor":                {},
+	"GetAuthor":                {},
+	"UpdateAuthor":             {},
+	"PatchAuthor":              {},
+	"EachAuthorEvent":          {},
+	"EachAuthor":               {stream: true},
+	"DeleteAuthor":             {},
+	"AddBook":                  {},
+	"GetBook":                  {},
+	"UpdateBook":               {},
+	"PatchBook":                {},
+	"AllBooks":                 {},
+	"EachBookEvent":            {},
+	"EachBook":                 {stream: true},
+	"BooksOf":                  {},
+	"DeleteBook":               {},
+	"AddAuthors":               {},
+	"AddBooks":                 {},
+	"ExportEvent":              {},
+	"AddWebhook":               {},
+	"GetWebhook":               {},
+	"UpdateWebhook":            {},
+	"EachWebhookEvent":         {},
+	"EachWebhook":              {stream: true},
+	"DeleteWebhook":            {},
+	"EachWebhookMessageEvent":  {},
+	"EachWebhookMessage":       {stream: true},
+	"EachWebhookDeliveryEvent": {},
+	"EachWebhookDelivery":      {stream: true},
+	"RetryWebhookMessage":      {},
+	"EachEvent":                {stream: true},
+	"IdempotentResponse":       {},
+	// Repeatable read gives all statements in the transaction the same snapshot.
+	"Export": {opts: sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, stream: true},
+}
+
+// IsTransaction tells if op names a transaction whose isolation level can be set.
+func IsTransaction(op string) bool {
+	_, ok := txOps[op]
+	return ok
+}
+
+// ParseIsolationLevel parses an isolation level like "serializable" or "repeatable-read".
+func ParseIsolationLevel(s string) (sql.IsolationLevel, error) {
+	norm := strings.NewReplacer("-", " ", "_", " ").Replace(strings.ToLower(strings.TrimSpace(s)))
+	for _, level := range []sql.IsolationLevel{
+		sql.LevelDefault,
+		sql.LevelReadUncommitted,
+		sql.LevelReadCommitted,
+		sql.LevelRepeatableRead,
+		sql.LevelSerializable,
+	} {
+		if norm == strings.ToLower(level.String()) {
+			return level, nil
+		}
+	}
+	return sql.LevelDefault, fmt.Errorf("unknown isolation level: '%s'", s)
+}
+
+// AuditDBOption configures optional parts of an AuditDB.
+type AuditDBOption func(*AuditDB)
+
+// WithIsolation runs the transaction of op, see IsTransaction, at level.
+func WithIsolation(op string, level sql.IsolationLevel) AuditDBOption {
+	return func(adb *AuditDB) {
+		if adb.isolation == nil {
+			adb.isolation = map[string]sql.IsolationLevel{}
+		}
+		adb.isolation[op] = level
+	}
+}
+
+// WithRetry makes transactions that fail on serialization failures or deadlocks
+// run again, up to attempts times in all. Retries back off exponentially from backoff.
+func WithRetry(attempts int, backoff time.Duration) AuditDBOption {
+	return func(adb *AuditDB) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		adb.attempts = attempts
+		adb.backoff = backoff
+	}
+}
+
+// Default retry policy of AuditDB, see WithRetry.
+const (
+	DefaultRetryAttempts = 3
+	DefaultRetryBackoff  = 20 * time.Millisecond
+)
+
+// maxRetryBackoff caps the wait between attempts.
+const maxRetryBackoff = time.Second
+
+// retryable tells if err is a transient failure, such that the transaction may succeed if run again.
+func retryable(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return "", false
+	}
+	switch pgErr.Code {
+	case pgSerializationFailure, pgDeadlockDetected:
+		return pgErr.Code, true
+	}
+	return "", false
+}
+
+// retryWait is how long to wait before the attempt after attempt, with full jitter
+// so that transactions that collided do not collide again.
+func retryWait(backoff time.Duration, attempt int) time.Duration {
+	wait := backoff << (attempt - 1)
+	if wait > maxRetryBackoff || wait <= 0 {
+		wait = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(wait) + 1))
+}
+
+// wrapInTransaction create a transaction for action.
+// DB operations in action either happens all together, or not all all.
+// action can be a closure to escape side-effects.
+// action should use the ctx it is given, it carries the span of the transaction.
+// op names the transaction in txOps, deciding its options.
+// On transient failures action is run again, in a new transaction, so it must not
+// leave anything behind from a failed attempt.
+// NOTE: Possibly too "magical".
+func (adb *AuditDB) wrapInTransaction(ctx context.Context, op string, action func(ctx context.Context, tx *sql.Tx) error) (err error) {
+	ctx, span := tracer().Start(ctx, "AuditDB.transaction", trace.WithAttributes(
+		attribute.String("krud.user", adb.user),
+		attribute.String("krud.tenant", adb.tenant),
+		attribute.String("krud.operation", op),
+	))
+	defer func() { endSpan(span, err) }()
+
+	txo := txOps[op]
+	opts := txo.opts
+	if level, ok := adb.isolation[op]; ok {
+		opts.Isolation = level
+	}
+	attempts := adb.attempts
+	if txo.stream || attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = adb.transaction(ctx, &opts, action)
+		code, ok := retryable(err)
+		if !ok || attempt >= attempts {
+			return translate(err)
+		}
+
+		wait := retryWait(adb.backoff, attempt)
+		txRetries.WithLabelValues(op, code).Inc()
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("code", code),
+		))
+		LoggerFrom(ctx).Debugf("retrying %s in %s after: %v", op, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return translate(err)
+		case <-time.After(wait):
+		}
+	}
+}
+
+// transaction runs action in a single transaction.
+func (adb *AuditDB) transaction(ctx context.Context, opts *sql.TxOptions, action func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, hooks := withCommitHooks(ctx)
+	// A transaction must end with a call to Commit or Rollback.
+	tx, err := adb.db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+
+	// Only while authorizing an unknown user is there no tenant.
+	if adb.tenant != "" {
+		err = setTenant(ctx, tx, adb.tenant)
+	}
+	if err == nil {
+		err = action(ctx, tx)
+	}
+	if err != nil {
+		rbErr := tx.Rollback()
+		if rbErr != nil {
+			return fmt.Errorf("rollback failed because '%v' after err: %w", rbErr, err)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return hooks.run()
+}
+
+type contextCommitHooks struct{}
+
+// commitHooks are what to do once a transaction has committed, and not before,
+// like counting its events. Each attempt at a transaction has hooks of its own.
+// A hook failing fails the transaction even though it has committed, so only
+// transactions that change nothing, like reads, should have hooks that can fail.
+type commitHooks []func() error
+
+// withCommitHooks gives the transaction run with ctx hooks, run them once it has committed.
+func withCommitHooks(ctx context.Context) (context.Context, *commitHooks) {
+	hooks := new(commitHooks)
+	return context.WithValue(ctx, contextCommitHooks{}, hooks), hooks
+}
+
+// afterCommit runs fn once the transaction of ctx has committed, right away if there are no hooks in ctx.
+func afterCommit(ctx context.Context, fn func() error) error {
+	if hooks, ok := ctx.Value(contextCommitHooks{}).(*commitHooks); ok {
+		*hooks = append(*hooks, fn)
+		return nil
+	}
+	return fn()
+}
+
+// run runs every hook, returning the first error.
+func (hooks *commitHooks) run() error {
+	var first error
+	for _, fn := range *hooks {
+		if err := fn(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,41 @@
+package krud_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/vikblom/krud"
+)
+
+func TestParseIsolationLevel(t *testing.T) {
+	tests := map[string]sql.IsolationLevel{
+		"serializable":     sql.LevelSerializable,
+		"Repeatable Read":  sql.LevelRepeatableRead,
+		"repeatable-read":  sql.LevelRepeatableRead,
+		"read_committed":   sql.LevelReadCommitted,
+		"read-uncommitted": sql.LevelReadUncommitted,
+		"default":          sql.LevelDefault,
+	}
+	for s, expected := range tests {
+		actual, err := krud.ParseIsolationLevel(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", s, err)
+		}
+		if actual != expected {
+			t.Errorf("%s: expected %s but got: %s", s, expected, actual)
+		}
+	}
+
+	if _, err := krud.ParseIsolationLevel("snapshot"); err == nil {
+		t.Error("expected unknown level to fail")
+	}
+}
+
+func TestIsTransaction(t *testing.T) {
+	if !krud.IsTransaction("UpdateAuthor") {
+		t.Error("expected UpdateAuthor to be a transaction")
+	}
+	if krud.IsTransaction("Nope") {
+		t.Error("expected Nope not to be a transaction")
+	}
+}
@@ -0,0 +1,93 @@
+package krud
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Users are who may use the API, see AuditDB.authorize. They are managed by ops with access
+// to the database rather than through the API, but the changes are audited all the same,
+// as made by admin. Users have no id, so events tell that users changed but not which.
+
+// User may use the API, seeing only the rows of Tenant.
+type User struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+}
+
+// ListUsers is all users, in order of name.
+func ListUsers(ctx context.Context, db *sql.DB) ([]User, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, tenant_id FROM users ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.Name, &u.Tenant); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+	return users, nil
+}
+
+// AddUser lets name use the API within tenant, it is a conflict if they already can.
+// The change is audited as made by admin, which is taken at its word, whoever can reach db can add users.
+// Names are unique across tenants, the tenant of a request follows from who makes it.
+func AddUser(ctx context.Context, db *sql.DB, admin, tenant, name string) error {
+	if strings.TrimSpace(name) == "" {
+		return invalid("name", "name empty")
+	}
+	if strings.TrimSpace(tenant) == "" {
+		return invalid("tenant", "tenant empty")
+	}
+	return changeUsers(ctx, db, admin, AUDIT_OP_CREATE,
+		"INSERT INTO users (name, tenant_id) VALUES ($1, $2) RETURNING tenant_id", name, tenant)
+}
+
+// RemoveUser stops name from using the API, audited as made by admin like AddUser.
+func RemoveUser(ctx context.Context, db *sql.DB, admin, name string) error {
+	return changeUsers(ctx, db, admin, AUDIT_OP_DELETE, "DELETE FROM users WHERE name = $1 RETURNING tenant_id", name)
+}
+
+// changeUsers runs query, returning the tenant of the user changed, and records it as op by admin in that tenant.
+func changeUsers(ctx context.Context, db *sql.DB, admin, op, query string, args ...interface{}) (err error) {
+	if admin == "" {
+		return invalid("admin", "who makes the change is needed for the audit log")
+	}
+	ctx, hooks := withCommitHooks(ctx)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var tenant string
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: user '%s'", ErrDoesNotExist, args[0])
+	}
+	if err != nil {
+		return translate(err)
+	}
+	if err := insertEvent(ctx, tx, tenant, admin, "users", op, nil); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return hooks.run()
+}
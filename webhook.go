@@ -0,0 +1,631 @@
+package krud
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgtype"
+
+	"github.com/vikblom/krud/krudapi"
+)
+
+// Webhooks are notified of changes to authors and books. Changes put messages in an outbox,
+// webhook_messages, in the same transaction, and a WebhookDispatcher delivers them after.
+// A message is tried until delivered or until it runs out of attempts, and is then dead
+// until retried through the API. Every attempt is kept in a log of deliveries.
+
+// validateWebhook is Webhook.Validate, and that the url is not of a host which is known not to be public.
+// Names are checked as they are dialed, see NewWebhookClient, they may resolve differently by then.
+func validateWebhook(h *Webhook) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return invalid("url", "expected an absolute http or https url but got: '%s'", h.URL)
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !publicIP(ip)) || strings.EqualFold(host, "localhost") {
+		return invalid("url", "expected a public host but got: '%s'", host)
+	}
+	return nil
+}
+
+// newWebhookSecret makes a secret for a webhook that was not given one.
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("make secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// enqueueWebhooks puts messages about the changes among links in the outbox of every
+// interested webhook, in tx so that messages exist exactly when the changes do.
+func enqueueWebhooks(ctx context.Context, tx *sql.Tx, links []link) error {
+	var seqs []int64
+	var tenants, objTypes, types, payloads []string
+	for _, l := range links {
+		if l.Operation == AUDIT_OP_READ || !krudapi.WebhookTypes[l.Type] {
+			continue
+		}
+		p := WebhookPayload{
+			Type:     l.Type + "." + strings.ToLower(l.Operation),
+			Event:    l.Seq,
+			When:     l.When,
+			User:     l.User,
+			Object:   l.Type,
+			ObjectID: l.ID,
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("webhook payload: %w", err)
+		}
+		seqs = append(seqs, l.Seq)
+		tenants = append(tenants, l.Tenant)
+		objTypes = append(objTypes, l.Type)
+		types = append(types, p.Type)
+		payloads = append(payloads, string(data))
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	// Only webhooks of the tenant of the event, tx may be one that sees every tenant.
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO webhook_messages (webhook_id, tenant_id, event_seq, type, payload, next_attempt, created)
+         SELECT w.id, w.tenant_id, e.seq, e.type, e.payload, NOW(), NOW()
+         FROM webhooks w
+         JOIN unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[]) AS e (seq, tenant_id, obj_type, type, payload)
+           ON w.tenant_id = e.tenant_id
+         WHERE w.active AND (cardinality(w.types) = 0 OR e.obj_type = ANY (w.types))
+         ORDER BY e.seq, w.id`,
+		seqs, tenants, objTypes, types, payloads)
+	if err != nil {
+		return fmt.Errorf("insert webhook messages: %w", err)
+	}
+	return nil
+}
+
+// AddWebhook stores hook for the user, returning it with its id and when it was created.
+func (adb *AuditDB) AddWebhook(ctx context.Context, hook Webhook) (created *Webhook, err error) {
+	defer observe(ctx, "AddWebhook", time.Now(), &err)
+
+	if hook.Types == nil {
+		hook.Types = []string{}
+	}
+	err = adb.wrapInTransaction(ctx, "AddWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO webhooks (username, url, secret, types, active, created)
+             VALUES ($1, $2, $3, $4, $5, NOW())
+             RETURNING id, created`,
+			adb.user, hook.URL, hook.Secret, hook.Types, hook.Active).Scan(&hook.ID, &hook.Created)
+		if err != nil {
+			return fmt.Errorf("insert webhook: %w", err)
+		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "webhooks", AUDIT_OP_CREATE, &hook.ID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	return &hook, nil
+}
+
+// scanWebhook scans id, url, types, active and created.
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var h Webhook
+	var types pgtype.TextArray
+	if err := row.Scan(&h.ID, &h.URL, &types, &h.Active, &h.Created); err != nil {
+		return h, err
+	}
+	if err := types.AssignTo(&h.Types); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+func (adb *AuditDB) GetWebhook(ctx context.Context, id int64) (hook *Webhook, err error) {
+	defer observe(ctx, "GetWebhook", time.Now(), &err)
+
+	err = adb.wrapInTransaction(ctx, "GetWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		err := adb.readEvent(ctx, tx, "webhooks", &id)
+		if err != nil {
+			return err
+		}
+
+		h, err := scanWebhook(tx.QueryRowContext(ctx,
+			`SELECT id, url, types, active, created
+             FROM webhooks
+             WHERE id = $1 AND username = $2`,
+			id, adb.user))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("scanning row: %w", err)
+		}
+		hook = &h
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transaction: %w", err)
+	}
+	return hook, nil
+}
+
+// UpdateWebhook changes the url, types and active of hook, and its secret unless empty.
+func (adb *AuditDB) UpdateWebhook(ctx context.Context, hook Webhook) (err error) {
+	defer observe(ctx, "UpdateWebhook", time.Now(), &err)
+
+	if hook.Types == nil {
+		hook.Types = []string{}
+	}
+	var n int64
+	err = adb.wrapInTransaction(ctx, "UpdateWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE webhooks
+             SET url = $3, types = $4, active = $5, secret = COALESCE(NULLIF($6, ''), secret)
+             WHERE id = $1 AND username = $2`,
+			hook.ID, adb.user, hook.URL, hook.Types, hook.Active, hook.Secret)
+		if err != nil {
+			return fmt.Errorf("update webhook: %w", err)
+		}
+		n, err = res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("affected rows: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "webhooks", AUDIT_OP_UPDATE, &hook.ID)
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	if n == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+// EachWebhook calls fn for every webhook of the user.
+func (adb *AuditDB) EachWebhook(ctx context.Context, fn func(Webhook) error) (err error) {
+	defer observe(ctx, "EachWebhook", time.Now(), &err)
+
+	if err := adb.readEventAlone(ctx, "EachWebhookEvent", "webhooks"); err != nil {
+		return err
+	}
+
+	err = adb.wrapInTransaction(ctx, "EachWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, url, types, active, created
+             FROM webhooks
+             WHERE username = $1
+             ORDER BY id`,
+			adb.user)
+		if err != nil {
+			return fmt.Errorf("select webhooks: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			h, err := scanWebhook(rows)
+			if err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(h); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	return nil
+}
+
+// DeleteWebhook deletes the webhook with id, its messages and deliveries.
+func (adb *AuditDB) DeleteWebhook(ctx context.Context, id int64) (err error) {
+	defer observe(ctx, "DeleteWebhook", time.Now(), &err)
+
+	var n int64
+	err = adb.wrapInTransaction(ctx, "DeleteWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1 AND username = $2", id, adb.user)
+		if err != nil {
+			return fmt.Errorf("delete webhook: %w", err)
+		}
+		n, err = res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("affected rows: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "webhooks", AUDIT_OP_DELETE, &id)
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	if n == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+// ownWebhook makes sure the webhook with id belongs to the user of adb.
+func (adb *AuditDB) ownWebhook(ctx context.Context, tx *sql.Tx, id int64) error {
+	var ok bool
+	err := tx.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM webhooks WHERE id = $1 AND username = $2)",
+		id, adb.user).Scan(&ok)
+	if err != nil {
+		return fmt.Errorf("select webhook: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("webhook %d: %w", id, ErrDoesNotExist)
+	}
+	return nil
+}
+
+// readWebhookAlone makes sure the webhook with id belongs to the user of adb and records reading it,
+// in a transaction of its own named op, see readEventAlone.
+func (adb *AuditDB) readWebhookAlone(ctx context.Context, op string, id int64) error {
+	err := adb.wrapInTransaction(ctx, op, func(ctx context.Context, tx *sql.Tx) error {
+		if err := adb.ownWebhook(ctx, tx, id); err != nil {
+			return err
+		}
+		return adb.readEvent(ctx, tx, "webhooks", &id)
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	return nil
+}
+
+// EachWebhookMessage calls fn for every message to the webhook with hookID, newest first.
+// A non-empty state keeps only messages in that state.
+func (adb *AuditDB) EachWebhookMessage(ctx context.Context, hookID int64, state string, fn func(WebhookMessage) error) (err error) {
+	defer observe(ctx, "EachWebhookMessage", time.Now(), &err)
+
+	if err := adb.readWebhookAlone(ctx, "EachWebhookMessageEvent", hookID); err != nil {
+		return err
+	}
+
+	err = adb.wrapInTransaction(ctx, "EachWebhookMessage", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, event_seq, type, state, attempts, next_attempt, created
+             FROM webhook_messages
+             WHERE webhook_id = $1 AND ($2 = '' OR state = $2)
+             ORDER BY id DESC`,
+			hookID, state)
+		if err != nil {
+			return fmt.Errorf("select webhook messages: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var m WebhookMessage
+			err := rows.Scan(&m.ID, &m.Event, &m.Type, &m.State, &m.Attempts, &m.NextAttempt, &m.Created)
+			if err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	return nil
+}
+
+// EachWebhookDelivery calls fn for every attempt at delivering to the webhook with hookID, newest first.
+func (adb *AuditDB) EachWebhookDelivery(ctx context.Context, hookID int64, fn func(WebhookDelivery) error) (err error) {
+	defer observe(ctx, "EachWebhookDelivery", time.Now(), &err)
+
+	if err := adb.readWebhookAlone(ctx, "EachWebhookDeliveryEvent", hookID); err != nil {
+		return err
+	}
+
+	err = adb.wrapInTransaction(ctx, "EachWebhookDelivery", func(ctx context.Context, tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT id, message_id, attempt, ts, status, COALESCE(error, ''), duration_ms
+             FROM webhook_deliveries
+             WHERE webhook_id = $1
+             ORDER BY id DESC`,
+			hookID)
+		if err != nil {
+			return fmt.Errorf("select webhook deliveries: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var d WebhookDelivery
+			err := rows.Scan(&d.ID, &d.MessageID, &d.Attempt, &d.When, &d.Status, &d.Error, &d.Duration)
+			if err != nil {
+				return fmt.Errorf("scanning row: %w", err)
+			}
+			if err := fn(d); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("going over rows: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	return nil
+}
+
+// RetryWebhookMessage brings a dead message back, with all its attempts, to be delivered again.
+func (adb *AuditDB) RetryWebhookMessage(ctx context.Context, hookID, msgID int64) (err error) {
+	defer observe(ctx, "RetryWebhookMessage", time.Now(), &err)
+
+	var n int64
+	err = adb.wrapInTransaction(ctx, "RetryWebhookMessage", func(ctx context.Context, tx *sql.Tx) error {
+		if err := adb.ownWebhook(ctx, tx, hookID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx,
+			`UPDATE webhook_messages
+             SET state = $3, attempts = 0, next_attempt = NOW()
+             WHERE id = $1 AND webhook_id = $2 AND state = $4`,
+			msgID, hookID, WebhookPending, WebhookDead)
+		if err != nil {
+			return fmt.Errorf("update webhook message: %w", err)
+		}
+		n, err = res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("affected rows: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		return insertEvent(ctx, tx, adb.tenant, adb.user, "webhooks", AUDIT_OP_UPDATE, &hookID)
+	})
+	if err != nil {
+		return fmt.Errorf("transaction: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("dead message %d: %w", msgID, ErrDoesNotExist)
+	}
+	return nil
+}
+
+// CreateWebhook adds a webhook, making up a secret if none is given.
+// The secret is only ever shown in this response.
+func (api *Controller) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	hook := Webhook{Active: true}
+	err := decodeBody(r, &hook)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	hook.ID = 0
+	err = validateWebhook(&hook)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	if hook.Secret == "" {
+		hook.Secret, err = newWebhookSecret()
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+	}
+
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	created, err := db.AddWebhook(r.Context(), hook)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	WriteJson(w, created, http.StatusCreated)
+}
+
+func (api *Controller) ReadWebhook(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	if _, ok := mux.Vars(r)["webhookID"]; ok { // List specific
+		id, err := GetIntFromRequest(r, "webhookID")
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		hook, err := db.GetWebhook(r.Context(), int64(id))
+		if err != nil {
+			api.writeError(w, r, err)
+			return
+		}
+		WriteJson(w, hook, http.StatusOK)
+
+	} else { // List all
+		api.writeCollection(w, r, WebhookCSVHeader, func(emit func(Record) error) error {
+			return db.EachWebhook(r.Context(), func(h Webhook) error { return emit(h) })
+		})
+	}
+}
+
+// UpdateWebhook changes the fields in the request. A new secret is shown in the response.
+func (api *Controller) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := GetIntFromRequest(r, "webhookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	hook, err := db.GetWebhook(r.Context(), int64(id))
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	// Pointers, to tell fields left out from those set to their zero value.
+	changes := struct {
+		URL    *string   `json:"url"`
+		Secret *string   `json:"secret"`
+		Types  *[]string `json:"types"`
+		Active *bool     `json:"active"`
+	}{}
+	err = decodeBody(r, &changes)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	if changes.URL != nil {
+		hook.URL = *changes.URL
+	}
+	if changes.Secret != nil {
+		hook.Secret = *changes.Secret
+	}
+	if changes.Types != nil {
+		hook.Types = *changes.Types
+	}
+	if changes.Active != nil {
+		hook.Active = *changes.Active
+	}
+
+	err = validateWebhook(hook)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	err = db.UpdateWebhook(r.Context(), *hook)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	WriteJson(w, hook, http.StatusOK)
+}
+
+func (api *Controller) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	id, err := GetIntFromRequest(r, "webhookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	err = db.DeleteWebhook(r.Context(), int64(id))
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookMessages lists the outbox of a webhook, newest first. Pick a state with ?state=dead.
+func (api *Controller) WebhookMessages(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	id, err := GetIntFromRequest(r, "webhookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", WebhookPending, WebhookDelivered, WebhookDead:
+	default:
+		api.writeError(w, r, invalid("state", "unknown state: '%s'", state))
+		return
+	}
+
+	api.writeCollection(w, r, WebhookMessageCSVHeader, func(emit func(Record) error) error {
+		return db.EachWebhookMessage(r.Context(), int64(id), state, func(m WebhookMessage) error { return emit(m) })
+	})
+}
+
+// WebhookDeliveries lists every attempt at delivering to a webhook, newest first.
+func (api *Controller) WebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	id, err := GetIntFromRequest(r, "webhookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	api.writeCollection(w, r, WebhookDeliveryCSVHeader, func(emit func(Record) error) error {
+		return db.EachWebhookDelivery(r.Context(), int64(id), func(d WebhookDelivery) error { return emit(d) })
+	})
+}
+
+// RetryWebhookMessage gives a dead message new attempts.
+func (api *Controller) RetryWebhookMessage(w http.ResponseWriter, r *http.Request) {
+	db, err := databaser(r)
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	hookID, err := GetIntFromRequest(r, "webhookID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	msgID, err := GetIntFromRequest(r, "messageID")
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+
+	err = db.RetryWebhookMessage(r.Context(), int64(hookID), int64(msgID))
+	if err != nil {
+		api.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
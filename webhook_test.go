@@ -0,0 +1,27 @@
+package krud_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vikblom/krud"
+)
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	resp, err := krud.NewWebhookClient(time.Second).Post(srv.URL, krud.MediaJSON, nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected loopback to be refused but got: %s", resp.Status)
+	}
+	if called {
+		t.Error("expected the request to never reach the server")
+	}
+}
@@ -0,0 +1,367 @@
+package krud
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of a WebhookDispatcher, see the options.
+const (
+	DefaultWebhookAttempts  = 8
+	DefaultWebhookBackoff   = 10 * time.Second
+	DefaultWebhookTimeout   = 10 * time.Second
+	DefaultWebhookInterval  = 5 * time.Second
+	DefaultWebhookBatchSize = 20
+)
+
+// Limits of a WebhookDispatcher.
+const (
+	// maxWebhookBackoff caps the wait between attempts.
+	maxWebhookBackoff = time.Hour
+	// webhookLease is how long a claimed message is left alone by other dispatchers,
+	// it should be well above the time it takes to deliver a batch.
+	webhookLease = 5 * time.Minute
+	// maxWebhookError caps how much of a failure is kept in the delivery log.
+	maxWebhookError = 512
+)
+
+// WebhookDispatcher delivers the messages in the outbox of webhooks, with at least once semantics.
+// Messages that fail are tried again later, backing off exponentially, until they are dead.
+// Dispatchers sharing a database split the messages between them, each message is only
+// claimed by one at a time. Messages are not delivered in any particular order.
+type WebhookDispatcher struct {
+	db  *sql.DB
+	log *log.Logger
+
+	client    *http.Client
+	notifier  Notifier
+	attempts  int
+	backoff   time.Duration
+	interval  time.Duration
+	batchSize int
+}
+
+// WebhookDispatcherOption configures optional parts of a WebhookDispatcher.
+type WebhookDispatcherOption func(*WebhookDispatcher)
+
+// WithWebhookClient sets the client deliveries are made with, its timeout caps each delivery.
+// See NewWebhookClient for one that only delivers to public addresses, like the default.
+func WithWebhookClient(client *http.Client) WebhookDispatcherOption {
+	return func(wd *WebhookDispatcher) {
+		wd.client = client
+	}
+}
+
+// WithWebhookRetry sets how many attempts a message gets before it is dead,
+// and the wait after the first failure, doubling after each.
+func WithWebhookRetry(attempts int, backoff time.Duration) WebhookDispatcherOption {
+	return func(wd *WebhookDispatcher) {
+		wd.attempts = attempts
+		wd.backoff = backoff
+	}
+}
+
+// WithWebhookNotifier wakes up the dispatcher when there may be new messages,
+// between looking for messages every interval.
+func WithWebhookNotifier(n Notifier, interval time.Duration) WebhookDispatcherOption {
+	return func(wd *WebhookDispatcher) {
+		wd.notifier = n
+		wd.interval = interval
+	}
+}
+
+// NewWebhookClient makes deliveries within timeout, to public addresses only.
+// Users choose where webhooks go, so the addresses a host resolves to are checked as it is dialed,
+// lest it points to the database or a metadata service, and redirects are not followed.
+// Proxies from the environment are not used, they would be dialed instead.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublic,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return fmt.Errorf("webhook redirected to %s", req.URL.Redacted())
+		},
+	}
+}
+
+// dialPublic refuses to connect to anything but a public IP address.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook address is not public: %s", host)
+	}
+	return nil
+}
+
+// nonPublicNets are reserved ranges not covered by the methods of net.IP.
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // This network.
+		"100.64.0.0/10",  // Shared address space, carrier-grade NAT.
+		"192.0.0.0/24",   // Protocol assignments.
+		"198.18.0.0/15",  // Benchmarking.
+		"240.0.0.0/4",    // Reserved, and broadcast.
+		"64:ff9b::/96",   // IPv4/IPv6 translation, may reach any IPv4 address.
+		"64:ff9b:1::/48", // Local IPv4/IPv6 translation.
+		"2002::/16",      // 6to4, likewise.
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicIP is false for loopback, private, link-local, multicast and other reserved addresses.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func NewWebhookDispatcher(log *log.Logger, db *sql.DB, opts ...WebhookDispatcherOption) *WebhookDispatcher {
+	wd := &WebhookDispatcher{
+		db:        db,
+		log:       log,
+		client:    NewWebhookClient(DefaultWebhookTimeout),
+		attempts:  DefaultWebhookAttempts,
+		backoff:   DefaultWebhookBackoff,
+		interval:  DefaultWebhookInterval,
+		batchSize: DefaultWebhookBatchSize,
+	}
+	for _, opt := range opts {
+		opt(wd)
+	}
+	if wd.attempts < 1 {
+		wd.attempts = 1
+	}
+	if wd.interval <= 0 {
+		wd.interval = DefaultWebhookInterval
+	}
+	return wd
+}
+
+// Run delivers messages until ctx is done.
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	var wake <-chan struct{}
+	if wd.notifier != nil {
+		var cancel func()
+		wake, cancel = wd.notifier.Subscribe()
+		defer cancel()
+	}
+	ticker := time.NewTicker(wd.interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := wd.Dispatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			wd.log.Errorf("dispatch webhooks: %v", err)
+		}
+		// A full batch, there may be more waiting.
+		if err == nil && n == wd.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// webhookClaim is a message claimed for delivery.
+type webhookClaim struct {
+	id        int64
+	webhookID int64
+	typ       string
+	payload   string
+	attempts  int
+	url       string
+	secret    string
+}
+
+// Dispatch makes an attempt at delivering each of a batch of messages that are due,
+// returning how many there were.
+func (wd *WebhookDispatcher) Dispatch(ctx context.Context) (n int, err error) {
+	claims, err := wd.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range claims {
+		start := time.Now()
+		status, derr := wd.deliver(ctx, c)
+		if err := wd.record(ctx, c, status, derr, time.Since(start)); err != nil {
+			// The lease runs out and the message is tried again.
+			return len(claims), err
+		}
+	}
+	return len(claims), nil
+}
+
+// claim takes a batch of due messages, leasing them so that no other dispatcher takes them meanwhile.
+func (wd *WebhookDispatcher) claim(ctx context.Context) ([]webhookClaim, error) {
+	rows, err := wd.db.QueryContext(ctx,
+		`WITH due AS (
+             SELECT m.id
+             FROM webhook_messages m JOIN webhooks w ON w.id = m.webhook_id
+             WHERE m.state = $1 AND m.next_attempt <= NOW() AND w.active
+             ORDER BY m.id
+             LIMIT $2
+             FOR UPDATE OF m SKIP LOCKED
+         )
+         UPDATE webhook_messages m
+         SET next_attempt = NOW() + make_interval(secs => $3)
+         FROM due, webhooks w
+         WHERE m.id = due.id AND w.id = m.webhook_id
+         RETURNING m.id, m.webhook_id, m.type, m.payload, m.attempts, w.url, w.secret`,
+		WebhookPending, wd.batchSize, webhookLease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("claim webhook messages: %w", err)
+	}
+	defer rows.Close()
+
+	var claims []webhookClaim
+	for rows.Next() {
+		var c webhookClaim
+		if err := rows.Scan(&c.id, &c.webhookID, &c.typ, &c.payload, &c.attempts, &c.url, &c.secret); err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		claims = append(claims, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("going over rows: %w", err)
+	}
+	return claims, nil
+}
+
+// deliver POSTs the message of c, any 2xx response means it was delivered.
+func (wd *WebhookDispatcher) deliver(ctx context.Context, c webhookClaim) (status int, err error) {
+	body := []byte(c.payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", MediaJSON)
+	req.Header.Set("User-Agent", "krud-webhooks")
+	req.Header.Set(WebhookEventHeader, c.typ)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(c.id, 10))
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", ts, SignWebhook(c.secret, ts, body)))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read some of it, so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff is how long to wait after the failed attempt.
+func webhookBackoff(backoff time.Duration, attempt int) time.Duration {
+	wait := backoff << (attempt - 1)
+	if wait > maxWebhookBackoff || wait <= 0 {
+		wait = maxWebhookBackoff
+	}
+	return wait
+}
+
+// record logs the attempt at delivering c and moves the message along.
+func (wd *WebhookDispatcher) record(ctx context.Context, c webhookClaim, status int, derr error, took time.Duration) (err error) {
+	attempt := c.attempts + 1
+	state, result := WebhookDelivered, WebhookDelivered
+	var wait time.Duration
+	var errText *string
+	if derr != nil {
+		state, result = WebhookPending, "failed"
+		wait = webhookBackoff(wd.backoff, attempt)
+		if attempt >= wd.attempts {
+			state, result = WebhookDead, WebhookDead
+		}
+		s := derr.Error()
+		if len(s) > maxWebhookError {
+			s = s[:maxWebhookError]
+		}
+		errText = &s
+	}
+	var statusCode *int
+	if status != 0 {
+		statusCode = &status
+	}
+
+	tx, err := wd.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries (message_id, webhook_id, tenant_id, attempt, ts, status, error, duration_ms)
+         SELECT $1, $2, tenant_id, $3, NOW(), $4, $5, $6 FROM webhook_messages WHERE id = $1`,
+		c.id, c.webhookID, attempt, statusCode, errText, took.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("insert webhook delivery: %w", err)
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE webhook_messages
+         SET state = $2, attempts = $3, next_attempt = NOW() + make_interval(secs => $4)
+         WHERE id = $1`,
+		c.id, state, attempt, wait.Seconds())
+	if err != nil {
+		return fmt.Errorf("update webhook message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	webhookDeliveries.WithLabelValues(result).Inc()
+	if state == WebhookDead {
+		wd.log.Warnf("webhook %d: message %d is dead after %d attempts: %v", c.webhookID, c.id, attempt, derr)
+	}
+	return nil
+}